@@ -0,0 +1,259 @@
+package core
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"unicode"
+
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/speedata/goxml"
+	"github.com/speedata/goxpath"
+	"golang.org/x/net/html"
+	"golang.org/x/text/collate"
+)
+
+// indexEntry is a term for the back-of-book index. Like the table of
+// contents, the entries are collected during shipout and saved in the aux
+// file for the next run.
+type indexEntry struct {
+	Term    string `xml:"term,attr"`
+	Sortkey string `xml:"sortkey,attr,omitempty"`
+	Page    int    `xml:"page,attr"`
+	Dest    string `xml:"dest,attr"`
+}
+
+// indexPages is a page or a range of pages of an index term. dest is the
+// destination on the first page.
+type indexPages struct {
+	first, last int
+	dest        string
+}
+
+func (ip indexPages) String() string {
+	if ip.first == ip.last {
+		return strconv.Itoa(ip.first)
+	}
+	return fmt.Sprintf("%d–%d", ip.first, ip.last)
+}
+
+type indexTerm struct {
+	term  string
+	key   string // sort key, determines the initial letter
+	pages []indexPages
+}
+
+// indexGroup has the terms with the same initial letter.
+type indexGroup struct {
+	letter string
+	terms  []*indexTerm
+}
+
+// checkIndex logs a message if the index is used and has changed since the
+// previous run.
+func (xd *xtsDocument) checkIndex() {
+	if !xd.indexUsed {
+		return
+	}
+	var old []indexEntry
+	if xd.aux != nil {
+		old = xd.aux.Index
+	}
+	if !slices.Equal(old, xd.index) {
+		slog.Warn("The index has changed, another run is necessary (--runs 2)")
+	}
+}
+
+// initialLetter returns the upper case first letter of s or "#" if s does
+// not start with a letter.
+func initialLetter(s string) string {
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			return string(unicode.ToUpper(r))
+		}
+		return "#"
+	}
+	return "#"
+}
+
+// indexGroups returns the index entries of the previous run sorted with the
+// collation and grouped by initial letter. Letters that differ only in case
+// or accents (in the collation) belong to the same group. Consecutive pages
+// are merged to ranges.
+func (xd *xtsDocument) indexGroups(collation string) ([]*indexGroup, error) {
+	xd.indexUsed = true
+	if xd.aux == nil || len(xd.aux.Index) == 0 {
+		return nil, nil
+	}
+	coll, err := getCollator(collation)
+	if err != nil {
+		return nil, err
+	}
+	entries := xd.aux.Index
+	keys := make([]sortKey, len(entries))
+	for i, e := range entries {
+		keys[i] = sortKey{str: cmp.Or(e.Sortkey, e.Term)}
+	}
+	entries = sortByKeys(entries, keys, coll)
+
+	var terms []*indexTerm
+	termPages := make(map[string]map[int]string)
+	for _, e := range entries {
+		pages, ok := termPages[e.Term]
+		if !ok {
+			pages = make(map[int]string)
+			termPages[e.Term] = pages
+			terms = append(terms, &indexTerm{term: e.Term, key: cmp.Or(e.Sortkey, e.Term)})
+		}
+		if _, ok := pages[e.Page]; !ok {
+			pages[e.Page] = e.Dest
+		}
+	}
+
+	// initial letters are compared on the primary level
+	tag, err := collationTag(collation)
+	if err != nil {
+		return nil, err
+	}
+	letters := collate.New(tag, collate.IgnoreCase, collate.IgnoreDiacritics)
+	var groups []*indexGroup
+	for _, t := range terms {
+		pages := termPages[t.term]
+		for _, p := range slices.Sorted(maps.Keys(pages)) {
+			if n := len(t.pages); n > 0 && t.pages[n-1].last+1 == p {
+				t.pages[n-1].last = p
+				continue
+			}
+			t.pages = append(t.pages, indexPages{first: p, last: p, dest: pages[p]})
+		}
+		letter := initialLetter(t.key)
+		if n := len(groups); n > 0 && letters.CompareString(groups[n-1].letter, letter) == 0 {
+			groups[n-1].terms = append(groups[n-1].terms, t)
+			continue
+		}
+		groups = append(groups, &indexGroup{letter: letter, terms: []*indexTerm{t}})
+	}
+	return groups, nil
+}
+
+func cmdIndexEntry(xd *xtsDocument, layoutelt *goxml.Element) (goxpath.Sequence, error) {
+	var err error
+	attValues := &struct {
+		Term    string `sdxml:"mustexist"`
+		Sortkey string
+	}{}
+	if err = getXMLAttributes(xd, layoutelt, attValues); err != nil {
+		return nil, err
+	}
+	xd.indexNumber++
+	entry := indexEntry{
+		Term:    attValues.Term,
+		Sortkey: attValues.Sortkey,
+		Dest:    fmt.Sprintf("index-%d", xd.indexNumber),
+	}
+	dest := getNameDest(entry.Dest)
+	dest.Attributes = node.H{
+		"page": xd.currentPage,
+	}
+	// the page number is known when the page is shipped out
+	dest.ShipoutCallback = func(n node.Node) string {
+		startStop := n.(*node.StartStop)
+		entry.Page = startStop.Attributes["page"].(*page).pagenumber
+		xd.index = append(xd.index, entry)
+		return ""
+	}
+	return goxpath.Sequence{dest}, nil
+}
+
+func cmdBookIndex(xd *xtsDocument, layoutelt *goxml.Element) (goxpath.Sequence, error) {
+	var err error
+	attValues := &struct {
+		Collation *string
+		Leader    string
+		Separator string `sdxml:"default:, "`
+	}{}
+	if err = getXMLAttributes(xd, layoutelt, attValues); err != nil {
+		return nil, err
+	}
+	collation := xd.defaultCollation()
+	if attValues.Collation != nil {
+		collation = *attValues.Collation
+	}
+	groups, err := xd.indexGroups(collation)
+	if err != nil {
+		return nil, newTypesettingError("BookIndex", layoutelt.Line, err.Error())
+	}
+	var ret goxpath.Sequence
+	for _, grp := range groups {
+		p := &html.Node{Type: html.ElementNode, Data: "p"}
+		p.Attr = append(p.Attr, html.Attribute{Key: "class", Val: "indexletter"})
+		p.AppendChild(&html.Node{Type: html.TextNode, Data: grp.letter})
+		ret = append(ret, p)
+		for _, t := range grp.terms {
+			p := &html.Node{Type: html.ElementNode, Data: "p"}
+			p.Attr = append(p.Attr, html.Attribute{Key: "class", Val: "indexentry"})
+			p.AppendChild(&html.Node{Type: html.TextNode, Data: t.term})
+			if attValues.Leader != "" {
+				leader := &html.Node{Type: html.ElementNode, Data: "span"}
+				leader.Attr = append(leader.Attr, html.Attribute{Key: "style", Val: fmt.Sprintf("content: leader(%q)", attValues.Leader)})
+				p.AppendChild(leader)
+			} else {
+				p.AppendChild(&html.Node{Type: html.TextNode, Data: attValues.Separator})
+			}
+			for i, pages := range t.pages {
+				if i > 0 {
+					p.AppendChild(&html.Node{Type: html.TextNode, Data: attValues.Separator})
+				}
+				p.AppendChild(tocLink(pages.dest, pages.String()))
+			}
+			ret = append(ret, p)
+		}
+	}
+	if len(ret) == 0 {
+		slog.Info("BookIndex: no entries, the index is available in the next run")
+	}
+	return ret, nil
+}
+
+// fnIndexEntries returns the index of the previous run as group elements
+// (attribute letter) with entry elements (attribute term) that contain page
+// elements (attributes first, last and dest): sd:index-entries(collation).
+func fnIndexEntries(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
+	collation := xd.defaultCollation()
+	if len(args) > 0 {
+		collation = args[0].Stringvalue()
+	}
+	groups, err := xd.indexGroups(collation)
+	if err != nil {
+		return nil, fmt.Errorf("sd:index-entries(): %w", err)
+	}
+	newElement := func(name string, attrs ...string) *goxml.Element {
+		elt := goxml.NewElement()
+		elt.ID = goxml.NewID()
+		elt.Name = name
+		for i := 0; i < len(attrs); i += 2 {
+			elt.SetAttribute(xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+		}
+		return elt
+	}
+	var seq goxpath.Sequence
+	for _, grp := range groups {
+		g := newElement("group", "letter", grp.letter)
+		for _, t := range grp.terms {
+			e := newElement("entry", "term", t.term)
+			for _, pages := range t.pages {
+				p := newElement("page", "first", strconv.Itoa(pages.first), "last", strconv.Itoa(pages.last), "dest", pages.dest)
+				p.Append(goxml.CharData{ID: goxml.NewID(), Contents: pages.String()})
+				e.Append(p)
+			}
+			g.Append(e)
+		}
+		seq = append(seq, g)
+	}
+	return seq, nil
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/speedata/goxpath"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// getCollator returns a collator for a BCP 47 language tag such as "de",
+// "de-u-co-phonebk" (German phone book order) or "sv-u-ks-level2" (Swedish,
+// case insensitive). Language names like "German" are also accepted. The
+// empty name and "--" give the language neutral Unicode order. With "-u-kn"
+// (for example "en-u-kn"), digits are compared by their numeric value, so
+// "9" sorts before "10".
+func getCollator(name string) (*collate.Collator, error) {
+	tag, err := collationTag(name)
+	if err != nil {
+		return nil, err
+	}
+	opts := []collate.Option{collate.OptionsFromTag(tag)}
+	if numericKey(tag) {
+		opts = append(opts, collate.Numeric)
+	}
+	return collate.New(tag, opts...), nil
+}
+
+// numericKey reports whether the tag has the key kn without a value, which
+// means kn-true in BCP 47. collate.OptionsFromTag only understands kn-true.
+func numericKey(tag language.Tag) bool {
+	ext, ok := tag.Extension('u')
+	if !ok {
+		return false
+	}
+	tokens := ext.Tokens()
+	for i, tok := range tokens {
+		// keys have two letters, values three to eight
+		if tok == "kn" && (i+1 == len(tokens) || len(tokens[i+1]) == 2) {
+			return true
+		}
+	}
+	return false
+}
+
+// collationTag returns the language tag for the collation name, see
+// getCollator.
+func collationTag(name string) (language.Tag, error) {
+	if ln, ok := languageMapping[name]; ok {
+		name = ln
+	}
+	name = strings.ReplaceAll(name, "_", "-")
+	if name == "" || name == "--" {
+		return language.Und, nil
+	}
+	tag, err := language.Parse(name)
+	if err != nil {
+		return language.Und, fmt.Errorf("unknown collation %q", name)
+	}
+	return tag, nil
+}
+
+// defaultCollation returns the name of the default language of the
+// document, which is the default collation for sorting.
+func (xd *xtsDocument) defaultCollation() string {
+	if xd.document.Doc.DefaultLanguage != nil {
+		return xd.document.Doc.DefaultLanguage.Name
+	}
+	return ""
+}
+
+// sortKey is the value a sequence item is sorted by.
+type sortKey struct {
+	str   string
+	num   float64
+	isNum bool
+}
+
+func newSortKey(seq goxpath.Sequence) sortKey {
+	if len(seq) == 1 {
+		switch t := seq[0].(type) {
+		case int:
+			return sortKey{num: float64(t), isNum: true}
+		case float64:
+			return sortKey{num: t, isNum: true}
+		}
+	}
+	return sortKey{str: seq.Stringvalue()}
+}
+
+// sortByKeys sorts the items by the keys with the collator. Numbers are
+// compared by value and sorted before strings. Items with equal keys keep
+// their order.
+func sortByKeys[S ~[]E, E any](seq S, keys []sortKey, coll *collate.Collator) S {
+	idx := make([]int, len(seq))
+	for i := range idx {
+		idx[i] = i
+	}
+	slices.SortStableFunc(idx, func(a, b int) int {
+		ka, kb := keys[a], keys[b]
+		switch {
+		case ka.isNum && kb.isNum:
+			return cmp.Compare(ka.num, kb.num)
+		case ka.isNum:
+			return -1
+		case kb.isNum:
+			return 1
+		}
+		return coll.CompareString(ka.str, kb.str)
+	})
+	ret := make(S, len(seq))
+	for i, j := range idx {
+		ret[i] = seq[j]
+	}
+	return ret
+}
+
+// sortKeys evaluates the key expression for each item of the sequence with
+// the item as the context item.
+func sortKeys(ctx *goxpath.Context, seq goxpath.Sequence, key string) ([]sortKey, error) {
+	keys := make([]sortKey, len(seq))
+	if key == "" || key == "." {
+		for i, itm := range seq {
+			keys[i] = newSortKey(goxpath.Sequence{itm})
+		}
+		return keys, nil
+	}
+	xp := &goxpath.Parser{Ctx: goxpath.CopyContext(ctx)}
+	for i, itm := range seq {
+		xp.Ctx.SetContextSequence(goxpath.Sequence{itm})
+		xp.Ctx.Pos = i + 1
+		res, err := xp.Evaluate(key)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = newSortKey(res)
+	}
+	return keys, nil
+}
+
+// fnSort sorts a sequence: sd:sort(sequence, key expression, collation).
+// The key expression is a string such as '@name' that is evaluated for each
+// item, the default is the item itself.
+func fnSort(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	key := "."
+	if len(args) > 1 {
+		key = args[1].Stringvalue()
+	}
+	collation := ""
+	if len(args) > 2 {
+		collation = args[2].Stringvalue()
+	} else if xd, ok := ctx.Store["xd"].(*xtsDocument); ok {
+		collation = xd.defaultCollation()
+	}
+	coll, err := getCollator(collation)
+	if err != nil {
+		return nil, fmt.Errorf("sd:sort(): %w", err)
+	}
+	keys, err := sortKeys(ctx, args[0], key)
+	if err != nil {
+		return nil, fmt.Errorf("sd:sort(): %w", err)
+	}
+	return sortByKeys(args[0], keys, coll), nil
+}
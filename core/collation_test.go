@@ -0,0 +1,119 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/speedata/goxml"
+	xpath "github.com/speedata/goxpath"
+)
+
+func TestSortCollation(t *testing.T) {
+	data := []struct {
+		items     xpath.Sequence
+		collation string
+		want      string
+	}{
+		{xpath.Sequence{"Öl", "zebra", "Äpfel", "Apfel", "ål"}, "de", "ål,Apfel,Äpfel,Öl,zebra"},
+		{xpath.Sequence{"Öl", "zebra", "Äpfel", "Apfel", "ål"}, "sv", "Apfel,zebra,ål,Äpfel,Öl"},
+		{xpath.Sequence{"Öl", "zebra", "Äpfel", "Apfel", "ål"}, "Swedish", "Apfel,zebra,ål,Äpfel,Öl"},
+		{xpath.Sequence{"b", "A", "a", "B"}, "en-u-ks-level2", "A,a,b,B"},
+		{xpath.Sequence{"Müller", "Mueller", "Muller"}, "de-u-co-phonebk", "Mueller,Müller,Muller"},
+		{xpath.Sequence{"3", "10", "2.5", "20", "1"}, "", "1,10,2.5,20,3"},
+		{xpath.Sequence{"3", "10", "2.5", "20", "1"}, "en-u-kn", "1,2.5,3,10,20"},
+		{xpath.Sequence{"a10", "a9", "b1"}, "en-u-kn-true", "a9,a10,b1"},
+		{xpath.Sequence{"a10", "a9", "b1"}, "en_US", "a10,a9,b1"},
+		{xpath.Sequence{"x", 10, 2.5, 3}, "", "2.5,3,10,x"},
+	}
+	for _, tc := range data {
+		seq, err := fnSort(nil, []xpath.Sequence{tc.items, {"."}, {tc.collation}})
+		if err != nil {
+			t.Errorf("%q: %s", tc.collation, err)
+			continue
+		}
+		if got := seq.StringvalueJoin(","); got != tc.want {
+			t.Errorf("sort %v with %q: got %q, want %q", tc.items, tc.collation, got, tc.want)
+		}
+	}
+	if _, err := getCollator("not a language"); err == nil {
+		t.Error("expected an error for an unknown collation")
+	}
+}
+
+func TestNumericKey(t *testing.T) {
+	data := []struct {
+		collation string
+		want      bool
+	}{
+		{"en", false},
+		{"en-u-kn", true},
+		{"en-u-kn-ks-level2", true},
+		{"en-u-ks-level2-kn", true},
+		{"en-u-kn-true", false}, // handled by collate.OptionsFromTag
+		{"en-u-kn-false", false},
+	}
+	for _, tc := range data {
+		tag, err := collationTag(tc.collation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := numericKey(tag); got != tc.want {
+			t.Errorf("numericKey(%s) = %t, want %t", tc.collation, got, tc.want)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Record match="data">
+    <ForAll select="item" sort="@name" collation="sv">
+      <TestSortForAll/>
+    </ForAll>
+    <TestSortFunction/>
+    <PlaceObject><TextBlock><Paragraph><Value>x</Value></Paragraph></TextBlock></PlaceObject>
+  </Record>
+</Layout>`
+	data := `<data>
+  <item name="Öl" price="3"/>
+  <item name="zebra" price="10"/>
+  <item name="Äpfel" price="2.5"/>
+  <item name="Apfel" price="20"/>
+  <item name="ål" price="1"/>
+</data>`
+	var forall []string
+	registerTestCommand(t, "TestSortForAll", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		seq, err := d.EvaluateXPath(layoutelt, "string(@name)")
+		forall = append(forall, seq.Stringvalue())
+		return nil, err
+	})
+	var got []string
+	registerTestCommand(t, "TestSortFunction", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		for _, expr := range []string{
+			"sd:sort(item, '@name', 'de')/@name",
+			"sd:sort(item, 'number(@price)')/@name",
+		} {
+			seq, err := d.EvaluateXPath(layoutelt, expr)
+			if err != nil {
+				return nil, err
+			}
+			got = append(got, seq.StringvalueJoin(","))
+		}
+		return nil, nil
+	})
+	if _, err := runLayout("sort", layout, data); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Apfel,zebra,ål,Äpfel,Öl"; strings.Join(forall, ",") != want {
+		t.Errorf("ForAll: got %q, want %q", strings.Join(forall, ","), want)
+	}
+	want := []string{
+		"ål,Apfel,Äpfel,Öl,zebra",
+		"ål,Äpfel,Öl,zebra,Apfel",
+	}
+	for i, w := range want {
+		if i >= len(got) || got[i] != w {
+			t.Errorf("sd:sort #%d: got %v, want %q", i, got, w)
+		}
+	}
+}
@@ -10,8 +10,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/net/html"
+	"golang.org/x/text/collate"
 
 	pdf "github.com/boxesandglue/baseline-pdf"
 	"github.com/boxesandglue/boxesandglue/backend/bag"
@@ -36,9 +38,20 @@ type recordEntry struct {
 	layout   *goxml.Element // the layout element containing the Record body
 }
 
+// layoutFunction is an XPath function defined in the layout with <Function>
+// or in Lua with document.register_function().
+type layoutFunction struct {
+	params []string
+	layout *goxml.Element
+	lua    bool
+}
+
 var (
-	dataRecords   []recordEntry
 	dispatchTable map[string]commandFunc
+
+	// layoutFunctionsMu protects layoutFunctionsRegistered.
+	layoutFunctionsMu         sync.Mutex
+	layoutFunctionsRegistered = make(map[string]bool)
 )
 
 func init() {
@@ -50,6 +63,7 @@ func init() {
 		"B":                cmdB,
 		"Br":               cmdBr,
 		"Bookmark":         cmdBookmark,
+		"BookIndex":        cmdBookIndex,
 		"Box":              cmdBox,
 		"Circle":           cmdCircle,
 		"ClearPage":        cmdClearpage,
@@ -67,9 +81,11 @@ func init() {
 		"HTML":             cmdHTML,
 		"I":                cmdI,
 		"Image":            cmdImage,
+		"IndexEntry":       cmdIndexEntry,
 		"Li":               cmdLi,
 		"LoadXML":          cmdLoadXML,
 		"Loop":             cmdLoop,
+		"Lua":              cmdLua,
 		"Mark":             cmdMark,
 		"Message":          cmdMessage,
 		"NextFrame":        cmdNextFrame,
@@ -93,8 +109,10 @@ func init() {
 		"TableHead":        cmdTableHead,
 		"TableRule":        cmdTableRule,
 		"Table":            cmdTable,
+		"TableOfContents":  cmdTableOfContents,
 		"TextBlock":        cmdTextBlock,
 		"Td":               cmdTd,
+		"TOCEntry":         cmdTOCEntry,
 		"Trace":            cmdTrace,
 		"Tr":               cmdTr,
 		"U":                cmdU,
@@ -113,6 +131,9 @@ func dispatch(xd *xtsDocument, layoutelement *goxml.Element) (xpath.Sequence, er
 	var retSequence xpath.Sequence
 	for _, cld := range layoutelement.Children() {
 		if elt, ok := cld.(*goxml.Element); ok {
+			if err := xd.checkRunning(elt); err != nil {
+				return nil, err
+			}
 			if f, ok := dispatchTable[elt.Name]; ok {
 				slog.Debug("Command", "cmd", elt.Name, "line", elt.Line)
 				seq, err := f(xd, elt)
@@ -176,7 +197,7 @@ func cmdAction(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error
 				startStop := n.(*node.StartStop)
 				cp := startStop.Attributes["page"].(*page)
 				m.pagenumber = cp.pagenumber
-				m.id = <-cp.markerids
+				m.id = cp.nextMarkerID()
 				xd.marker[m.name] = m
 				return ""
 			}
@@ -239,7 +260,7 @@ func cmdBookmark(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, err
 		return nil, newTypesettingErrorf("Bookmark", layoutelt.Line, "error parsing select XPath expression %s", err)
 	}
 
-	dest := getNumDest()
+	dest := xd.getNumDest()
 
 	// this callback turns the dest object into an outline object by adding the
 	// dest to the Outlines slice of the PDFWriter.
@@ -596,17 +617,64 @@ func cmdElement(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, erro
 func cmdForall(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
 	var err error
 	attValues := &struct {
-		Select string `sdxml:"noescape"`
+		Select            string `sdxml:"noescape"`
+		Sort              string `sdxml:"noescape"`
+		Collation         *string
+		GroupBy           string `sdxml:"noescape"`
+		GroupAdjacent     string `sdxml:"noescape"`
+		GroupStartingWith string `sdxml:"noescape"`
 	}{}
 	if err = getXMLAttributes(xd, layoutelt, attValues); err != nil {
 		return nil, err
 	}
 	var eval xpath.Sequence
 	oldContext := xd.data.Ctx.GetContextSequence()
+	// sort and grouping expressions may use the sd: functions, restore the
+	// namespaces for a running evaluation (for example a Function called
+	// from XPath)
+	ns := xd.data.Ctx.Namespaces
+	defer func() { xd.data.Ctx.Namespaces = ns }()
+	xd.data.Ctx.Namespaces = layoutelt.Namespaces
 	eval, err = xd.data.Evaluate(attValues.Select)
 	if err != nil {
 		return nil, newTypesettingErrorf("ForAll", layoutelt.Line, "error parsing select XPath expression %s", err)
 	}
+	var coll *collate.Collator
+	if attValues.Sort != "" || attValues.Collation != nil {
+		collation := xd.defaultCollation()
+		if attValues.Collation != nil {
+			collation = *attValues.Collation
+		}
+		if coll, err = getCollator(collation); err != nil {
+			return nil, newTypesettingError("ForAll", layoutelt.Line, err.Error())
+		}
+	}
+
+	var groups []*forAllGroup
+	switch {
+	case attValues.GroupBy != "" && attValues.GroupAdjacent == "" && attValues.GroupStartingWith == "":
+		groups, err = xd.groupBy(eval, attValues.GroupBy)
+	case attValues.GroupAdjacent != "" && attValues.GroupBy == "" && attValues.GroupStartingWith == "":
+		groups, err = xd.groupAdjacent(eval, attValues.GroupAdjacent)
+	case attValues.GroupStartingWith != "" && attValues.GroupBy == "" && attValues.GroupAdjacent == "":
+		groups, err = xd.groupStartingWith(eval, attValues.GroupStartingWith)
+	case attValues.GroupBy != "" || attValues.GroupAdjacent != "" || attValues.GroupStartingWith != "":
+		return nil, newTypesettingError("ForAll", layoutelt.Line, "only one of group-by, group-adjacent and group-starting-with is allowed")
+	}
+	if err != nil {
+		return nil, newTypesettingErrorf("ForAll", layoutelt.Line, "error parsing grouping XPath expression %s", err)
+	}
+	if attValues.GroupBy != "" || attValues.GroupAdjacent != "" || attValues.GroupStartingWith != "" {
+		return xd.forAllGroups(layoutelt, groups, attValues.Sort, coll, oldContext)
+	}
+
+	if coll != nil {
+		keys, err := sortKeys(xd.data.Ctx, eval, attValues.Sort)
+		if err != nil {
+			return nil, newTypesettingErrorf("ForAll", layoutelt.Line, "error parsing sort XPath expression %s", err)
+		}
+		eval = sortByKeys(eval, keys, coll)
+	}
 	var ret xpath.Sequence
 
 	xd.data.Ctx.SetContextSequence(xpath.Sequence{})
@@ -625,6 +693,45 @@ func cmdForall(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error
 	return ret, nil
 }
 
+// forAllGroups runs the child elements of a grouping ForAll once for each
+// group with the first item of the group as the context item. If coll is not
+// nil, the groups are sorted by the sort expression or, if empty, by the
+// grouping key.
+func (xd *xtsDocument) forAllGroups(layoutelt *goxml.Element, groups []*forAllGroup, sort string, coll *collate.Collator, oldContext xpath.Sequence) (xpath.Sequence, error) {
+	if coll != nil {
+		keys := make([]sortKey, len(groups))
+		for i, grp := range groups {
+			key := grp.key
+			if sort != "" || key == nil {
+				xd.groups = append(xd.groups, grp)
+				k, err := sortKeys(xd.data.Ctx, grp.items[:1], sort)
+				xd.groups = xd.groups[:len(xd.groups)-1]
+				if err != nil {
+					return nil, newTypesettingErrorf("ForAll", layoutelt.Line, "error parsing sort XPath expression %s", err)
+				}
+				keys[i] = k[0]
+			} else {
+				keys[i] = newSortKey(key)
+			}
+		}
+		groups = sortByKeys(groups, keys, coll)
+	}
+	var ret xpath.Sequence
+	for i, grp := range groups {
+		xd.groups = append(xd.groups, grp)
+		xd.data.Ctx.SetContextSequence(grp.items[:1])
+		xd.data.Ctx.Pos = i + 1
+		neval, err := dispatch(xd, layoutelt)
+		xd.groups = xd.groups[:len(xd.groups)-1]
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, neval...)
+	}
+	xd.data.Ctx.SetContextSequence(oldContext)
+	return ret, nil
+}
+
 func cmdFunction(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
 	var err error
 	attValues := &struct {
@@ -658,17 +765,60 @@ func cmdFunction(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, err
 	if ns, ok = layoutelt.Namespaces[prefix]; !ok {
 		return nil, newTypesettingErrorf("Function", layoutelt.Line, "unknown name space prefix %s", prefix)
 	}
-	a := func(ctx *xpath.Context, args []xpath.Sequence) (xpath.Sequence, error) {
-		sf := returnEvalBodyLater(layoutelt, xd, ctx)
-		for i := 0; i < len(params); i++ {
-			xd.data.SetVariable(params[i], args[i])
+	if err = registerLayoutFunction(ns, name); err != nil {
+		return nil, newTypesettingError("Function", layoutelt.Line, err.Error())
+	}
+	xd.functions[ns+" "+name] = &layoutFunction{params: params, layout: layoutelt}
+	return nil, nil
+}
+
+// registerLayoutFunction makes the function ns:name known to the XPath
+// parser. The function table of goxpath is shared by all documents in the
+// process, so the registered function only forwards the call to the
+// definition in the document that evaluates the expression. Documents without
+// a definition call the built-in function of the same name, if there is one.
+// Each name is registered once per process.
+func registerLayoutFunction(ns, name string) error {
+	if ns == xpathFunctionsNS {
+		return fmt.Errorf("cannot redefine the XPath function %s", name)
+	}
+	key := ns + " " + name
+	layoutFunctionsMu.Lock()
+	defer layoutFunctionsMu.Unlock()
+	if layoutFunctionsRegistered[key] {
+		return nil
+	}
+	layoutFunctionsRegistered[key] = true
+	builtin := builtinFunctions[key]
+	f := func(ctx *xpath.Context, args []xpath.Sequence) (xpath.Sequence, error) {
+		xd := ctx.Store["xd"].(*xtsDocument)
+		lf, ok := xd.functions[key]
+		if !ok {
+			if builtin == nil {
+				return nil, fmt.Errorf("function %s is not defined in this layout", name)
+			}
+			if len(args) < builtin.MinArg {
+				return nil, fmt.Errorf("function %s expects at least %d arguments, got %d", name, builtin.MinArg, len(args))
+			}
+			if builtin.MaxArg > -1 && len(args) > builtin.MaxArg {
+				return nil, fmt.Errorf("function %s expects at most %d arguments, got %d", name, builtin.MaxArg, len(args))
+			}
+			return builtin.F(ctx, args)
+		}
+		if lf.lua {
+			return xd.callLuaFunction(key, args)
+		}
+		if len(args) != len(lf.params) {
+			return nil, fmt.Errorf("function %s expects %d arguments, got %d", name, len(lf.params), len(args))
+		}
+		sf := returnEvalBodyLater(lf.layout, xd, ctx)
+		for i := 0; i < len(lf.params); i++ {
+			xd.data.SetVariable(lf.params[i], args[i])
 		}
 		return sf()
 	}
-	minArg := len(params)
-	maxArg := len(params)
-	xpath.RegisterFunction(&xpath.Function{Name: name, Namespace: ns, F: a, MinArg: minArg, MaxArg: maxArg})
-	return nil, nil
+	xpath.RegisterFunction(&xpath.Function{Name: name, Namespace: ns, F: f, MinArg: 0, MaxArg: -1})
+	return nil
 }
 
 func cmdSlate(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
@@ -914,7 +1064,7 @@ func cmdImage(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error)
 		return xpath.Sequence{hl}, nil
 	}
 
-	filename, err := xd.cfg.FindFile(attValues.Href)
+	filename, err := xd.findFile(attValues.Href)
 	if err != nil {
 		if xd.imageNotFoundError {
 			slog.Error("Image file not found", "href", attValues.Href, "error", err)
@@ -1044,7 +1194,7 @@ func cmdLoadXML(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, erro
 	} else if attValues.Href != nil {
 		filename = *attValues.Href
 	}
-	xmlPath, err := xd.cfg.FindFile(filename)
+	xmlPath, err := xd.findFile(filename)
 	if xmlPath == "" {
 		slog.Info(fmt.Sprintf("LoadXML file %s does not exist", filename))
 		return nil, nil
@@ -1070,7 +1220,7 @@ func cmdLoadXML(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, erro
 	}
 	dataroot := rootNode.Stringvalue()
 	xd.data.Evaluate("/*")
-	if rec := findRecordByName(dataroot); rec != nil {
+	if rec := xd.findRecordByName(dataroot); rec != nil {
 		_, err = dispatch(xd, rec)
 	}
 	xd.data.Ctx.SetContextSequence(oldContext)
@@ -1122,8 +1272,8 @@ func cmdProcessNode(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence,
 func findRecord(xd *xtsDocument, elt *goxml.Element, mode string) *goxml.Element {
 	var fallback *goxml.Element
 	// Iterate in reverse: last registered = highest priority
-	for i := len(dataRecords) - 1; i >= 0; i-- {
-		rec := dataRecords[i]
+	for i := len(xd.records) - 1; i >= 0; i-- {
+		rec := xd.records[i]
 		if rec.elemName != elt.Name || rec.mode != mode {
 			continue
 		}
@@ -1157,7 +1307,7 @@ func cmdRecord(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error
 	}
 
 	elemName, pred := parseMatch(attValues.Match)
-	dataRecords = append(dataRecords, recordEntry{
+	xd.records = append(xd.records, recordEntry{
 		elemName: elemName,
 		pred:     pred,
 		mode:     attValues.Mode,
@@ -1188,6 +1338,9 @@ func cmdLoop(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error)
 	}
 
 	for i := 1; i < int(f)+1; i++ {
+		if err = xd.checkIteration(layoutelt, i); err != nil {
+			return nil, err
+		}
 		xd.data.SetVariable(attValues.Variable, xpath.Sequence{i})
 		eval, err = dispatch(xd, layoutelt)
 		if err != nil {
@@ -1333,7 +1486,7 @@ func cmdAttachFile(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, e
 		return nil, err
 	}
 
-	filename, err := xd.cfg.FindFile(attValues.Href)
+	filename, err := xd.findFile(attValues.Href)
 	if err != nil {
 		return nil, newTypesettingErrorf("AttachFile", layoutelt.Line, "file not found: %s", attValues.Href)
 	}
@@ -2055,7 +2208,7 @@ func cmdStyleSheet(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, e
 		}
 	} else {
 		var loc string
-		loc, err = FindFile(attrHref)
+		loc, err = xd.findFile(attrHref)
 		if err != nil {
 			return nil, newTypesettingError("StyleSheet", layoutelt.Line, err.Error())
 		}
@@ -2206,11 +2359,7 @@ func cmdTable(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error)
 	root.AppendChild(head)
 	root.AppendChild(body)
 	doc.AppendChild(root)
-	vlistFormatter, err := xd.decodeHTMLFromHTMLNode(doc)
-	if err != nil {
-		return nil, newTypesettingError("Table", layoutelt.Line, err.Error())
-	}
-	vl, err := vlistFormatter(attValues.Width)
+	vl, err := xd.shrinkTable(doc, attValues.Width, xd.tableShrinkCells(tableNode))
 	if err != nil {
 		return nil, newTypesettingError("Table", layoutelt.Line, err.Error())
 	}
@@ -2287,8 +2436,11 @@ func cmdTextBlock(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, er
 	xd.setupPage()
 	var err error
 	attValues := &struct {
-		Width  bag.ScaledPoint
-		Parsep bag.ScaledPoint
+		Fit         string
+		MaxHeight   bag.ScaledPoint
+		MinFontSize bag.ScaledPoint `sdxml:"default:6pt"`
+		Width       bag.ScaledPoint
+		Parsep      bag.ScaledPoint
 	}{}
 	if err = getXMLAttributes(xd, layoutelt, attValues); err != nil {
 		return nil, err
@@ -2308,21 +2460,7 @@ func cmdTextBlock(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, er
 		return nil, err
 	}
 	var vlists node.Node
-	doc := &html.Node{
-		Type: html.DocumentNode,
-	}
-	root := &html.Node{
-		Data: "html",
-		Type: html.ElementNode,
-	}
-	head := &html.Node{
-		Data: "head",
-		Type: html.ElementNode,
-	}
-	body := &html.Node{
-		Data: "body",
-		Type: html.ElementNode,
-	}
+	doc, body := newHTMLDocument()
 
 	var startStopNodes []*node.StartStop
 	for _, itm := range seq {
@@ -2336,27 +2474,27 @@ func cmdTextBlock(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, er
 		}
 	}
 
-	root.AppendChild(head)
-	root.AppendChild(body)
-	doc.AppendChild(root)
-
-	vlistFormatter, err := xd.decodeHTMLFromHTMLNode(doc)
-	if err != nil {
-		return nil, newTypesettingError("TextBlock", layoutelt.Line, err.Error())
+	var vlist *node.VList
+	switch attValues.Fit {
+	case "":
+		vlist, err = xd.formatHTMLDocument(doc, attValues.Width)
+	case "shrink":
+		if attValues.MaxHeight == 0 {
+			return nil, newTypesettingError("TextBlock", layoutelt.Line, `fit="shrink" requires max-height`)
+		}
+		var te *frontend.Text
+		if te, err = xd.cssbuilder.ParseHTMLFromNode(doc); err != nil {
+			break
+		}
+		vlist, err = xd.shrinkToFit([]any{te}, func() (*node.VList, error) {
+			return xd.formatHTMLText(te, attValues.Width)
+		}, attValues.MaxHeight, attValues.MinFontSize, "TextBlock", layoutelt.Line)
+	default:
+		return nil, newTypesettingErrorf("TextBlock", layoutelt.Line, "unknown value for fit: %q", attValues.Fit)
 	}
-	vl, err := vlistFormatter(attValues.Width)
 	if err != nil {
 		return nil, newTypesettingError("TextBlock", layoutelt.Line, err.Error())
 	}
-	te := frontend.NewText()
-
-	te.Items = append(te.Items, vl)
-
-	// if no width is requested, we use the maximum available width
-	vlist, _, err := xd.document.FormatParagraph(te, attValues.Width)
-	if err != nil {
-		return nil, err
-	}
 
 	// Prepend StartStop nodes (from Bookmark, Action/Mark) to the vlist so
 	// they are encountered during PDF shipout.
@@ -2412,11 +2550,15 @@ func cmdTr(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
 func cmdTd(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
 	var err error
 	attValues := &struct {
-		Colspan int `sdxml:"default:1"`
-		Rowspan int `sdxml:"default:1"`
-		Class   string
-		ID      string
-		Style   string
+		Colspan     int `sdxml:"default:1"`
+		Rowspan     int `sdxml:"default:1"`
+		Class       string
+		Fit         string
+		ID          string
+		MaxHeight   bag.ScaledPoint
+		MinFontSize bag.ScaledPoint `sdxml:"default:6pt"`
+		Style       string
+		Width       bag.ScaledPoint
 	}{}
 	if err = getXMLAttributes(xd, layoutelt, attValues); err != nil {
 		return nil, err
@@ -2436,6 +2578,28 @@ func cmdTd(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
 		html.Attribute{Key: "style", Val: attValues.Style},
 		html.Attribute{Key: "class", Val: attValues.Class},
 		html.Attribute{Key: "id", Val: attValues.ID})
+	// with fit="shrink" the table formats the text, see shrink.go
+	switch attValues.Fit {
+	case "":
+	case "shrink":
+		if attValues.MaxHeight == 0 {
+			return nil, newTypesettingError("Td", layoutelt.Line, `fit="shrink" requires max-height`)
+		}
+		sc := &shrinkCell{
+			id:          fmt.Sprintf("shrink-%p", td),
+			width:       attValues.Width,
+			maxheight:   attValues.MaxHeight,
+			minfontsize: attValues.MinFontSize,
+			line:        layoutelt.Line,
+		}
+		if xd.shrinkCells == nil {
+			xd.shrinkCells = make(map[string]*shrinkCell)
+		}
+		xd.shrinkCells[sc.id] = sc
+		td.Attr = append(td.Attr, html.Attribute{Key: "data-vlist-id", Val: sc.id})
+	default:
+		return nil, newTypesettingErrorf("Td", layoutelt.Line, "unknown value for fit: %q", attValues.Fit)
+	}
 	for _, itm := range seq {
 		switch t := itm.(type) {
 		case string:
@@ -2447,11 +2611,17 @@ func cmdTd(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
 		case *html.Node:
 			td.AppendChild(t)
 		case *node.HList:
+			if attValues.Fit != "" {
+				return nil, newTypesettingError("Td", layoutelt.Line, `fit="shrink" requires text contents`)
+			}
 			vl := node.Vpack(t)
 			vlid := fmt.Sprintf("vl-%p", vl)
 			xd.cssbuilder.PendingVLists[vlid] = vl
 			td.Attr = append(td.Attr, html.Attribute{Key: "data-vlist-id", Val: vlid})
 		case *node.VList:
+			if attValues.Fit != "" {
+				return nil, newTypesettingError("Td", layoutelt.Line, `fit="shrink" requires text contents`)
+			}
 			vlid := fmt.Sprintf("vl-%p", t)
 			xd.cssbuilder.PendingVLists[vlid] = t
 			td.Attr = append(td.Attr, html.Attribute{Key: "data-vlist-id", Val: vlid})
@@ -2584,7 +2754,10 @@ func cmdUntil(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error)
 		return nil, err
 	}
 	var ret []xpath.Item
-	for {
+	for i := 1; ; i++ {
+		if err = xd.checkIteration(layoutelt, i); err != nil {
+			return nil, err
+		}
 		seq, err := dispatch(xd, layoutelt)
 		if err != nil {
 			return nil, err
@@ -2644,7 +2817,10 @@ func cmdWhile(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error)
 		return nil, err
 	}
 	var ret []xpath.Item
-	for {
+	for i := 1; ; i++ {
+		if err = xd.checkIteration(layoutelt, i); err != nil {
+			return nil, err
+		}
 		var eval xpath.Sequence
 		eval, err = evaluateXPath(xd, layoutelt.Namespaces, attValues.Test)
 		if err != nil {
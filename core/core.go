@@ -1,10 +1,14 @@
 package core
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -16,17 +20,24 @@ import (
 	"github.com/boxesandglue/boxesandglue/frontend/pdfdraw"
 	"github.com/boxesandglue/csshtml"
 	"github.com/boxesandglue/htmlbag"
+	lua "github.com/speedata/go-lua"
 	"github.com/speedata/goxml"
 	xpath "github.com/speedata/goxpath"
 )
 
 var (
 	// XPath escape sequence for attributes
-	attributeValueRE   = regexp.MustCompile(`\{(.*?)\}`)
-	oneCM              = bag.MustSP("1cm")
-	destinationNumbers = make(chan int)
+	attributeValueRE = regexp.MustCompile(`\{(.*?)\}`)
+	oneCM            = bag.MustSP("1cm")
 	// Version is a semantic version
 	Version string
+	// typesetting serializes the publishing runs: a run sends to the
+	// channel before it starts and receives when it is done. All XTS state
+	// lives in the xtsDocument, but boxes and glue allocates nodes from
+	// package level slabs which must not be used by two goroutines at the
+	// same time. A channel instead of a mutex lets a waiting run give up when
+	// its context is done.
+	typesetting = make(chan struct{}, 1)
 )
 
 const (
@@ -38,43 +49,48 @@ const (
 	LevelNotice = slog.Level(2)
 )
 
-func init() {
-	go genIntegerSequence(destinationNumbers)
-}
-
-func genIntegerSequence(ids chan int) {
-	i := int(0)
-	for {
-		ids <- i
-		i++
-	}
-}
-
 type xtsDocument struct {
-	cfg               *XTSConfig
-	document          *frontend.Document
-	layoutcss         *csshtml.CSS
-	cssbuilder        *htmlbag.CSSBuilder
-	data              *xpath.Parser
-	pages             []*page
-	slates            map[string]*slate
-	defaultGridWidth  bag.ScaledPoint
-	defaultGridHeight bag.ScaledPoint
-	defaultGridGapX   bag.ScaledPoint
-	defaultGridGapY   bag.ScaledPoint
-	defaultGridNx     int
-	defaultGridNy     int
-	masterpages       []*pagetype
-	marker            mapmarker
-	aux               *auxfile // contents of the previous run, if available
-	currentPage       *page
-	currentGrid       *grid
-	currentSlate      *slate
+	ctx                context.Context
+	cfg                *XTSConfig
+	findFile           func(string) (string, error) // cfg.FindFile or the process wide FindFile
+	document           *frontend.Document
+	layoutcss          *csshtml.CSS
+	cssbuilder         *htmlbag.CSSBuilder
+	data               *xpath.Parser
+	pages              []*page
+	slates             map[string]*slate
+	defaultGridWidth   bag.ScaledPoint
+	defaultGridHeight  bag.ScaledPoint
+	defaultGridGapX    bag.ScaledPoint
+	defaultGridGapY    bag.ScaledPoint
+	defaultGridNx      int
+	defaultGridNy      int
+	masterpages        []*pagetype
+	marker             mapmarker
+	aux                *auxfile // contents of the previous run, if available
+	currentPage        *page
+	currentGrid        *grid
+	currentSlate       *slate
 	currentPagenumber  int
 	tracing            VTrace
 	layoutNS           map[string]string
 	imageNotFoundError bool   // if true, missing images are errors instead of warnings
 	missingGlyph       string // “warning” (default), “error”, or “none”
+	records            []recordEntry
+	functions          map[string]*layoutFunction // key is "namespace name"
+	inSetupPage        bool
+	destinationNumber  int                    // next value for getNumDest
+	databases          map[string]*sql.DB     // opened by sd:sql-query()
+	lua                *lua.State             // created on first use, see luaState
+	luaNamespaces      map[string]string      // namespaces of the running <Lua> command
+	groups             []*forAllGroup         // current groups of nested grouping ForAll commands
+	index              []indexEntry           // entries of the back-of-book index in this run
+	indexNumber        int                    // for the names of the index destinations
+	indexUsed          bool                   // the index of the previous run is used
+	toc                []tocEntry             // entries of the table of contents in this run
+	tocNumber          int                    // for the names of the table of contents destinations
+	tocUsed            bool                   // the table of contents of the previous run is used
+	shrinkCells        map[string]*shrinkCell // Td with fit="shrink" not yet formatted by their table
 	// for “global” variables
 	store map[any]any
 }
@@ -89,8 +105,8 @@ func newXTSDocument() *xtsDocument {
 		slates:            make(map[string]*slate),
 		store:             make(map[any]any),
 		marker:            make(mapmarker),
+		functions:         make(map[string]*layoutFunction),
 	}
-	xd.layoutcss.FileFinder = FindFile
 	return xd
 }
 
@@ -154,8 +170,6 @@ versionMismatch:
 	return fmt.Errorf("requested layout version %q and xts version %q don't match", requestedVersion, productVersion)
 }
 
-var inSetupPage bool
-
 func (xd *xtsDocument) setupPage() {
 	if xd.currentSlate != nil {
 		return
@@ -163,10 +177,14 @@ func (xd *xtsDocument) setupPage() {
 	if xd.currentPage != nil {
 		return
 	}
-	if inSetupPage {
+	if xd.inSetupPage {
 		return
 	}
-	inSetupPage = true
+	xd.inSetupPage = true
+	// page creation evaluates XPath expressions with other namespaces, restore
+	// them for a running evaluation (for example sd:grid-width())
+	ns := xd.data.Ctx.Namespaces
+	defer func() { xd.data.Ctx.Namespaces = ns }()
 	p, atPageCreation, err := newPage(xd)
 	if err != nil {
 		slog.Error(err.Error())
@@ -174,7 +192,7 @@ func (xd *xtsDocument) setupPage() {
 	slog.Info("Page created", "wd", p.pagegrid.nx, "ht", p.pagegrid.ny, "page", p.pagenumber, "type", p.pagetype.name)
 	xd.pages = append(xd.pages, p)
 	xd.currentPage = p
-	inSetupPage = false
+	xd.inSetupPage = false
 	if atPageCreation != nil {
 		atPageCreation()
 	}
@@ -188,28 +206,70 @@ type PublishingInfo struct {
 
 // XTSConfig is the configuration file for PDF generation.
 type XTSConfig struct {
-	Datafile     io.Reader
-	DumpFile     io.Writer
-	FindFile     func(string) (string, error)
-	Jobname      string
-	Layoutfile   io.Reader
-	Mode         []string
-	Outfile      io.WriteCloser
-	OutFilename  string
+	Datafile io.Reader
+	DumpFile io.Writer
+	// FindFile resolves file names in the layout. Use the method of a
+	// FileIndex to give each run its own search path. If nil, the process
+	// wide FindFile is used.
+	FindFile   func(string) (string, error)
+	Jobname    string
+	Layoutfile io.Reader
+	// LuaModules are the modules that the Lua code in the layout can load
+	// with require() in addition to the document module.
+	LuaModules  map[string]lua.Function
+	Mode        []string
+	Outfile     io.WriteCloser
+	OutFilename string
+	// Safe disables file, environment and process access in the Lua code of
+	// the layout.
+	Safe         bool
 	SuppressInfo bool
 	Tracing      []string
 	Variables    map[string]any
+	Limits       Limits
 	Info         PublishingInfo
 }
 
-// RunXTS is the entry point
+// RunXTS is the entry point. It is safe to call RunXTS from several
+// goroutines. The runs don't share any state, but they are typeset one after
+// the other.
 func RunXTS(cfg *XTSConfig) error {
+	return RunXTSContext(context.Background(), cfg)
+}
+
+// RunXTSContext is like RunXTS but stops the publishing run when ctx is done
+// or when one of the limits in cfg.Limits is exceeded. The returned
+// TypesettingError names the layout command where the run stopped and wraps
+// the cause, for example context.Canceled.
+func RunXTSContext(ctx context.Context, cfg *XTSConfig) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	select {
+	case typesetting <- struct{}{}:
+		defer func() { <-typesetting }()
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
 	var err error
 	var layoutxml *goxml.XMLDocument
 	slog.Info(fmt.Sprintf("XTS start version %s", Version))
 
+	if maxDuration := cfg.Limits.MaxDuration; maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, maxDuration, fmt.Errorf("time limit of %s exceeded", maxDuration))
+		defer cancel()
+	}
+
 	d := newXTSDocument()
+	defer d.closeDatabases()
+	d.ctx = ctx
 	d.cfg = cfg
+	d.findFile = cfg.FindFile
+	if d.findFile == nil {
+		d.findFile = FindFile
+	}
+	d.layoutcss.FileFinder = d.findFile
 	if d.document, err = frontend.New(cfg.OutFilename); err != nil {
 		return err
 	}
@@ -267,7 +327,7 @@ func RunXTS(cfg *XTSConfig) error {
 		"xd": d,
 	}
 	for k, v := range cfg.Variables {
-		d.data.SetVariable(k, xpath.Sequence{v})
+		d.data.SetVariable(k, variableSequence(v))
 	}
 	d.registerCallbacks()
 
@@ -312,7 +372,7 @@ func RunXTS(cfg *XTSConfig) error {
 	}
 
 	d.data.Ctx.Root()
-	startDispatcher := findRecordByName(rootname)
+	startDispatcher := d.findRecordByName(rootname)
 	if startDispatcher == nil {
 		return fmt.Errorf("cannot find <Record> for root element %s", rootname)
 	}
@@ -323,6 +383,9 @@ func RunXTS(cfg *XTSConfig) error {
 	if d.currentPage != nil {
 		clearPage(d)
 	}
+	if err = d.checkRunning(startDispatcher); err != nil {
+		return err
+	}
 	if err = d.document.Finish(); err != nil {
 		return err
 	}
@@ -344,6 +407,33 @@ func RunXTS(cfg *XTSConfig) error {
 	return nil
 }
 
+// variableSequence converts a value of XTSConfig.Variables to a sequence.
+// Sequences are used as is, slices become sequences and maps (for example
+// from a TOML table) become XPath maps.
+func variableSequence(v any) xpath.Sequence {
+	switch t := v.(type) {
+	case xpath.Sequence:
+		return t
+	case []any:
+		var seq xpath.Sequence
+		for _, itm := range t {
+			seq = append(seq, variableSequence(itm)...)
+		}
+		return seq
+	case map[string]any:
+		m := &xpath.XPathMap{}
+		for _, k := range slices.Sorted(maps.Keys(t)) {
+			m.Entries = append(m.Entries, xpath.MapEntry{Key: k, Value: variableSequence(t[k])})
+		}
+		return xpath.Sequence{m}
+	case int64:
+		return xpath.Sequence{int(t)}
+	case float32:
+		return xpath.Sequence{float64(t)}
+	}
+	return xpath.Sequence{v}
+}
+
 // Add necessary callbacks to boxes and glue callback mechanism for tracing
 // purpose.
 func (xd *xtsDocument) handleMissingGlyph(face *pdf.Face, r rune) {
@@ -495,6 +585,7 @@ type TypesettingError struct {
 	Msg     string
 	Command string // layout command name, e.g. "DefineColor"
 	Line    int    // line in the layout file, 0 if unknown
+	Err     error  // underlying error, if any
 }
 
 func (te TypesettingError) Error() string {
@@ -507,6 +598,11 @@ func (te TypesettingError) Error() string {
 	return te.Msg
 }
 
+// Unwrap returns the underlying error.
+func (te TypesettingError) Unwrap() error {
+	return te.Err
+}
+
 // newTypesettingError creates a TypesettingError with layout position from a
 // layout element. Use this in cmd* functions where layoutelt is available.
 func newTypesettingError(command string, line int, msg string) error {
@@ -1,6 +1,24 @@
 package core
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	lua "github.com/speedata/go-lua"
+	"github.com/speedata/goxml"
+	xpath "github.com/speedata/goxpath"
+	"github.com/speedata/xts/xts/luadb"
+	"golang.org/x/net/html"
+)
 
 func TestVersion(t *testing.T) {
 	data := []struct {
@@ -31,3 +49,604 @@ func TestVersion(t *testing.T) {
 		}
 	}
 }
+
+// runLayout runs XTS in the current directory and returns the number of pages.
+func runLayout(jobname, layout, data string) (int, error) {
+	cfg := &XTSConfig{
+		Datafile:    strings.NewReader(data),
+		Layoutfile:  strings.NewReader(layout),
+		Jobname:     jobname,
+		OutFilename: jobname + ".pdf",
+	}
+	err := RunXTS(cfg)
+	return cfg.Info.Pages, err
+}
+
+func TestConcurrentRuns(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// Both layouts define sd:pages() with a different result. The function
+	// and the Records must not leak from one document into the other.
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Function name="sd:pages"><Value select="%d"/></Function>
+  <Record match="data">
+    <Loop select="sd:pages()">
+      <PlaceObject><TextBlock><Paragraph><Value select="$_loopcounter"/></Paragraph></TextBlock></PlaceObject>
+      <ClearPage/>
+    </Loop>
+  </Record>
+</Layout>`
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	pages := make([]int, 8)
+	for i := range 8 {
+		wg.Go(func() {
+			pages[i], errs[i] = runLayout(fmt.Sprintf("job%d", i), fmt.Sprintf(layout, i%3+1), "<data/>")
+		})
+	}
+	wg.Wait()
+	for i := range 8 {
+		if errs[i] != nil {
+			t.Fatalf("run %d: %s", i, errs[i])
+		}
+		if want := i%3 + 1; pages[i] != want {
+			t.Errorf("run %d: got %d pages, want %d", i, pages[i], want)
+		}
+	}
+}
+
+func TestLayoutFunctionFallback(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// After a layout has replaced sd:even(), other layouts still get the
+	// built-in function.
+	withFunction := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Function name="sd:even"><Param name="n"/><Value select="3"/></Function>
+  <Record match="data">
+    <Loop select="sd:even(2)">
+      <PlaceObject><TextBlock><Paragraph><Value select="$_loopcounter"/></Paragraph></TextBlock></PlaceObject>
+      <ClearPage/>
+    </Loop>
+  </Record>
+</Layout>`
+	withoutFunction := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Record match="data">
+    <Loop select="if (%s) then 2 else 1">
+      <PlaceObject><TextBlock><Paragraph><Value select="$_loopcounter"/></Paragraph></TextBlock></PlaceObject>
+      <ClearPage/>
+    </Loop>
+  </Record>
+</Layout>`
+	for _, tc := range []struct {
+		layout string
+		pages  int
+	}{
+		{withFunction, 3},
+		{fmt.Sprintf(withoutFunction, "sd:even(2)"), 2},
+		{fmt.Sprintf(withoutFunction, "sd:even(3)"), 1},
+	} {
+		pages, err := runLayout("fallback", tc.layout, "<data/>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pages != tc.pages {
+			t.Errorf("got %d pages, want %d", pages, tc.pages)
+		}
+	}
+	if _, err := runLayout("fallback", fmt.Sprintf(withoutFunction, "sd:even()"), "<data/>"); err == nil {
+		t.Error("sd:even() without arguments: got no error")
+	}
+}
+
+func TestRecordsDoNotLeak(t *testing.T) {
+	t.Chdir(t.TempDir())
+	withRecord := `<Layout xmlns="urn:speedata.de/2021/xts/en">
+  <Record match="data"><PlaceObject><TextBlock><Paragraph><Value select="."/></Paragraph></TextBlock></PlaceObject></Record>
+</Layout>`
+	withoutRecord := `<Layout xmlns="urn:speedata.de/2021/xts/en"/>`
+	if _, err := runLayout("first", withRecord, "<data>a</data>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runLayout("second", withoutRecord, "<data>a</data>"); err == nil {
+		t.Error("RunXTS() = nil, want error for missing Record")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	t.Chdir(t.TempDir())
+	const layoutStart = `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Record match="data">
+`
+	data := []struct {
+		name   string
+		body   string
+		limits Limits
+		want   string
+	}{
+		{"loop", `<While test="true()"><SetVariable variable="a" select="1"/></While>`, Limits{MaxLoopIterations: 100}, `While (line 3): publishing run stopped: loop limit of 100 iterations exceeded`},
+		{"time", `<While test="true()"><SetVariable variable="a" select="1"/></While>`, Limits{MaxDuration: 50 * time.Millisecond}, "time limit of 50ms exceeded"},
+		{"pages", `<Loop select="10"><PlaceObject><TextBlock><Paragraph><Value select="$_loopcounter"/></Paragraph></TextBlock></PlaceObject><ClearPage/></Loop>`, Limits{MaxPages: 3}, "page limit of 3 exceeded"},
+	}
+	for _, tc := range data {
+		cfg := &XTSConfig{
+			Datafile:    strings.NewReader("<data/>"),
+			Layoutfile:  strings.NewReader(layoutStart + tc.body + "\n</Record></Layout>"),
+			Jobname:     tc.name,
+			OutFilename: tc.name + ".pdf",
+			Limits:      tc.limits,
+		}
+		err := RunXTS(cfg)
+		if err == nil {
+			t.Errorf("%s: got no error", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, err.Error(), tc.want)
+		}
+	}
+}
+
+func TestRunXTSContextCancel(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg := &XTSConfig{
+		Datafile:    strings.NewReader("<data/>"),
+		Layoutfile:  strings.NewReader(`<Layout xmlns="urn:speedata.de/2021/xts/en"><Record match="data"><ClearPage/></Record></Layout>`),
+		Jobname:     "cancel",
+		OutFilename: "cancel.pdf",
+	}
+	if err := RunXTSContext(ctx, cfg); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunXTSContext() = %v, want context.Canceled", err)
+	}
+
+	// a run that waits for another run stops when its context is done
+	typesetting <- struct{}{}
+	defer func() { <-typesetting }()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := RunXTSContext(ctx, cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RunXTSContext() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// registerTestCommand registers the layout command for the test and removes
+// it when the test is finished, so the tests can run more than once.
+func registerTestCommand(t *testing.T, name string, f CommandFunc) {
+	t.Helper()
+	if err := RegisterCommand(name, f); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { delete(dispatchTable, name) })
+}
+
+func TestRegisterCommand(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var price string
+	var columns, pagenumber int
+	registerTestCommand(t, "PriceTag", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		attValues := &struct {
+			Price string `sdxml:"mustexist"`
+		}{}
+		if err := d.Attributes(layoutelt, attValues); err != nil {
+			return nil, err
+		}
+		price = attValues.Price
+		columns = d.Grid().Columns
+		pagenumber = d.PageNumber()
+		return xpath.Sequence{price + " EUR"}, nil
+	})
+	if err := RegisterCommand("PriceTag", nil); err == nil {
+		t.Error("RegisterCommand() with existing name: got no error")
+	}
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en">
+  <Record match="data">
+    <PlaceObject><TextBlock><Paragraph><PriceTag price="{@price * 2}"/></Paragraph></TextBlock></PlaceObject>
+  </Record>
+</Layout>`
+	if _, err := runLayout("pricetag", layout, `<data price="21"/>`); err != nil {
+		t.Fatal(err)
+	}
+	if price != "42" {
+		t.Errorf("price = %q, want 42", price)
+	}
+	if columns == 0 || pagenumber != 1 {
+		t.Errorf("columns = %d, page = %d, want columns > 0 and page 1", columns, pagenumber)
+	}
+}
+
+func TestLua(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Lua>
+    local document = require("document")
+    function shout(s, n)
+      return string.upper(s) .. string.rep("!", n)
+    end
+    document.register_function("urn:example", "double", function(x) return x * 2 end)
+  </Lua>
+  <Record match="data">
+    <SetVariable variable="price" select="10"/>
+    <Lua>
+      local document = require("document")
+      local node = document.node()
+      document.variables.name = node.attribs.name
+      document.variables.words = { "a", "b", "c" }
+      document.variables.total = document.variables.price + document.xpath("count(item)")
+    </Lua>
+    <SetVariable variable="shout" select="sd:lua('shout', $name, 2)"/>
+    <SetVariable variable="double" select="ex:double(21)" xmlns:ex="urn:example"/>
+    <SetVariable variable="returned"><Lua>return "x", 2</Lua></SetVariable>
+    <PlaceObject><TextBlock><Paragraph><Value select="$shout, count($words), $total, $double, $returned"/></Paragraph></TextBlock></PlaceObject>
+  </Record>
+</Layout>`
+	var got string
+	registerTestCommand(t, "TestLuaResult", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		seq, err := d.EvaluateXPath(layoutelt, "string-join(($shout, string(count($words)), string($total), string($double), $returned), ' ')")
+		got = seq.Stringvalue()
+		return nil, err
+	})
+	layout = strings.Replace(layout, "<PlaceObject>", "<TestLuaResult/><PlaceObject>", 1)
+	if _, err := runLayout("lua", layout, `<data name="xts"><item/><item/></data>`); err != nil {
+		t.Fatal(err)
+	}
+	if want := "XTS!! 3 12 42 x 2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLuaStructuredVariables(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en">
+  <Record match="data">
+    <Lua>
+      local document = require("document")
+      document.variables.cfg = { title = "Catalog", sizes = { 1, 2, 3 } }
+      document.variables.list = { type = "element", name = "list",
+        { type = "element", name = "item", attribs = { id = "a" }, "first" },
+        { type = "element", name = "item", attribs = { id = "b", ["urn:x:code"] = "X" }, "second" } }
+      document.variables.back = document.variables.cfg.title .. #document.variables.list
+    </Lua>
+    <TestLuaVariables/>
+    <PlaceObject><TextBlock><Paragraph><Value>x</Value></Paragraph></TextBlock></PlaceObject>
+  </Record>
+</Layout>`
+	var got string
+	registerTestCommand(t, "TestLuaVariables", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		seq, err := d.EvaluateXPath(layoutelt, "string-join(($cfg('title'), string(sum($cfg('sizes'))), $list/item[@id='b'], $list/item[2]/@*[namespace-uri() = 'urn:x' and local-name() = 'code'], $back, string($opts('level'))), ' ')")
+		got = seq.Stringvalue()
+		return nil, err
+	})
+	cfg := &XTSConfig{
+		Datafile:    strings.NewReader(`<data/>`),
+		Layoutfile:  strings.NewReader(layout),
+		Jobname:     "luavariables",
+		OutFilename: "luavariables.pdf",
+		Variables:   map[string]any{"opts": map[string]any{"level": int64(2)}},
+	}
+	if err := RunXTS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Catalog 6 second X Catalog2 2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLuaSafe(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en">
+  <Record match="data">
+    <SetVariable variable="restricted"><Lua>return io == nil and os.execute == nil and os.getenv == nil and dofile == nil</Lua></SetVariable>
+    <SetVariable variable="modules"><Lua>return package.preload.http == nil and package.preload.json ~= nil</Lua></SetVariable>
+    <TestLuaSafe/>
+    <PlaceObject><TextBlock><Paragraph><Value>x</Value></Paragraph></TextBlock></PlaceObject>
+  </Record>
+</Layout>`
+	var got string
+	registerTestCommand(t, "TestLuaSafe", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		seq, err := d.EvaluateXPath(layoutelt, "string-join((string($restricted), string($modules)), ' ')")
+		got = seq.Stringvalue()
+		return nil, err
+	})
+	cfg := &XTSConfig{
+		Datafile:    strings.NewReader(`<data/>`),
+		Layoutfile:  strings.NewReader(layout),
+		Jobname:     "luasafe",
+		LuaModules:  map[string]lua.Function{"json": func(l *lua.State) int { l.NewTable(); return 1 }},
+		OutFilename: "luasafe.pdf",
+		Safe:        true,
+	}
+	if err := RunXTS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want := "true true"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSQLQuery(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db, err := luadb.OpenDatabase("products.db", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE products (id INTEGER, name TEXT, price REAL, note TEXT)",
+		"INSERT INTO products VALUES (1, 'Pen', 1.5, NULL), (2, 'Ink', 7.25, 'blue')",
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Record match="data">
+    <TestSQLQuery/>
+    <PlaceObject><TextBlock><Paragraph><Value>x</Value></Paragraph></TextBlock></PlaceObject>
+  </Record>
+</Layout>`
+	var got string
+	registerTestCommand(t, "TestSQLQuery", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		rows, err := d.EvaluateXPath(layoutelt, "sd:sql-query('products.db', 'SELECT * FROM products WHERE price > ? ORDER BY id', 1)")
+		if err != nil {
+			return nil, err
+		}
+		if _, err = d.EvaluateXPath(layoutelt, "sd:sql-query('products.db', 'DELETE FROM products')"); err == nil {
+			t.Error("sd:sql-query() with DELETE: got no error")
+		}
+		d.SetVariable("rows", rows)
+		seq, err := d.EvaluateXPath(layoutelt, "string-join((string(count($rows)), $rows[2]/name, string(sum($rows/price)), string(count($rows/note))), ' ')")
+		got = seq.Stringvalue()
+		return nil, err
+	})
+	if _, err = runLayout("sqlquery", layout, `<data/>`); err != nil {
+		t.Fatal(err)
+	}
+	if want := "2 Ink 8.75 1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTableOfContents(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Record match="data">
+    <PlaceObject><TextBlock><TableOfContents maxlevel="2"/></TextBlock></PlaceObject>
+    <TestTOC/>
+    <ClearPage/>
+    <ForAll select="chapter">
+      <PlaceObject>
+        <TextBlock>
+          <TOCEntry select="@title" level="1"/>
+          <Paragraph><Value select="@title"/></Paragraph>
+          <ForAll select="section">
+            <TOCEntry select="@title" level="2" name="{@id}"/>
+            <Paragraph><Value select="@title"/></Paragraph>
+          </ForAll>
+        </TextBlock>
+      </PlaceObject>
+      <ClearPage/>
+    </ForAll>
+  </Record>
+</Layout>`
+	data := `<data>
+  <chapter title="Introduction"><section id="sec-a" title="Scope"/></chapter>
+  <chapter title="Usage"><section id="sec-b" title="Install"/></chapter>
+</data>`
+	var got string
+	registerTestCommand(t, "TestTOC", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		seq, err := d.EvaluateXPath(layoutelt, "string-join(for $e in sd:toc-entries() return $e/@level || ' ' || $e || ' ' || $e/@page || ' ' || $e/@dest, '; ')")
+		got = seq.Stringvalue()
+		return nil, err
+	})
+	if _, err := runLayout("toc", layout, data); err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("first run: got %q, want no entries", got)
+	}
+	if _, err := runLayout("toc", layout, data); err != nil {
+		t.Fatal(err)
+	}
+	want := "1 Introduction 2 toc-1; 2 Scope 2 sec-a; 1 Usage 3 toc-3; 2 Install 3 sec-b"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Record match="data">
+    <PlaceObject><TextBlock><BookIndex/></TextBlock></PlaceObject>
+    <TestIndex/>
+    <ClearPage/>
+    <ForAll select="page">
+      <PlaceObject>
+        <TextBlock>
+          <ForAll select="term">
+            <IndexEntry term="{.}" sortkey="{@sortkey}"/>
+          </ForAll>
+          <Paragraph><Value select="position()"/></Paragraph>
+        </TextBlock>
+      </PlaceObject>
+      <ClearPage/>
+    </ForAll>
+  </Record>
+</Layout>`
+	data := `<data>
+  <page><term>Screws</term><term>apples</term></page>
+  <page><term>Screws</term><term>Äxte</term></page>
+  <page><term>Screws</term><term>Bolts</term><term>Screws</term></page>
+  <page><term sortkey="Bolts, 3 mm">Bolts, 3mm</term></page>
+  <page><term>Screws</term><term>2-way nuts</term></page>
+  <page><term>Size 10</term><term>Size 9</term></page>
+</data>`
+	var got string
+	registerTestCommand(t, "TestIndex", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		seq, err := d.EvaluateXPath(layoutelt, "string-join(for $g in sd:index-entries('de-u-kn') return $g/@letter || ': ' || string-join(for $e in $g/entry return $e/@term || ' ' || string-join($e/page, ','), '; '), ' | ')")
+		got = seq.Stringvalue()
+		return nil, err
+	})
+	if _, err := runLayout("index", layout, data); err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("first run: got %q, want no entries", got)
+	}
+	if _, err := runLayout("index", layout, data); err != nil {
+		t.Fatal(err)
+	}
+	want := "#: 2-way nuts 6 | A: apples 2; Äxte 3 | B: Bolts 4; Bolts, 3mm 5 | S: Screws 2–4,6; Size 9 7; Size 10 7"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTextMeasure(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <StyleSheet>
+    p { font-size: 10pt; line-height: 12pt; }
+    .large { font-size: 20pt; line-height: 24pt; }
+  </StyleSheet>
+  <Record match="data">
+    <TestTextMeasure/>
+    <PlaceObject><TextBlock><Paragraph><Value>x</Value></Paragraph></TextBlock></PlaceObject>
+  </Record>
+</Layout>`
+	results := map[string]float64{}
+	registerTestCommand(t, "TestTextMeasure", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		for name, expr := range map[string]string{
+			"small":     "sd:to-unit(sd:text-width('Hello world'), 'pt')",
+			"large":     "sd:to-unit(sd:text-width('Hello world', 'large'), 'pt')",
+			"oneline":   "sd:to-unit(sd:text-height('Hello world', '10cm'), 'pt')",
+			"multiline": "sd:to-unit(sd:text-height('Hello world, hello world, hello world', 1), 'pt')",
+		} {
+			seq, err := d.EvaluateXPath(layoutelt, expr)
+			if err != nil {
+				return nil, err
+			}
+			results[name] = seq[0].(float64)
+		}
+		return nil, nil
+	})
+	if _, err := runLayout("textmeasure", layout, "<data/>"); err != nil {
+		t.Fatal(err)
+	}
+	if results["small"] <= 0 || math.Abs(results["large"]-2*results["small"]) > 0.1 {
+		t.Errorf("text-width: got %v (10pt) and %v (20pt), want positive and twice the width", results["small"], results["large"])
+	}
+	if results["oneline"] <= 0 || results["multiline"] <= results["oneline"] {
+		t.Errorf("text-height: got %v (one line) and %v (narrow), want the narrow text to be higher", results["oneline"], results["multiline"])
+	}
+}
+
+func TestShrinkToFit(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <StyleSheet>.name { font-size: 20pt; } td.article { font-size: 20pt; padding: 3pt; }</StyleSheet>
+  <Record match="data">
+    <TestShrink/>
+    <PlaceObject>
+      <TextBlock width="4cm" fit="shrink" max-height="1cm">
+        <Paragraph class="name"><Value>Screws, stainless steel, countersunk</Value></Paragraph>
+      </TextBlock>
+    </PlaceObject>
+    <TestShrinkTable>
+      <Table width="3cm">
+        <Tr><Td class="article" fit="shrink" max-height="1cm"><Paragraph><Value>Hexagon nuts, </Value><Span style="font-size: 24pt"><Value>galvanized</Value></Span></Paragraph></Td></Tr>
+      </Table>
+    </TestShrinkTable>
+  </Record>
+</Layout>`
+	type result struct {
+		height bag.ScaledPoint
+		sizes  []bag.ScaledPoint
+	}
+	results := map[string]result{}
+	registerTestCommand(t, "TestShrink", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		for name, maxheight := range map[string]bag.ScaledPoint{
+			"fits":   bag.MustSP("10cm"),
+			"shrink": bag.MustSP("1cm"),
+			"min":    bag.MustSP("1pt"),
+		} {
+			// an 8pt article number before the 20pt name
+			doc, body := newHTMLDocument()
+			p := &html.Node{Type: html.ElementNode, Data: "p", Attr: []html.Attribute{{Key: "class", Val: "name"}}}
+			span := &html.Node{Type: html.ElementNode, Data: "span", Attr: []html.Attribute{{Key: "style", Val: "font-size: 8pt"}}}
+			span.AppendChild(&html.Node{Type: html.TextNode, Data: "A-1234 "})
+			p.AppendChild(span)
+			p.AppendChild(&html.Node{Type: html.TextNode, Data: "Screws, stainless steel, countersunk"})
+			body.AppendChild(p)
+			te, err := d.xd.cssbuilder.ParseHTMLFromNode(doc)
+			if err != nil {
+				return nil, err
+			}
+			vl, err := d.xd.shrinkToFit([]any{te}, func() (*node.VList, error) {
+				return d.xd.formatHTMLText(te, bag.MustSP("4cm"))
+			}, maxheight, bag.MustSP("8pt"), "TestShrink", layoutelt.Line)
+			if err != nil {
+				return nil, err
+			}
+			results[name] = result{vl.Height + vl.Depth, fontSizes(vl.List, nil)}
+		}
+		return nil, nil
+	})
+	registerTestCommand(t, "TestShrinkTable", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		seq, err := dispatch(d.xd, layoutelt)
+		if err != nil {
+			return nil, err
+		}
+		vl := seq[0].(*node.VList)
+		results["table"] = result{vl.Height + vl.Depth, fontSizes(vl.List, nil)}
+		return nil, nil
+	})
+	if _, err := runLayout("shrink", layout, "<data/>"); err != nil {
+		t.Fatal(err)
+	}
+	// ratio checks that the text has two font sizes with the given ratio
+	ratio := func(name string, sizes []bag.ScaledPoint, want float64) {
+		t.Helper()
+		if len(sizes) != 2 {
+			t.Errorf("%s: got font sizes %v, want two sizes", name, sizes)
+			return
+		}
+		if got := float64(sizes[1]) / float64(sizes[0]); got < want*0.98 || got > want*1.02 {
+			t.Errorf("%s: got font sizes %v, want the ratio %.2f", name, sizes, want)
+		}
+	}
+	if sizes := results["fits"].sizes; len(sizes) != 2 || sizes[0] != bag.MustSP("8pt") || sizes[1] != bag.MustSP("20pt") {
+		t.Errorf("fits: got font sizes %v, want 8pt and 20pt", sizes)
+	}
+	// the largest text is shrunk down to the minimum font size
+	if r := results["shrink"]; r.height > bag.MustSP("1cm") || len(r.sizes) != 2 || r.sizes[1] >= bag.MustSP("20pt") || r.sizes[1] < bag.MustSP("8pt") {
+		t.Errorf("shrink: got height %s and font sizes %v, want at most 1cm and between 8pt and 20pt", r.height, r.sizes)
+	}
+	ratio("shrink", results["shrink"].sizes, 2.5)
+	if sizes := results["min"].sizes; len(sizes) != 2 || max(sizes[1]-bag.MustSP("8pt"), bag.MustSP("8pt")-sizes[1]) > bag.Factor/100 {
+		t.Errorf("min: got font sizes %v, want 8pt for the name", sizes)
+	}
+	// the padding of the cell is not part of the maximum height
+	if r := results["table"]; r.height > bag.MustSP("1cm")+bag.MustSP("6pt") || len(r.sizes) != 2 || r.sizes[1] >= bag.MustSP("24pt") || r.sizes[1] < bag.MustSP("6pt") {
+		t.Errorf("table: got height %s and font sizes %v, want at most 1cm+6pt and between 6pt and 24pt", r.height, r.sizes)
+	}
+	ratio("table", results["table"].sizes, 1.2)
+}
+
+// fontSizes returns the font sizes of the glyphs in the list in the order of
+// their first use.
+func fontSizes(n node.Node, sizes []bag.ScaledPoint) []bag.ScaledPoint {
+	for e := n; e != nil; e = e.Next() {
+		switch t := e.(type) {
+		case *node.Glyph:
+			if t.Font != nil && !slices.Contains(sizes, t.Font.Size) {
+				sizes = append(sizes, t.Font.Size)
+			}
+		case *node.HList:
+			sizes = fontSizes(t.List, sizes)
+		case *node.VList:
+			sizes = fontSizes(t.List, sizes)
+		}
+	}
+	return sizes
+}
@@ -88,6 +88,39 @@ func (xd *xtsDocument) decodeHTMLFromHTMLNode(input *html.Node) (frontend.Format
 	return ftv, nil
 }
 
+// newHTMLDocument returns an empty HTML document and its body element.
+func newHTMLDocument() (*html.Node, *html.Node) {
+	doc := &html.Node{Type: html.DocumentNode}
+	root := &html.Node{Type: html.ElementNode, Data: "html"}
+	body := &html.Node{Type: html.ElementNode, Data: "body"}
+	root.AppendChild(&html.Node{Type: html.ElementNode, Data: "head"})
+	root.AppendChild(body)
+	doc.AppendChild(root)
+	return doc, body
+}
+
+// formatHTMLDocument formats the HTML document with the width the same way
+// as a TextBlock.
+func (xd *xtsDocument) formatHTMLDocument(doc *html.Node, width bag.ScaledPoint) (*node.VList, error) {
+	te, err := xd.cssbuilder.ParseHTMLFromNode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return xd.formatHTMLText(te, width)
+}
+
+// formatHTMLText formats the parsed HTML text with the width.
+func (xd *xtsDocument) formatHTMLText(te *frontend.Text, width bag.ScaledPoint) (*node.VList, error) {
+	vl, err := xd.cssbuilder.CreateVlist(te, width)
+	if err != nil {
+		return nil, err
+	}
+	wrapper := frontend.NewText()
+	wrapper.Items = append(wrapper.Items, vl)
+	vlist, _, err := xd.document.FormatParagraph(wrapper, width)
+	return vlist, err
+}
+
 // parseHTMLText takes well formed XML input and interprets this as HTML.
 func (xd *xtsDocument) parseHTMLText(input string) (*html.Node, error) {
 	s := strings.NewReader(input)
@@ -0,0 +1,538 @@
+package core
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/speedata/goxpath"
+)
+
+// dateLayouts are the formats sd:parse-date() tries if no format is given.
+var dateLayouts = []struct {
+	layout  string
+	hasTime bool
+}{
+	{"2006-01-02", false},
+	{"2006-01-02T15:04:05Z07:00", true},
+	{"2006-01-02T15:04:05", true},
+	{"2006-01-02T15:04", true},
+	{"2006-01-02 15:04:05", true},
+	{"2006-01-02 15:04", true},
+	{"2.1.2006", false},
+	{"2.1.2006 15:04:05", true},
+	{"2.1.2006 15:04", true},
+	{"2.1.06", false},
+}
+
+// getDateNames returns the month and day names for a language name
+// ("German") or language code ("de", "en_US").
+func getDateNames(name string) (*dateNames, string, error) {
+	if ln, ok := languageMapping[name]; ok {
+		name = ln
+	}
+	code, _, _ := strings.Cut(strings.ToLower(strings.ReplaceAll(name, "_", "-")), "-")
+	switch code {
+	case "", "--":
+		code = "en"
+	case "grc":
+		code = "el"
+	}
+	dn, ok := dateNamesMapping[code]
+	if !ok {
+		return nil, "", fmt.Errorf("no month and day names for language %q", name)
+	}
+	return dn, code, nil
+}
+
+// excelSerialToTime converts a date in Excel's 1900 date system to a time.
+// Excel treats 1900 as a leap year, so dates before March 1, 1900 are one
+// day off.
+func excelSerialToTime(f float64) time.Time {
+	base := time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+	if f < 61 {
+		base = base.AddDate(0, 0, 1)
+	}
+	days := math.Floor(f)
+	secs := math.Round((f - days) * 86400)
+	return base.AddDate(0, 0, int(days)).Add(time.Duration(secs) * time.Second)
+}
+
+// datePictureLayout converts a picture such as "[D01].[M01].[Y0001]
+// [H01]:[m01]" (see formatDatePicture) to a Go time layout. The bool is true
+// if the picture has a time component.
+func datePictureLayout(picture string) (string, bool, error) {
+	var sb strings.Builder
+	hasTime := false
+	for i := 0; i < len(picture); i++ {
+		c := picture[i]
+		if c == '[' || c == ']' {
+			if i+1 < len(picture) && picture[i+1] == c {
+				sb.WriteByte(c)
+				i++
+				continue
+			}
+		}
+		if c != '[' {
+			if c >= '0' && c <= '9' {
+				return "", false, fmt.Errorf("digits outside of a component in picture %q", picture)
+			}
+			sb.WriteByte(c)
+			continue
+		}
+		end := strings.IndexByte(picture[i:], ']')
+		if end < 0 {
+			return "", false, fmt.Errorf("unclosed '[' in picture %q", picture)
+		}
+		component := strings.Join(strings.Fields(picture[i+1:i+end]), "")
+		i += end
+		if component == "" {
+			continue
+		}
+		specifier := component[0]
+		presentation, width, _ := strings.Cut(component[1:], ",")
+		_, maxWidth := parseWidth(width)
+		twoDigits := presentation == "01"
+		var layout string
+		switch specifier {
+		case 'Y':
+			layout = "2006"
+			if twoDigits || maxWidth == 2 {
+				layout = "06"
+			}
+		case 'M':
+			switch {
+			case presentation == "Nn" && maxWidth == 3:
+				layout = "Jan"
+			case presentation == "Nn":
+				layout = "January"
+			case twoDigits:
+				layout = "01"
+			case presentation == "" || presentation == "1":
+				layout = "1"
+			}
+		case 'D':
+			layout = "2"
+			if twoDigits {
+				layout = "02"
+			}
+		case 'H':
+			layout = "15"
+		case 'h':
+			layout = "3"
+			if twoDigits {
+				layout = "03"
+			}
+		case 'P':
+			layout = "PM"
+		case 'm':
+			layout = "04"
+		case 's':
+			layout = "05"
+		}
+		if layout == "" {
+			return "", false, fmt.Errorf("component [%s] cannot be parsed", component)
+		}
+		if strings.IndexByte("HhPms", specifier) >= 0 {
+			hasTime = true
+		}
+		sb.WriteString(layout)
+	}
+	return sb.String(), hasTime, nil
+}
+
+// parseDateString parses a date in one of the formats of dateLayouts. If
+// picture is not empty, it is used instead (see datePictureLayout). The bool
+// is true if the date has a time.
+func parseDateString(s, picture string) (time.Time, bool, error) {
+	s = strings.TrimSpace(s)
+	if picture != "" {
+		layout, hasTime, err := datePictureLayout(picture)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return t, false, fmt.Errorf("cannot parse date %q with picture %q", s, picture)
+		}
+		return t, hasTime, nil
+	}
+	for _, dl := range dateLayouts {
+		if t, err := time.Parse(dl.layout, s); err == nil {
+			return t, dl.hasTime, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("cannot parse date %q", s)
+}
+
+// itemToTime converts an xs:date, xs:dateTime, a number (an Excel serial
+// number) or a string to a time. Strings are never read as serial numbers,
+// use number() to convert them. The bool is true if the value has a time.
+func itemToTime(itm goxpath.Item) (time.Time, bool, error) {
+	switch t := itm.(type) {
+	case goxpath.XSDate:
+		return time.Time(t), false, nil
+	case goxpath.XSDateTime:
+		return time.Time(t), true, nil
+	case int:
+		return excelSerialToTime(float64(t)), false, nil
+	case float64:
+		return excelSerialToTime(t), t != math.Floor(t), nil
+	}
+	return parseDateString(goxpath.ItemStringvalue(itm), "")
+}
+
+func timeToItem(t time.Time, hasTime bool) goxpath.Item {
+	if hasTime {
+		return goxpath.XSDateTime(t)
+	}
+	return goxpath.XSDate(t)
+}
+
+// addDuration adds the duration to t. Adding months keeps the day unless the
+// new month is shorter: January 31 plus one month is February 28 (or 29).
+func addDuration(t time.Time, d goxpath.XSDuration) time.Time {
+	sign := 1
+	if d.Negative {
+		sign = -1
+	}
+	if months := sign * (d.Years*12 + d.Months); months != 0 {
+		y, m, day := t.Date()
+		first := time.Date(y, m+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+		lastDay := first.AddDate(0, 1, -1).Day()
+		t = first.AddDate(0, 0, min(day, lastDay)-1)
+	}
+	t = t.AddDate(0, 0, sign*d.Days)
+	dur := time.Duration(d.Hours)*time.Hour + time.Duration(d.Minutes)*time.Minute + time.Duration(d.Seconds*float64(time.Second))
+	return t.Add(time.Duration(sign) * dur)
+}
+
+// ordinalSuffix returns the suffix for ordinal numbers ("st" in 1st).
+func ordinalSuffix(n int, lang string) string {
+	switch lang {
+	case "en":
+		if n%100 >= 11 && n%100 <= 13 {
+			return "th"
+		}
+		switch n % 10 {
+		case 1:
+			return "st"
+		case 2:
+			return "nd"
+		case 3:
+			return "rd"
+		}
+		return "th"
+	case "fr":
+		if n == 1 {
+			return "er"
+		}
+		return "e"
+	case "es", "it", "pt", "gl":
+		return "º"
+	case "cs", "da", "de", "et", "fi", "hr", "hu", "is", "lv", "nb", "nn", "pl", "sk", "sl", "sr", "sc", "tr":
+		return "."
+	}
+	return ""
+}
+
+// formatDateNumber formats a number with a presentation modifier such as
+// "01", "1o" or "I".
+func formatDateNumber(n int, presentation string, minWidth int, lang string) (string, error) {
+	ordinal := strings.HasSuffix(presentation, "o") && len(presentation) > 1
+	if ordinal {
+		presentation = strings.TrimSuffix(presentation, "o")
+	}
+	var s string
+	switch presentation {
+	case "I", "i":
+		seq, err := fnRomannumeral(nil, []goxpath.Sequence{{n}})
+		if err != nil {
+			return "", err
+		}
+		s = seq.Stringvalue()
+		if presentation == "i" {
+			s = strings.ToLower(s)
+		}
+	default:
+		width := max(strings.Count(presentation, "0")+strings.Count(presentation, "1"), minWidth)
+		s = fmt.Sprintf("%0*d", width, n)
+	}
+	if ordinal {
+		s += ordinalSuffix(n, lang)
+	}
+	return s, nil
+}
+
+// formatDateName formats a name with the presentation modifier N (upper
+// case), n (lower case) or Nn (title case) and truncates it to maxWidth
+// characters.
+func formatDateName(name, presentation string, maxWidth int) string {
+	switch presentation {
+	case "N":
+		name = strings.ToUpper(name)
+	case "n":
+		name = strings.ToLower(name)
+	default:
+		if r, size := utf8.DecodeRuneInString(name); size > 0 {
+			name = string(unicode.ToUpper(r)) + name[size:]
+		}
+	}
+	if maxWidth > 0 && utf8.RuneCountInString(name) > maxWidth {
+		name = string([]rune(name)[:maxWidth])
+	}
+	return name
+}
+
+// parseWidth parses the width modifier of a picture component ("3", "2-3",
+// "*-3"). A single number sets both the minimum and the maximum width.
+func parseWidth(width string) (int, int) {
+	if width == "" {
+		return 0, 0
+	}
+	minStr, maxStr, found := strings.Cut(width, "-")
+	if !found {
+		maxStr = minStr
+	}
+	minWidth, _ := strconv.Atoi(minStr)
+	maxWidth, _ := strconv.Atoi(maxStr)
+	return minWidth, maxWidth
+}
+
+// formatDatePicture formats t with an XSLT picture string such as
+// "[D01].[M01].[Y0001]" or "[FNn], [D1o] [MNn] [Y]". Time components are
+// only allowed if withTime is true.
+func formatDatePicture(t time.Time, picture string, lang string, withTime bool) (string, error) {
+	names, lang, err := getDateNames(lang)
+	if err != nil {
+		return "", err
+	}
+	genitive := names.monthsGenitive[0] != "" && strings.Contains(picture, "[D")
+	var sb strings.Builder
+	for i := 0; i < len(picture); i++ {
+		c := picture[i]
+		if c == ']' {
+			if i+1 < len(picture) && picture[i+1] == ']' {
+				i++
+			}
+			sb.WriteByte(c)
+			continue
+		}
+		if c != '[' {
+			sb.WriteByte(c)
+			continue
+		}
+		if i+1 < len(picture) && picture[i+1] == '[' {
+			sb.WriteByte('[')
+			i++
+			continue
+		}
+		end := strings.IndexByte(picture[i:], ']')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed '[' in picture %q", picture)
+		}
+		component := strings.Join(strings.Fields(picture[i+1:i+end]), "")
+		i += end
+		if component == "" {
+			continue
+		}
+		specifier := component[0]
+		presentation, width, _ := strings.Cut(component[1:], ",")
+		minWidth, maxWidth := parseWidth(width)
+		if !withTime && strings.IndexByte("HhPmsfZz", specifier) >= 0 {
+			return "", fmt.Errorf("component [%c] needs a date with time", specifier)
+		}
+		number := func(n int, def string) error {
+			if presentation == "" {
+				presentation = def
+			}
+			s, err := formatDateNumber(n, presentation, minWidth, lang)
+			sb.WriteString(s)
+			return err
+		}
+		isName := strings.HasPrefix(presentation, "N") || strings.HasPrefix(presentation, "n")
+		switch specifier {
+		case 'Y':
+			year := t.Year()
+			if strings.Count(presentation, "0")+strings.Count(presentation, "1") == 2 || maxWidth == 2 {
+				year %= 100
+				presentation = "01"
+			}
+			err = number(year, "1")
+		case 'M':
+			if isName {
+				name := names.months[t.Month()-1]
+				if genitive {
+					name = names.monthsGenitive[t.Month()-1]
+				}
+				sb.WriteString(formatDateName(name, presentation, maxWidth))
+			} else {
+				err = number(int(t.Month()), "1")
+			}
+		case 'D':
+			err = number(t.Day(), "1")
+		case 'd':
+			err = number(t.YearDay(), "1")
+		case 'F':
+			if presentation == "" || isName {
+				sb.WriteString(formatDateName(names.days[t.Weekday()], cmp.Or(presentation, "n"), maxWidth))
+			} else {
+				err = number((int(t.Weekday())+6)%7+1, "1")
+			}
+		case 'W':
+			_, week := t.ISOWeek()
+			err = number(week, "1")
+		case 'H':
+			err = number(t.Hour(), "1")
+		case 'h':
+			h := t.Hour() % 12
+			if h == 0 {
+				h = 12
+			}
+			err = number(h, "1")
+		case 'P':
+			ampm := "am"
+			if t.Hour() >= 12 {
+				ampm = "pm"
+			}
+			sb.WriteString(formatDateName(ampm, cmp.Or(presentation, "n"), maxWidth))
+		case 'm':
+			err = number(t.Minute(), "01")
+		case 's':
+			err = number(t.Second(), "01")
+		case 'f':
+			digits := max(len(presentation), minWidth, 1)
+			frac := fmt.Sprintf("%09d", t.Nanosecond())
+			sb.WriteString(frac[:min(digits, 9)])
+		case 'Z':
+			sb.WriteString(t.Format("-07:00"))
+		case 'z':
+			sb.WriteString("GMT" + t.Format("-07:00"))
+		default:
+			return "", fmt.Errorf("unknown component [%c] in picture %q", specifier, picture)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return sb.String(), nil
+}
+
+// formatDate implements sd:format-date() and sd:format-datetime().
+func formatDate(ctx *goxpath.Context, args []goxpath.Sequence, withTime bool) (goxpath.Sequence, error) {
+	if len(args[0]) == 0 {
+		return goxpath.Sequence{}, nil
+	}
+	t, _, err := itemToTime(args[0][0])
+	if err != nil {
+		return nil, err
+	}
+	lang := "en"
+	if len(args) > 2 {
+		lang = args[2].Stringvalue()
+	} else if xd, ok := ctx.Store["xd"].(*xtsDocument); ok && xd.document.Doc.DefaultLanguage != nil {
+		lang = xd.document.Doc.DefaultLanguage.Name
+	}
+	str, err := formatDatePicture(t, args[1].Stringvalue(), lang, withTime)
+	if err != nil {
+		return nil, err
+	}
+	return goxpath.Sequence{str}, nil
+}
+
+// fnFormatDate formats a date: sd:format-date(date, picture, language).
+func fnFormatDate(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	seq, err := formatDate(ctx, args, false)
+	if err != nil {
+		return nil, fmt.Errorf("sd:format-date(): %w", err)
+	}
+	return seq, nil
+}
+
+// fnFormatDatetime formats a date with time: sd:format-datetime(date,
+// picture, language).
+func fnFormatDatetime(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	seq, err := formatDate(ctx, args, true)
+	if err != nil {
+		return nil, fmt.Errorf("sd:format-datetime(): %w", err)
+	}
+	return seq, nil
+}
+
+// fnParseDate returns an xs:date or an xs:dateTime: sd:parse-date(string,
+// picture).
+func fnParseDate(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	if len(args[0]) == 0 {
+		return goxpath.Sequence{}, nil
+	}
+	var t time.Time
+	var hasTime bool
+	var err error
+	if len(args) > 1 {
+		t, hasTime, err = parseDateString(args[0].Stringvalue(), args[1].Stringvalue())
+	} else {
+		t, hasTime, err = itemToTime(args[0][0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sd:parse-date(): %w", err)
+	}
+	return goxpath.Sequence{timeToItem(t, hasTime)}, nil
+}
+
+// fnAddToDate adds a duration (xs:duration, a duration string such as
+// "P30D" or a number of days) to a date: sd:add-to-date(date, duration).
+func fnAddToDate(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	if len(args[0]) == 0 {
+		return goxpath.Sequence{}, nil
+	}
+	t, hasTime, err := itemToTime(args[0][0])
+	if err != nil {
+		return nil, fmt.Errorf("sd:add-to-date(): %w", err)
+	}
+	if len(args[1]) != 1 {
+		return nil, fmt.Errorf("sd:add-to-date(): the second argument must be a single duration")
+	}
+	var d goxpath.XSDuration
+	switch v := args[1][0].(type) {
+	case goxpath.XSDuration:
+		d = v
+	case int:
+		d = goxpath.XSDuration{Days: v}
+		if v < 0 {
+			d = goxpath.XSDuration{Negative: true, Days: -v}
+		}
+	case float64:
+		days := math.Floor(math.Abs(v))
+		d = goxpath.XSDuration{Negative: v < 0, Days: int(days), Seconds: math.Round((math.Abs(v) - days) * 86400)}
+	default:
+		if d, err = goxpath.ParseXSDuration(goxpath.ItemStringvalue(v)); err != nil {
+			return nil, fmt.Errorf("sd:add-to-date(): %w", err)
+		}
+	}
+	if d.Hours != 0 || d.Minutes != 0 || d.Seconds != 0 {
+		hasTime = true
+	}
+	return goxpath.Sequence{timeToItem(addDuration(t, d), hasTime)}, nil
+}
+
+// fnDaysBetween returns the number of days from the first to the second
+// date: sd:days-between(from, to).
+func fnDaysBetween(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	var days [2]time.Time
+	for i, arg := range args {
+		if len(arg) != 1 {
+			return nil, fmt.Errorf("sd:days-between(): each argument must be a single date")
+		}
+		t, _, err := itemToTime(arg[0])
+		if err != nil {
+			return nil, fmt.Errorf("sd:days-between(): %w", err)
+		}
+		days[i] = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return goxpath.Sequence{int(math.Round(days[1].Sub(days[0]).Hours() / 24))}, nil
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	xpath "github.com/speedata/goxpath"
+)
+
+func TestFormatDatePicture(t *testing.T) {
+	date := time.Date(2026, time.March, 1, 14, 5, 9, 0, time.UTC)
+	data := []struct {
+		picture string
+		lang    string
+		want    string
+	}{
+		{"[D01].[M01].[Y0001]", "de", "01.03.2026"},
+		{"[D]. [MNn] [Y]", "German", "1. März 2026"},
+		{"[FNn], [MNn] [D1o], [Y]", "en", "Sunday, March 1st, 2026"},
+		{"[D] [MNn,*-3] [Y01]", "en_US", "1 Mar 26"},
+		{"[FNn] [D1o] [MNn]", "fr", "Dimanche 1er Mars"},
+		{"[D] [Mn] [Y]", "ru", "1 марта 2026"},
+		{"[MNn] [Y]", "ru", "Март 2026"},
+		{"[MN] [Y,2] [[W[W]]]", "de", "MÄRZ 26 [W9]"},
+		{"[H01]:[m]:[s] [h]:[m] [PN]", "en", "14:05:09 2:05 PM"},
+	}
+	for _, tc := range data {
+		got, err := formatDatePicture(date, tc.picture, tc.lang, true)
+		if err != nil {
+			t.Errorf("%s: %s", tc.picture, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("formatDatePicture(%q, %q) = %q, want %q", tc.picture, tc.lang, got, tc.want)
+		}
+	}
+	if _, err := formatDatePicture(date, "[H]", "en", false); err == nil {
+		t.Error("expected an error for a time component in a date")
+	}
+	if _, err := formatDatePicture(date, "[D]", "xx", false); err == nil {
+		t.Error("expected an error for an unknown language")
+	}
+}
+
+func TestDates(t *testing.T) {
+	data := []struct {
+		fn   func(*xpath.Context, []xpath.Sequence) (xpath.Sequence, error)
+		args []xpath.Sequence
+		want string
+	}{
+		{fnParseDate, []xpath.Sequence{{"2026-01-31"}}, "2026-01-31"},
+		{fnParseDate, []xpath.Sequence{{"31.1.2026"}}, "2026-01-31"},
+		{fnParseDate, []xpath.Sequence{{46053}}, "2026-01-31"},
+		{fnParseDate, []xpath.Sequence{{46053.4375}}, "2026-01-31T10:30:00"},
+		{fnParseDate, []xpath.Sequence{{"01/31/2026 10:30"}, {"[M01]/[D01]/[Y0001] [H01]:[m01]"}}, "2026-01-31T10:30:00"},
+		{fnParseDate, []xpath.Sequence{{"Mar 1, 2026"}, {"[MNn,3] [D], [Y]"}}, "2026-03-01"},
+		{fnParseDate, []xpath.Sequence{{"MD 1.3.2026"}, {"MD [D].[M].[Y]"}}, "2026-03-01"},
+		{fnAddToDate, []xpath.Sequence{{"2026-01-31"}, {"P1M"}}, "2026-02-28"},
+		{fnAddToDate, []xpath.Sequence{{"2026-01-31"}, {30}}, "2026-03-02"},
+		{fnAddToDate, []xpath.Sequence{{"2026-01-31"}, {"-P1Y"}}, "2025-01-31"},
+		{fnAddToDate, []xpath.Sequence{{"2026-01-31T22:00:00"}, {"PT3H"}}, "2026-02-01T01:00:00"},
+		{fnDaysBetween, []xpath.Sequence{{"2026-01-31"}, {"1.3.2026"}}, "29"},
+	}
+	for _, tc := range data {
+		seq, err := tc.fn(nil, tc.args)
+		if err != nil {
+			t.Errorf("%v: %s", tc.args, err)
+			continue
+		}
+		got := seq.Stringvalue()
+		switch tm := seq[0].(type) {
+		case xpath.XSDate:
+			got = time.Time(tm).Format("2006-01-02")
+		case xpath.XSDateTime:
+			got = time.Time(tm).Format("2006-01-02T15:04:05")
+		}
+		if got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+	for _, args := range [][]xpath.Sequence{{{"46053"}}, {{"31.1.2026"}, {"DD.MM.YYYY"}}} {
+		if _, err := fnParseDate(nil, args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestDatePictureLayout(t *testing.T) {
+	data := []struct {
+		picture string
+		layout  string
+		hasTime bool
+	}{
+		{"[D01].[M01].[Y0001]", "02.01.2006", false},
+		{"[D].[M].[Y]", "2.1.2006", false},
+		{"[M01]/[D01]/[Y0001] [H01]:[m01]", "01/02/2006 15:04", true},
+		{"[MNn,3] [D], [Y]", "Jan 2, 2006", false},
+		{"[[[D]]]", "[2]", false},
+	}
+	for _, tc := range data {
+		layout, hasTime, err := datePictureLayout(tc.picture)
+		if err != nil {
+			t.Errorf("datePictureLayout(%q): %s", tc.picture, err)
+			continue
+		}
+		if layout != tc.layout || hasTime != tc.hasTime {
+			t.Errorf("datePictureLayout(%q) = %q, %t, want %q, %t", tc.picture, layout, hasTime, tc.layout, tc.hasTime)
+		}
+	}
+}
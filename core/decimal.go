@@ -0,0 +1,223 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/speedata/goxpath"
+)
+
+// The sd:decimal-... functions calculate with exact decimal numbers instead
+// of float64. Their results are strings such as "1234.50" that keep all
+// digits. sd:format-number() formats these strings without converting them
+// to float64.
+
+var bigTen = big.NewInt(10)
+
+// itemToDecimal converts an XPath item to an exact decimal number. Floating
+// point numbers are converted using their shortest representation, so 0.1
+// becomes exactly 1/10.
+func itemToDecimal(itm goxpath.Item) (*big.Rat, error) {
+	r := new(big.Rat)
+	switch t := itm.(type) {
+	case int:
+		return r.SetInt64(int64(t)), nil
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return nil, fmt.Errorf("%v is not a decimal number", t)
+		}
+		r.SetString(strconv.FormatFloat(t, 'f', -1, 64))
+		return r, nil
+	}
+	str := strings.TrimSpace(goxpath.ItemStringvalue(itm))
+	if strings.Contains(str, "/") {
+		return nil, fmt.Errorf("%q is not a decimal number", str)
+	}
+	if _, ok := r.SetString(strings.TrimPrefix(str, "+")); !ok {
+		return nil, fmt.Errorf("%q is not a decimal number", str)
+	}
+	return r, nil
+}
+
+// sequenceToDecimal converts a sequence with exactly one item to a decimal
+// number.
+func sequenceToDecimal(seq goxpath.Sequence) (*big.Rat, error) {
+	if len(seq) != 1 {
+		return nil, fmt.Errorf("expect a single number, got a sequence of length %d", len(seq))
+	}
+	return itemToDecimal(seq[0])
+}
+
+// decimalString returns the decimal representation of r without trailing
+// zeros. r must have a finite decimal representation, that is the
+// denominator has no prime factors other than 2 and 5.
+func decimalString(r *big.Rat) string {
+	denom := new(big.Int).Set(r.Denom())
+	count := func(factor int64) int {
+		n := 0
+		f := big.NewInt(factor)
+		q, m := new(big.Int), new(big.Int)
+		for {
+			q.QuoRem(denom, f, m)
+			if m.Sign() != 0 {
+				return n
+			}
+			denom.Set(q)
+			n++
+		}
+	}
+	return r.FloatString(max(count(2), count(5)))
+}
+
+// roundDecimalRat rounds r to the given number of fractional digits. The
+// rounding modes are the same as in sd:format-number(): half-up (the
+// default), half-down, half-even, up, down, ceiling and floor.
+func roundDecimalRat(r *big.Rat, digits int, mode string) (*big.Rat, error) {
+	scale := new(big.Int).Exp(bigTen, big.NewInt(int64(max(digits, 0))), nil)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(scale))
+	negative := scaled.Sign() < 0
+	num := new(big.Int).Abs(scaled.Num())
+	den := scaled.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	// compare the remainder with half of the denominator
+	half := new(big.Int).Lsh(rem, 1).Cmp(den)
+	nonZero := rem.Sign() != 0
+	var up bool
+	switch mode {
+	case "", "half-up":
+		up = half >= 0
+	case "half-down":
+		up = half > 0
+	case "half-even":
+		up = half > 0 || half == 0 && quo.Bit(0) == 1
+	case "up":
+		up = nonZero
+	case "down":
+		up = false
+	case "ceiling":
+		up = nonZero && !negative
+	case "floor":
+		up = nonZero && negative
+	default:
+		return nil, fmt.Errorf("unknown rounding mode %q", mode)
+	}
+	if up {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if negative {
+		quo.Neg(quo)
+	}
+	return new(big.Rat).SetFrac(quo, scale), nil
+}
+
+// fnDecimal returns the exact decimal value of a number or a string:
+// sd:decimal(value).
+func fnDecimal(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	if len(args[0]) == 0 {
+		return goxpath.Sequence{}, nil
+	}
+	r, err := sequenceToDecimal(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("sd:decimal(): %w", err)
+	}
+	return goxpath.Sequence{decimalString(r)}, nil
+}
+
+// fnDecimalSum adds all items of the sequence: sd:decimal-sum(sequence).
+func fnDecimalSum(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	sum := new(big.Rat)
+	for _, itm := range args[0] {
+		r, err := itemToDecimal(itm)
+		if err != nil {
+			return nil, fmt.Errorf("sd:decimal-sum(): %w", err)
+		}
+		sum.Add(sum, r)
+	}
+	return goxpath.Sequence{decimalString(sum)}, nil
+}
+
+// fnDecimalSubtract returns the difference: sd:decimal-subtract(a, b).
+func fnDecimalSubtract(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	var operands [2]*big.Rat
+	for i, arg := range args {
+		r, err := sequenceToDecimal(arg)
+		if err != nil {
+			return nil, fmt.Errorf("sd:decimal-subtract(): %w", err)
+		}
+		operands[i] = r
+	}
+	return goxpath.Sequence{decimalString(new(big.Rat).Sub(operands[0], operands[1]))}, nil
+}
+
+// fnDecimalMultiply returns the product of all arguments:
+// sd:decimal-multiply(a, b, ...).
+func fnDecimalMultiply(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	product := big.NewRat(1, 1)
+	for _, arg := range args {
+		r, err := sequenceToDecimal(arg)
+		if err != nil {
+			return nil, fmt.Errorf("sd:decimal-multiply(): %w", err)
+		}
+		product.Mul(product, r)
+	}
+	return goxpath.Sequence{decimalString(product)}, nil
+}
+
+// fnDecimalDivide divides a by b and rounds the result:
+// sd:decimal-divide(a, b, digits, rounding mode).
+func fnDecimalDivide(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	a, err := sequenceToDecimal(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("sd:decimal-divide(): %w", err)
+	}
+	b, err := sequenceToDecimal(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("sd:decimal-divide(): %w", err)
+	}
+	if b.Sign() == 0 {
+		return nil, fmt.Errorf("sd:decimal-divide(): division by zero")
+	}
+	digits, err := goxpath.NumberValue(args[2])
+	if err != nil {
+		return nil, fmt.Errorf("sd:decimal-divide(): %w", err)
+	}
+	mode := ""
+	if len(args) > 3 {
+		mode = args[3].Stringvalue()
+	}
+	r, err := roundDecimalRat(new(big.Rat).Quo(a, b), int(digits), mode)
+	if err != nil {
+		return nil, fmt.Errorf("sd:decimal-divide(): %w", err)
+	}
+	return goxpath.Sequence{r.FloatString(max(int(digits), 0))}, nil
+}
+
+// fnDecimalRound rounds to the number of fractional digits:
+// sd:decimal-round(value, digits, rounding mode). The result has exactly
+// this number of fractional digits.
+func fnDecimalRound(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	if len(args[0]) == 0 {
+		return goxpath.Sequence{}, nil
+	}
+	r, err := sequenceToDecimal(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("sd:decimal-round(): %w", err)
+	}
+	digits := 0.0
+	if len(args) > 1 {
+		if digits, err = goxpath.NumberValue(args[1]); err != nil {
+			return nil, fmt.Errorf("sd:decimal-round(): %w", err)
+		}
+	}
+	mode := ""
+	if len(args) > 2 {
+		mode = args[2].Stringvalue()
+	}
+	if r, err = roundDecimalRat(r, int(digits), mode); err != nil {
+		return nil, fmt.Errorf("sd:decimal-round(): %w", err)
+	}
+	return goxpath.Sequence{r.FloatString(max(int(digits), 0))}, nil
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	xpath "github.com/speedata/goxpath"
+)
+
+func TestRoundDecimalRat(t *testing.T) {
+	data := []struct {
+		number string
+		digits int
+		mode   string
+		want   string
+	}{
+		{"2.675", 2, "", "2.68"},
+		{"2.665", 2, "half-even", "2.66"},
+		{"2.675", 2, "half-even", "2.68"},
+		{"2.665", 2, "half-down", "2.66"},
+		{"-2.5", 0, "", "-3"},
+		{"-2.5", 0, "half-even", "-2"},
+		{"2.671", 2, "up", "2.68"},
+		{"2.679", 2, "down", "2.67"},
+		{"-2.671", 2, "ceiling", "-2.67"},
+		{"-2.671", 2, "floor", "-2.68"},
+		{"1234.5", -1, "", "1235"},
+	}
+	for _, tc := range data {
+		r, _ := new(big.Rat).SetString(tc.number)
+		got, err := roundDecimalRat(r, tc.digits, tc.mode)
+		if err != nil {
+			t.Errorf("roundDecimalRat(%s, %d, %q): %s", tc.number, tc.digits, tc.mode, err)
+			continue
+		}
+		if s := decimalString(got); s != tc.want {
+			t.Errorf("roundDecimalRat(%s, %d, %q) = %s, want %s", tc.number, tc.digits, tc.mode, s, tc.want)
+		}
+	}
+	if _, err := roundDecimalRat(big.NewRat(1, 2), 0, "nearest"); err == nil {
+		t.Error("expected an error for an unknown rounding mode")
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	seq := func(items ...xpath.Item) xpath.Sequence { return xpath.Sequence(items) }
+	data := []struct {
+		fn   func(*xpath.Context, []xpath.Sequence) (xpath.Sequence, error)
+		args []xpath.Sequence
+		want string
+	}{
+		{fnDecimal, []xpath.Sequence{seq(0.1)}, "0.1"},
+		{fnDecimal, []xpath.Sequence{seq(" 12.50 ")}, "12.5"},
+		{fnDecimalSum, []xpath.Sequence{seq(0.1, 0.2, "0.3", 5)}, "5.6"},
+		{fnDecimalSum, []xpath.Sequence{seq()}, "0"},
+		{fnDecimalSubtract, []xpath.Sequence{seq(1.1), seq(2.2)}, "-1.1"},
+		{fnDecimalMultiply, []xpath.Sequence{seq("19.99"), seq(3), seq("1.19")}, "71.3643"},
+		{fnDecimalDivide, []xpath.Sequence{seq(10), seq(3), seq(2)}, "3.33"},
+		{fnDecimalDivide, []xpath.Sequence{seq(-2), seq(3), seq(0), seq("floor")}, "-1"},
+		{fnDecimalRound, []xpath.Sequence{seq("2.675"), seq(2)}, "2.68"},
+		{fnDecimalRound, []xpath.Sequence{seq("2.665"), seq(2), seq("half-even")}, "2.66"},
+		{fnDecimalRound, []xpath.Sequence{seq("-2.5")}, "-3"},
+		{fnDecimalRound, []xpath.Sequence{seq("-2.5"), seq(0), seq("half-even")}, "-2"},
+		{fnDecimalRound, []xpath.Sequence{seq(7), seq(2)}, "7.00"},
+	}
+	for _, tc := range data {
+		res, err := tc.fn(nil, tc.args)
+		if err != nil {
+			t.Errorf("%v: %s", tc.args, err)
+			continue
+		}
+		if got := res.Stringvalue(); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+	if _, err := fnDecimal(nil, []xpath.Sequence{seq("1/3")}); err == nil {
+		t.Error("expected an error for 1/3")
+	}
+	res, err := fnFormatNumber(nil, []xpath.Sequence{seq("12345678901234567.85"), seq("#,##0.0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Stringvalue(), "12,345,678,901,234,567.9"; got != want {
+		t.Errorf("format-number: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/boxesandglue/boxesandglue/frontend"
+	"github.com/speedata/goxml"
+	xpath "github.com/speedata/goxpath"
+)
+
+// CommandFunc implements a layout command that is registered with
+// RegisterCommand. The returned sequence is passed to the surrounding command,
+// so a command that returns a *node.VList can be used inside PlaceObject.
+type CommandFunc func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error)
+
+// Document gives layout commands registered with RegisterCommand access to
+// the state of the current publishing run. A Document is only valid during the
+// call of the CommandFunc.
+type Document struct {
+	xd *xtsDocument
+}
+
+// GridInfo describes the grid of the current page.
+type GridInfo struct {
+	CellWidth    bag.ScaledPoint // width of the grid cells
+	CellHeight   bag.ScaledPoint // height of the grid cells
+	GapX         bag.ScaledPoint // horizontal space between two grid cells
+	GapY         bag.ScaledPoint // vertical space between two grid cells
+	Columns      int             // number of grid cells in horizontal direction
+	Rows         int             // number of grid cells in vertical direction
+	MarginLeft   bag.ScaledPoint
+	MarginRight  bag.ScaledPoint
+	MarginTop    bag.ScaledPoint
+	MarginBottom bag.ScaledPoint
+}
+
+// RegisterCommand makes the layout command name available in all following
+// publishing runs. RegisterCommand must be called before the first publishing
+// run, usually from the init function of the package that provides the
+// command. It is an error to register a command name twice or to replace a
+// built-in command.
+func RegisterCommand(name string, f CommandFunc) error {
+	if name == "" || f == nil {
+		return fmt.Errorf("RegisterCommand: name and function must not be empty")
+	}
+	if _, ok := dispatchTable[name]; ok {
+		return fmt.Errorf("RegisterCommand: command %q already exists", name)
+	}
+	dispatchTable[name] = func(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		return f(&Document{xd: xd}, layoutelt)
+	}
+	return nil
+}
+
+// Attributes fills the struct at v with the attribute values of layoutelt.
+// Attribute names are the lower case field names, values in curly braces are
+// evaluated as XPath expressions. Supported field types are bool, string, int,
+// bag.ScaledPoint and pointers to these. The struct tag sdxml can contain
+// "mustexist", "noescape", "default:value" and "attr:name".
+func (d *Document) Attributes(layoutelt *goxml.Element, v any) error {
+	return getXMLAttributes(d.xd, layoutelt, v)
+}
+
+// EvaluateXPath evaluates the XPath expression with the namespaces of
+// layoutelt in the current data context.
+func (d *Document) EvaluateXPath(layoutelt *goxml.Element, expr string) (xpath.Sequence, error) {
+	return evaluateXPath(d.xd, layoutelt.Namespaces, expr)
+}
+
+// Dispatch executes the child elements of layoutelt and returns their
+// combined result.
+func (d *Document) Dispatch(layoutelt *goxml.Element) (xpath.Sequence, error) {
+	return dispatch(d.xd, layoutelt)
+}
+
+// SetVariable sets the layout variable name.
+func (d *Document) SetVariable(name string, value xpath.Sequence) {
+	d.xd.data.SetVariable(name, value)
+}
+
+// Errorf creates a typesetting error for layoutelt and writes it to the log.
+func (d *Document) Errorf(layoutelt *goxml.Element, format string, a ...any) error {
+	return newTypesettingErrorf(layoutelt.Name, layoutelt.Line, format, a...)
+}
+
+// FindFile returns the full path of the file name, searching the directories
+// of the publishing run.
+func (d *Document) FindFile(name string) (string, error) {
+	return d.xd.findFile(name)
+}
+
+// Frontend returns the boxes and glue document for creating text and PDF
+// objects.
+func (d *Document) Frontend() *frontend.Document {
+	return d.xd.document
+}
+
+// PageNumber returns the number of the current page. It is 0 if no page has
+// been created yet.
+func (d *Document) PageNumber() int {
+	return d.xd.currentPagenumber
+}
+
+// CurrentPage returns the current PDF page. A new page is created if
+// necessary.
+func (d *Document) CurrentPage() (*document.Page, error) {
+	d.xd.setupPage()
+	if d.xd.currentPage == nil {
+		return nil, fmt.Errorf("no current page")
+	}
+	return d.xd.currentPage.bagPage, nil
+}
+
+// Grid returns the grid of the current page or slate. A new page is created
+// if necessary.
+func (d *Document) Grid() GridInfo {
+	d.xd.setupPage()
+	g := d.xd.currentGrid
+	return GridInfo{
+		CellWidth:    g.gridWidth,
+		CellHeight:   g.gridHeight,
+		GapX:         g.gridGapX,
+		GapY:         g.gridGapY,
+		Columns:      g.nx,
+		Rows:         g.ny,
+		MarginLeft:   g.marginLeft,
+		MarginRight:  g.marginRight,
+		MarginTop:    g.marginTop,
+		MarginBottom: g.marginBottom,
+	}
+}
+
+// MaxWidth returns the width that is available for an object in the current
+// PlaceObject.
+func (d *Document) MaxWidth() bag.ScaledPoint {
+	d.xd.setupPage()
+	g := d.xd.currentGrid
+	if mw, ok := d.xd.store["maxwidth"].(int); ok {
+		return g.width(coord(mw))
+	}
+	return g.width(coord(g.nx))
+}
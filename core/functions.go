@@ -6,6 +6,7 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -19,50 +20,87 @@ import (
 
 	chromahtml "github.com/alecthomas/chroma/formatters/html"
 	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/speedata/goxml"
 	"github.com/speedata/goxpath"
+	"github.com/speedata/xts/xts/luadb"
+	"github.com/speedata/xts/xts/luaxml"
 	"github.com/yuin/goldmark"
 	highlighting "github.com/yuin/goldmark-highlighting"
 	"github.com/yuin/goldmark/extension"
 	"golang.org/x/net/html"
 )
 
-const fnNS = "urn:speedata.de/2021/xtsfunctions/en"
+const (
+	fnNS = "urn:speedata.de/2021/xtsfunctions/en"
+	// xpathFunctionsNS is the namespace of the standard XPath functions.
+	xpathFunctionsNS = "http://www.w3.org/2005/xpath-functions"
+)
+
+// builtinFunctions are the XPath functions of XTS by namespace and name. A
+// function defined in a layout replaces the function in the table of goxpath,
+// the other documents still call the built-in function.
+var builtinFunctions = make(map[string]*goxpath.Function)
+
+func registerFunction(f *goxpath.Function) {
+	builtinFunctions[f.Namespace+" "+f.Name] = f
+	goxpath.RegisterFunction(f)
+}
 
 var onlyUnitRE = regexp.MustCompile(`^(sp|mm|cm|in|pt|px|pc|m)$`)
 
 func init() {
-	goxpath.RegisterFunction(&goxpath.Function{Name: "aspect-ratio", Namespace: fnNS, F: fnAspectRatio, MinArg: 1, MaxArg: 3})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "attribute", Namespace: fnNS, F: fnAttribute, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "current-page", Namespace: fnNS, F: fnCurrentPage, MinArg: 0, MaxArg: 0})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "current-row", Namespace: fnNS, F: fnCurrentRow, MinArg: 0, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "decode-base64", Namespace: fnNS, F: fnDecodeBase64, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "decode-html", Namespace: fnNS, F: fnDecodeHTML, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "dummy-text", Namespace: fnNS, F: fnDummytext, MinArg: 0, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "even", Namespace: fnNS, F: fnEven, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "file-contents", Namespace: fnNS, F: fnFileContents, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "file-exists", Namespace: fnNS, F: fnFileExists, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "format-number", Namespace: fnNS, F: fnFormatNumber, MinArg: 3, MaxArg: 3})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "grid-height", Namespace: fnNS, F: fnGridHeight, MinArg: 1, MaxArg: 2})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "grid-width", Namespace: fnNS, F: fnGridWidth, MinArg: 1, MaxArg: 2})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "slate-height", Namespace: fnNS, F: fnSlateheight, MinArg: 1, MaxArg: 2})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "slate-width", Namespace: fnNS, F: fnSlatewidth, MinArg: 1, MaxArg: 2})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "image-height", Namespace: fnNS, F: fnImageHeight, MinArg: 1, MaxArg: 4})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "image-width", Namespace: fnNS, F: fnImageWidth, MinArg: 1, MaxArg: 4})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "last-page-number", Namespace: fnNS, F: fnLastPagenumber, MinArg: 0, MaxArg: 0})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "md5", Namespace: fnNS, F: fnMdFive, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "markdown", Namespace: fnNS, F: fnMarkdown, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "mode", Namespace: fnNS, F: fnMode, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "number-of-columns", Namespace: fnNS, F: fnNumberOfColumns, MinArg: 0, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "number-of-rows", Namespace: fnNS, F: fnNumberOfRows, MinArg: 0, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "odd", Namespace: fnNS, F: fnOdd, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "page-number", Namespace: fnNS, F: fnPagenumber, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "roman-numeral", Namespace: fnNS, F: fnRomannumeral, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "sha1", Namespace: fnNS, F: fnShaOne, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "sha256", Namespace: fnNS, F: fnShaTwoFiveSix, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "sha512", Namespace: fnNS, F: fnShaFiveOneTwo, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "variable", Namespace: fnNS, F: fnVariable, MinArg: 1, MaxArg: 1})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "to-unit", Namespace: fnNS, F: fnToUnit, MinArg: 1, MaxArg: 3})
-	goxpath.RegisterFunction(&goxpath.Function{Name: "total-pages", Namespace: fnNS, F: fnTotalPages, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "add-to-date", Namespace: fnNS, F: fnAddToDate, MinArg: 2, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "aspect-ratio", Namespace: fnNS, F: fnAspectRatio, MinArg: 1, MaxArg: 3})
+	registerFunction(&goxpath.Function{Name: "attribute", Namespace: fnNS, F: fnAttribute, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "current-group", Namespace: fnNS, F: fnCurrentGroup, MinArg: 0, MaxArg: 0})
+	registerFunction(&goxpath.Function{Name: "current-grouping-key", Namespace: fnNS, F: fnCurrentGroupingKey, MinArg: 0, MaxArg: 0})
+	registerFunction(&goxpath.Function{Name: "current-page", Namespace: fnNS, F: fnCurrentPage, MinArg: 0, MaxArg: 0})
+	registerFunction(&goxpath.Function{Name: "current-row", Namespace: fnNS, F: fnCurrentRow, MinArg: 0, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "days-between", Namespace: fnNS, F: fnDaysBetween, MinArg: 2, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "decimal", Namespace: fnNS, F: fnDecimal, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "decimal-divide", Namespace: fnNS, F: fnDecimalDivide, MinArg: 3, MaxArg: 4})
+	registerFunction(&goxpath.Function{Name: "decimal-multiply", Namespace: fnNS, F: fnDecimalMultiply, MinArg: 2, MaxArg: -1})
+	registerFunction(&goxpath.Function{Name: "decimal-round", Namespace: fnNS, F: fnDecimalRound, MinArg: 1, MaxArg: 3})
+	registerFunction(&goxpath.Function{Name: "decimal-subtract", Namespace: fnNS, F: fnDecimalSubtract, MinArg: 2, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "decimal-sum", Namespace: fnNS, F: fnDecimalSum, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "decode-base64", Namespace: fnNS, F: fnDecodeBase64, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "decode-html", Namespace: fnNS, F: fnDecodeHTML, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "dummy-text", Namespace: fnNS, F: fnDummytext, MinArg: 0, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "even", Namespace: fnNS, F: fnEven, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "file-contents", Namespace: fnNS, F: fnFileContents, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "file-exists", Namespace: fnNS, F: fnFileExists, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "format-date", Namespace: fnNS, F: fnFormatDate, MinArg: 2, MaxArg: 3})
+	registerFunction(&goxpath.Function{Name: "format-datetime", Namespace: fnNS, F: fnFormatDatetime, MinArg: 2, MaxArg: 3})
+	registerFunction(&goxpath.Function{Name: "format-number", Namespace: fnNS, F: fnFormatNumber, MinArg: 2, MaxArg: 3})
+	registerFunction(&goxpath.Function{Name: "grid-height", Namespace: fnNS, F: fnGridHeight, MinArg: 1, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "grid-width", Namespace: fnNS, F: fnGridWidth, MinArg: 1, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "slate-height", Namespace: fnNS, F: fnSlateheight, MinArg: 1, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "slate-width", Namespace: fnNS, F: fnSlatewidth, MinArg: 1, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "image-height", Namespace: fnNS, F: fnImageHeight, MinArg: 1, MaxArg: 4})
+	registerFunction(&goxpath.Function{Name: "image-width", Namespace: fnNS, F: fnImageWidth, MinArg: 1, MaxArg: 4})
+	registerFunction(&goxpath.Function{Name: "index-entries", Namespace: fnNS, F: fnIndexEntries, MinArg: 0, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "last-page-number", Namespace: fnNS, F: fnLastPagenumber, MinArg: 0, MaxArg: 0})
+	registerFunction(&goxpath.Function{Name: "md5", Namespace: fnNS, F: fnMdFive, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "lua", Namespace: fnNS, F: fnLua, MinArg: 1, MaxArg: -1})
+	registerFunction(&goxpath.Function{Name: "markdown", Namespace: fnNS, F: fnMarkdown, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "mode", Namespace: fnNS, F: fnMode, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "number-of-columns", Namespace: fnNS, F: fnNumberOfColumns, MinArg: 0, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "number-of-rows", Namespace: fnNS, F: fnNumberOfRows, MinArg: 0, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "odd", Namespace: fnNS, F: fnOdd, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "page-number", Namespace: fnNS, F: fnPagenumber, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "parse-date", Namespace: fnNS, F: fnParseDate, MinArg: 1, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "roman-numeral", Namespace: fnNS, F: fnRomannumeral, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "sha1", Namespace: fnNS, F: fnShaOne, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "sha256", Namespace: fnNS, F: fnShaTwoFiveSix, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "sha512", Namespace: fnNS, F: fnShaFiveOneTwo, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "sort", Namespace: fnNS, F: fnSort, MinArg: 1, MaxArg: 3})
+	registerFunction(&goxpath.Function{Name: "sql-query", Namespace: fnNS, F: fnSQLQuery, MinArg: 2, MaxArg: -1})
+	registerFunction(&goxpath.Function{Name: "variable", Namespace: fnNS, F: fnVariable, MinArg: 1, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "toc-entries", Namespace: fnNS, F: fnTOCEntries, MinArg: 0, MaxArg: 1})
+	registerFunction(&goxpath.Function{Name: "text-height", Namespace: fnNS, F: fnTextHeight, MinArg: 2, MaxArg: 3})
+	registerFunction(&goxpath.Function{Name: "text-width", Namespace: fnNS, F: fnTextWidth, MinArg: 1, MaxArg: 2})
+	registerFunction(&goxpath.Function{Name: "to-unit", Namespace: fnNS, F: fnToUnit, MinArg: 1, MaxArg: 3})
+	registerFunction(&goxpath.Function{Name: "total-pages", Namespace: fnNS, F: fnTotalPages, MinArg: 1, MaxArg: 1})
 }
 
 var spaceRemover = regexp.MustCompile(`(?m)\s*`)
@@ -179,7 +217,7 @@ func fnAspectRatio(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Seque
 		return nil, fmt.Errorf("You cannot use unit in sd:aspect-ratio()")
 	}
 	var p string
-	if p, err = FindFile(fn); err != nil {
+	if p, err = xd.findFile(fn); err != nil {
 		return nil, err
 	}
 	imgf, err := xd.document.Doc.LoadImageFileWithBox(p, pdfbox, pagenumber)
@@ -292,7 +330,7 @@ func fnImageHeight(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Seque
 		return nil, err
 	}
 	var p string
-	if p, err = FindFile(fn); err != nil {
+	if p, err = xd.findFile(fn); err != nil {
 		return nil, err
 	}
 	imgf, err := xd.document.Doc.LoadImageFileWithBox(p, pdfbox, pagenum)
@@ -333,7 +371,7 @@ func fnImageWidth(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequen
 		return nil, err
 	}
 	var p string
-	if p, err = FindFile(fn); err != nil {
+	if p, err = xd.findFile(fn); err != nil {
 		return nil, err
 	}
 	imgf, err := xd.document.Doc.LoadImageFileWithBox(p, pdfbox, pagenum)
@@ -460,7 +498,7 @@ func fnToUnit(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence,
 func fnTotalPages(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
 	xd := ctx.Store["xd"].(*xtsDocument)
 	fn := args[0].Stringvalue()
-	fullPath, err := FindFile(fn)
+	fullPath, err := xd.findFile(fn)
 	if err != nil {
 		return nil, err
 	}
@@ -487,11 +525,14 @@ func fnNumberOfRows(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequ
 	return goxpath.Sequence{int(area.frame[area.currentFrame].height)}, nil
 }
 
+// fnFormatNumber formats a number. sd:format-number(number, pattern, locale)
+// uses a pattern like "#,##0.00" and a locale name or a map with the
+// options locale, rounding, currency, currency-symbol, currency-position,
+// decimal-separator and grouping-separator. The old form
+// sd:format-number(number, thousands separator, decimal separator) is still
+// supported.
 func fnFormatNumber(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
 	num := args[0]
-	thousandsSep := args[1]
-	decimalComma := args[2]
-
 	if len(num) != 1 {
 		return nil, fmt.Errorf("the first argument of format-number must have a cardinality of 1")
 	}
@@ -499,7 +540,69 @@ func fnFormatNumber(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequ
 	if err != nil {
 		return nil, err
 	}
-	return goxpath.Sequence{formatNumber(f, thousandsSep.Stringvalue(), decimalComma.Stringvalue())}, nil
+	pattern := args[1].Stringvalue()
+	if len(args) == 3 && !strings.ContainsAny(pattern, "#0") {
+		return goxpath.Sequence{formatNumber(f, pattern, args[2].Stringvalue())}, nil
+	}
+	opts := numberFormatOptions{locale: numberLocales["en"]}
+	if len(args) == 3 && len(args[2]) > 0 {
+		if opts, err = getNumberFormatOptions(args[2][0]); err != nil {
+			return nil, fmt.Errorf("sd:format-number(): %w", err)
+		}
+	}
+	// decimal strings (for example from sd:decimal-sum()) keep all digits
+	decimal := strconv.FormatFloat(f, 'f', -1, 64)
+	if s, ok := num[0].(string); ok {
+		if r, err := itemToDecimal(s); err == nil {
+			decimal = decimalString(r)
+		}
+	}
+	str, err := formatDecimalPattern(decimal, pattern, opts)
+	if err != nil {
+		return nil, fmt.Errorf("sd:format-number(): %w", err)
+	}
+	return goxpath.Sequence{str}, nil
+}
+
+// getNumberFormatOptions reads the third argument of sd:format-number(),
+// which is a locale name or a map with options.
+func getNumberFormatOptions(itm goxpath.Item) (numberFormatOptions, error) {
+	opts := numberFormatOptions{locale: numberLocales["en"]}
+	m, ok := itm.(*goxpath.XPathMap)
+	if !ok {
+		loc, err := getNumberLocale(goxpath.ItemStringvalue(itm))
+		opts.locale = loc
+		return opts, err
+	}
+	get := func(key string) (string, bool) {
+		if seq, ok := m.Get(key); ok {
+			return seq.Stringvalue(), true
+		}
+		return "", false
+	}
+	if name, ok := get("locale"); ok {
+		loc, err := getNumberLocale(name)
+		if err != nil {
+			return opts, err
+		}
+		opts.locale = loc
+	}
+	if sep, ok := get("decimal-separator"); ok {
+		opts.locale.decimal = sep
+	}
+	if sep, ok := get("grouping-separator"); ok {
+		opts.locale.group = sep
+	}
+	opts.rounding, _ = get("rounding")
+	opts.currency, _ = get("currency")
+	opts.currencySymbol, _ = get("currency-symbol")
+	opts.currencyPosition, _ = get("currency-position")
+	switch opts.currencyPosition {
+	case "", "before", "after":
+	default:
+		return opts, fmt.Errorf("currency-position must be before or after, got %q", opts.currencyPosition)
+	}
+	return opts, nil
 }
 
 func fnSlateheight(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
@@ -609,8 +712,103 @@ func fnFileContents(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequ
 }
 
 func fnFileExists(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
 	seq := args[0]
-	return goxpath.Sequence{fileexists(seq.Stringvalue())}, nil
+	_, err := xd.findFile(seq.Stringvalue())
+	return goxpath.Sequence{err == nil}, nil
+}
+
+func fnLua(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
+	fnname := args[0].Stringvalue()
+	l := xd.luaState()
+	l.Global(fnname)
+	if !l.IsFunction(-1) {
+		l.Pop(1)
+		return nil, fmt.Errorf("lua: function %q not defined", fnname)
+	}
+	return xd.callLua(l, args[1:])
+}
+
+// sqlDatabase returns the database file opened read-only for
+// sd:sql-query(). The database stays open until the end of the publishing
+// run.
+func (xd *xtsDocument) sqlDatabase(filename string) (*sql.DB, error) {
+	if db, ok := xd.databases[filename]; ok {
+		return db, nil
+	}
+	db, err := luadb.OpenReadOnly(filename)
+	if err != nil {
+		return nil, err
+	}
+	if xd.databases == nil {
+		xd.databases = make(map[string]*sql.DB)
+	}
+	xd.databases[filename] = db
+	return db, nil
+}
+
+// closeDatabases closes the databases opened by sd:sql-query().
+func (xd *xtsDocument) closeDatabases() {
+	for _, db := range xd.databases {
+		db.Close()
+	}
+	xd.databases = nil
+}
+
+// fnSQLQuery runs a query on an SQLite database file and returns a row
+// element for each result row: sd:sql-query(filename, query, parameters...).
+// The children of a row are named after the columns, NULL values are
+// omitted.
+func fnSQLQuery(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
+	filename, err := xd.findFile(args[0].Stringvalue())
+	if err != nil {
+		return nil, fmt.Errorf("sd:sql-query(): %w", err)
+	}
+	var params []any
+	for _, arg := range args[2:] {
+		if len(arg) == 0 {
+			params = append(params, nil)
+			continue
+		}
+		switch t := arg[0].(type) {
+		case int, float64, bool, string:
+			params = append(params, t)
+		default:
+			params = append(params, arg.Stringvalue())
+		}
+	}
+	db, err := xd.sqlDatabase(filename)
+	if err != nil {
+		return nil, fmt.Errorf("sd:sql-query(): %w", err)
+	}
+	columns, rows, err := luadb.Query(db, args[1].Stringvalue(), params...)
+	if err != nil {
+		return nil, fmt.Errorf("sd:sql-query(): %w", err)
+	}
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = luaxml.XMLName(col)
+	}
+	seq := make(goxpath.Sequence, 0, len(rows))
+	for _, values := range rows {
+		row := goxml.NewElement()
+		row.ID = goxml.NewID()
+		row.Name = "row"
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			cell := goxml.NewElement()
+			cell.ID = goxml.NewID()
+			cell.Name = names[i]
+			cell.Append(goxml.CharData{ID: goxml.NewID(), Contents: fmt.Sprint(v)})
+			row.Append(cell)
+		}
+		seq = append(seq, row)
+	}
+	return seq, nil
 }
 
 func fnPagenumber(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
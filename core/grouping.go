@@ -0,0 +1,120 @@
+package core
+
+import (
+	"github.com/speedata/goxpath"
+)
+
+// forAllGroup is a group of items in a grouping ForAll, see
+// sd:current-group() and sd:current-grouping-key().
+type forAllGroup struct {
+	key   goxpath.Sequence
+	items goxpath.Sequence
+}
+
+// evaluateForItem evaluates the expression with the item as the context
+// item.
+func (xd *xtsDocument) evaluateForItem(itm goxpath.Item, pos int, expr string) (goxpath.Sequence, error) {
+	xd.data.Ctx.SetContextSequence(goxpath.Sequence{itm})
+	xd.data.Ctx.Pos = pos
+	return xd.data.Evaluate(expr)
+}
+
+// groupBy groups the items by the string values of the key expression. An
+// item with more than one key value is added to each of the groups, items
+// without a key are dropped. The groups are in the order of their first
+// appearance.
+func (xd *xtsDocument) groupBy(seq goxpath.Sequence, expr string) ([]*forAllGroup, error) {
+	var groups []*forAllGroup
+	index := make(map[string]*forAllGroup)
+	for i, itm := range seq {
+		keys, err := xd.evaluateForItem(itm, i+1, expr)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			str := goxpath.ItemStringvalue(key)
+			if seen[str] {
+				continue
+			}
+			seen[str] = true
+			grp, ok := index[str]
+			if !ok {
+				grp = &forAllGroup{key: goxpath.Sequence{key}}
+				index[str] = grp
+				groups = append(groups, grp)
+			}
+			grp.items = append(grp.items, itm)
+		}
+	}
+	return groups, nil
+}
+
+// groupAdjacent starts a new group whenever the string value of the key
+// expression differs from the key of the previous item.
+func (xd *xtsDocument) groupAdjacent(seq goxpath.Sequence, expr string) ([]*forAllGroup, error) {
+	var groups []*forAllGroup
+	var grp *forAllGroup
+	for i, itm := range seq {
+		key, err := xd.evaluateForItem(itm, i+1, expr)
+		if err != nil {
+			return nil, err
+		}
+		if grp == nil || grp.key.Stringvalue() != key.Stringvalue() {
+			grp = &forAllGroup{key: key}
+			groups = append(groups, grp)
+		}
+		grp.items = append(grp.items, itm)
+	}
+	return groups, nil
+}
+
+// groupStartingWith starts a new group with each item for which the
+// expression is true. Items before the first match form a group of their
+// own.
+func (xd *xtsDocument) groupStartingWith(seq goxpath.Sequence, expr string) ([]*forAllGroup, error) {
+	var groups []*forAllGroup
+	for i, itm := range seq {
+		res, err := xd.evaluateForItem(itm, i+1, expr)
+		if err != nil {
+			return nil, err
+		}
+		start, err := goxpath.BooleanValue(res)
+		if err != nil {
+			return nil, err
+		}
+		if start || len(groups) == 0 {
+			groups = append(groups, &forAllGroup{})
+		}
+		groups[len(groups)-1].items = append(groups[len(groups)-1].items, itm)
+	}
+	return groups, nil
+}
+
+// currentGroup returns the innermost group of a grouping ForAll or nil.
+func (xd *xtsDocument) currentGroup() *forAllGroup {
+	if len(xd.groups) == 0 {
+		return nil
+	}
+	return xd.groups[len(xd.groups)-1]
+}
+
+// fnCurrentGroup returns the items of the current group in a grouping
+// ForAll: sd:current-group().
+func fnCurrentGroup(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
+	if grp := xd.currentGroup(); grp != nil {
+		return grp.items, nil
+	}
+	return goxpath.Sequence{}, nil
+}
+
+// fnCurrentGroupingKey returns the key of the current group in a ForAll with
+// group-by or group-adjacent: sd:current-grouping-key().
+func fnCurrentGroupingKey(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
+	if grp := xd.currentGroup(); grp != nil && grp.key != nil {
+		return grp.key, nil
+	}
+	return goxpath.Sequence{}, nil
+}
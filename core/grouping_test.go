@@ -0,0 +1,101 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/speedata/goxml"
+	xpath "github.com/speedata/goxpath"
+)
+
+func TestGroupingHelpers(t *testing.T) {
+	data := `<data>
+  <heading name="h1"/>
+  <product category="tools" name="saw"/>
+  <product category="tools garden" name="hammer"/>
+  <product category="garden" name="rake"/>
+  <heading name="h2"/>
+  <product name="drill"/>
+</data>`
+	xd := &xtsDocument{}
+	var err error
+	if xd.data, err = xpath.NewParser(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	items, err := xd.data.Evaluate("/data/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata := []struct {
+		group func(xpath.Sequence, string) ([]*forAllGroup, error)
+		expr  string
+		want  string
+	}{
+		{xd.groupBy, "tokenize(@category, ' ')", "tools:saw,hammer;garden:hammer,rake"},
+		{xd.groupBy, "local-name()", "heading:h1,h2;product:saw,hammer,rake,drill"},
+		{xd.groupAdjacent, "string(@category)", ":h1;tools:saw;tools garden:hammer;garden:rake;:h2,drill"},
+		{xd.groupStartingWith, "local-name() = 'heading'", ":h1,saw,hammer,rake;:h2,drill"},
+		{xd.groupStartingWith, "@name = 'saw'", ":h1;:saw,hammer,rake,h2,drill"},
+	}
+	for _, tc := range testdata {
+		groups, err := tc.group(items, tc.expr)
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err)
+			continue
+		}
+		var got []string
+		for _, grp := range groups {
+			var names []string
+			for _, itm := range grp.items {
+				for _, attr := range itm.(*goxml.Element).Attributes() {
+					if attr.Name == "name" {
+						names = append(names, attr.Value)
+					}
+				}
+			}
+			got = append(got, grp.key.Stringvalue()+":"+strings.Join(names, ","))
+		}
+		if strings.Join(got, ";") != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.expr, strings.Join(got, ";"), tc.want)
+		}
+	}
+}
+
+func TestForAllGrouping(t *testing.T) {
+	t.Chdir(t.TempDir())
+	layout := `<Layout xmlns="urn:speedata.de/2021/xts/en" xmlns:sd="urn:speedata.de/2021/xtsfunctions/en">
+  <Record match="data">
+    <ForAll select="product" group-by="@category" sort="sd:current-grouping-key()">
+      <TestGroup select="sd:current-grouping-key() || ':' || string-join(sd:sort(sd:current-group(), 'number(@price)')/@name, ',')"/>
+    </ForAll>
+    <ForAll select="product" group-adjacent="@category">
+      <TestGroup select="sd:current-grouping-key() || ':' || count(sd:current-group())"/>
+    </ForAll>
+    <ForAll select="*" group-starting-with="local-name() = 'heading'">
+      <TestGroup select="string(@name) || ':' || count(sd:current-group())"/>
+    </ForAll>
+    <PlaceObject><TextBlock><Paragraph><Value>x</Value></Paragraph></TextBlock></PlaceObject>
+  </Record>
+</Layout>`
+	data := `<data>
+  <heading name="h1"/>
+  <product category="tools" name="saw" price="20"/>
+  <product category="tools" name="hammer" price="9.5"/>
+  <product category="garden" name="rake" price="12"/>
+  <heading name="h2"/>
+  <product category="tools" name="drill" price="80"/>
+</data>`
+	var got []string
+	registerTestCommand(t, "TestGroup", func(d *Document, layoutelt *goxml.Element) (xpath.Sequence, error) {
+		seq, err := d.EvaluateXPath(layoutelt, layoutelt.Attributes()[0].Value)
+		got = append(got, seq.Stringvalue())
+		return nil, err
+	})
+	if _, err := runLayout("grouping", layout, data); err != nil {
+		t.Fatal(err)
+	}
+	want := "garden:rake;tools:hammer,saw,drill;tools:2;garden:1;tools:1;h1:4;h2:2"
+	if strings.Join(got, ";") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, ";"), want)
+	}
+}
@@ -11,36 +11,69 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
-var filelist = make(map[string]string)
+// A FileIndex maps file names to the full path of files found in a set of
+// directories. It is safe for concurrent use, so a server can share one index
+// between several publishing runs or give each run its own.
+type FileIndex struct {
+	mu    sync.RWMutex
+	files map[string]string
+}
 
-// AddDir recursively adds a directory to the file list
-func AddDir(dirname string) error {
+// NewFileIndex returns an empty file index.
+func NewFileIndex() *FileIndex {
+	return &FileIndex{files: make(map[string]string)}
+}
+
+// defaultFileIndex is used by the package level functions AddDir, InitDirs,
+// FindFile and FindFontFiles.
+var defaultFileIndex = NewFileIndex()
+
+// AddDir recursively adds a directory to the file index.
+func (fi *FileIndex) AddDir(dirname string) error {
 	slog.Debug("Add directory to recursive file list", "dir", dirname)
-	return filepath.WalkDir(dirname, dirWalker)
+	return filepath.WalkDir(dirname, func(path string, d fs.DirEntry, err error) error {
+		if d == nil {
+			return fmt.Errorf("%w %q", os.ErrNotExist, path)
+		}
+		if d.Type().IsRegular() {
+			fi.mu.Lock()
+			fi.files[filepath.Base(path)] = path
+			fi.mu.Unlock()
+		}
+		return nil
+	})
 }
 
-// InitDirs starts indexing the files.
-func InitDirs(basedir string) error {
+// InitDirs adds the default directories below basedir to the file index.
+func (fi *FileIndex) InitDirs(basedir string) error {
 	var err error
 	for _, dir := range []string{"img"} {
 		dir = filepath.Join(basedir, dir)
-		if err = AddDir(dir); err != nil {
+		if err = fi.AddDir(dir); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func dirWalker(path string, d fs.DirEntry, err error) error {
-	if d == nil {
-		return fmt.Errorf("%w %q", os.ErrNotExist, path)
-	}
-	if d.Type().IsRegular() {
-		filelist[filepath.Base(path)] = path
-	}
-	return nil
+func (fi *FileIndex) lookup(filename string) (string, bool) {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	fn, ok := fi.files[filename]
+	return fn, ok
+}
+
+// AddDir recursively adds a directory to the process wide file list
+func AddDir(dirname string) error {
+	return defaultFileIndex.AddDir(dirname)
+}
+
+// InitDirs starts indexing the files.
+func InitDirs(basedir string) error {
+	return defaultFileIndex.InitDirs(basedir)
 }
 
 // urldownloader downloads the given URI to a file. No caching is performed.
@@ -74,9 +107,16 @@ func urldownloader(uri string) (string, error) {
 	return w.Name(), nil
 }
 
-// FindFile returns the full path to the file name.
+// FindFile returns the full path to the file name. It looks in the process
+// wide file list first.
 func FindFile(filename string) (string, error) {
-	if fn, ok := filelist[filename]; ok {
+	return defaultFileIndex.FindFile(filename)
+}
+
+// FindFile returns the full path to the file name. Files in the index take
+// precedence over URLs and paths relative to the current directory.
+func (fi *FileIndex) FindFile(filename string) (string, error) {
+	if fn, ok := fi.lookup(filename); ok {
 		slog.Debug("File lookup", "src", filename, "found", fn)
 		return fn, nil
 	}
@@ -106,18 +146,21 @@ func isFontFile(filename string) bool {
 	return strings.HasSuffix(l, ".ttf") || strings.HasSuffix(l, ".otf")
 }
 
-// FindFontFiles returns a list of all font files (otf,ttf)
+// FindFontFiles returns a list of all font files (otf,ttf) in the process wide
+// file list.
 func FindFontFiles() []string {
+	return defaultFileIndex.FindFontFiles()
+}
+
+// FindFontFiles returns a list of all font files (otf,ttf) in the index.
+func (fi *FileIndex) FindFontFiles() []string {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
 	var ret []string
-	for _, fn := range filelist {
+	for _, fn := range fi.files {
 		if isFontFile(fn) {
 			ret = append(ret, fn)
 		}
 	}
 	return ret
 }
-
-func fileexists(fn string) bool {
-	_, ok := filelist[fn]
-	return ok
-}
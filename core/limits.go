@@ -0,0 +1,56 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/speedata/goxml"
+)
+
+// Limits restricts the resources a publishing run may use. A zero value means
+// no limit.
+type Limits struct {
+	MaxPages          int           // maximum number of pages in the PDF
+	MaxDuration       time.Duration // maximum wall-clock time of the run
+	MaxLoopIterations int           // maximum number of iterations of a single Loop, While or Until
+}
+
+// checkRunning returns an error if the publishing run has been cancelled, has
+// run out of time or has created too many pages. The error names the layout
+// element that was about to be executed.
+func (xd *xtsDocument) checkRunning(layoutelt *goxml.Element) error {
+	if cause := context.Cause(xd.ctx); cause != nil {
+		return newStopError(layoutelt, cause)
+	}
+	if maxPages := xd.cfg.Limits.MaxPages; maxPages > 0 && xd.currentPagenumber > maxPages {
+		return newStopError(layoutelt, fmt.Errorf("page limit of %d exceeded", maxPages))
+	}
+	return nil
+}
+
+// checkIteration is called by the loop commands before each iteration.
+func (xd *xtsDocument) checkIteration(layoutelt *goxml.Element, iteration int) error {
+	if err := xd.checkRunning(layoutelt); err != nil {
+		return err
+	}
+	if maxIterations := xd.cfg.Limits.MaxLoopIterations; maxIterations > 0 && iteration > maxIterations {
+		return newStopError(layoutelt, fmt.Errorf("loop limit of %d iterations exceeded", maxIterations))
+	}
+	return nil
+}
+
+// newStopError creates and logs a TypesettingError for a run that has been
+// stopped.
+func newStopError(layoutelt *goxml.Element, cause error) error {
+	te := TypesettingError{
+		Msg:     "publishing run stopped: " + cause.Error(),
+		Command: layoutelt.Name,
+		Line:    layoutelt.Line,
+		Err:     cause,
+	}
+	slog.Error(te.Error())
+	te.Logged = true
+	return te
+}
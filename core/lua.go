@@ -0,0 +1,423 @@
+package core
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	lua "github.com/speedata/go-lua"
+	"github.com/speedata/goxml"
+	xpath "github.com/speedata/goxpath"
+	"github.com/speedata/xts/xts/luaxml"
+)
+
+// luaFunctionsKey is the name of the table in the Lua registry that holds the
+// functions registered with document.register_function().
+const luaFunctionsKey = "xts.functions"
+
+// luaState returns the Lua state of the publishing run. All <Lua> commands and
+// Lua XPath functions of a run share the state, so global Lua variables and
+// functions stay defined until the end of the run. The modules in
+// XTSConfig.LuaModules can be loaded with require(), in safe mode the standard
+// library has no file, environment and process access.
+func (xd *xtsDocument) luaState() *lua.State {
+	if xd.lua != nil {
+		return xd.lua
+	}
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	if xd.cfg.Safe {
+		RestrictLuaLibraries(l)
+	}
+	for name, loader := range xd.cfg.LuaModules {
+		preloadLuaModule(l, name, loader)
+	}
+	preloadLuaModule(l, "document", xd.luaDocumentLoader)
+	l.NewTable()
+	l.SetField(lua.RegistryIndex, luaFunctionsKey)
+	xd.lua = l
+	return l
+}
+
+// RestrictLuaLibraries removes the functions of the Lua standard library that
+// access files, the environment or external programs. require() only loads
+// the preloaded modules.
+func RestrictLuaLibraries(l *lua.State) {
+	l.PushNil()
+	l.SetGlobal("io")
+	l.Global("os")
+	for _, name := range []string{"execute", "exit", "getenv", "remove", "rename", "tmpname"} {
+		l.PushNil()
+		l.SetField(-2, name)
+	}
+	l.Pop(1)
+	for _, name := range []string{"dofile", "loadfile"} {
+		l.PushNil()
+		l.SetGlobal(name)
+	}
+	// keep only the searcher for package.preload
+	l.Global("package")
+	l.Field(-1, "searchers")
+	l.CreateTable(1, 0)
+	l.RawGetInt(-2, 1)
+	l.RawSetInt(-2, 1)
+	l.SetField(-3, "searchers")
+	l.Pop(1)
+	l.PushNil()
+	l.SetField(-2, "searchpath")
+	l.Pop(1)
+}
+
+// preloadLuaModule registers a module loader in package.preload[name]
+func preloadLuaModule(l *lua.State, name string, loader lua.Function) {
+	l.Global("package")
+	l.Field(-1, "preload")
+	l.PushGoFunction(loader)
+	l.SetField(-2, name)
+	l.Pop(2) // pop preload and package
+}
+
+// luaDocumentLoader creates the document module which gives Lua code access
+// to the data and the variables of the publishing run.
+func (xd *xtsDocument) luaDocumentLoader(l *lua.State) int {
+	lua.NewLibrary(l, []lua.RegistryFunction{
+		{Name: "xpath", Function: xd.luaXPath},
+		{Name: "node", Function: xd.luaNode},
+		{Name: "register_function", Function: xd.luaRegisterFunction},
+	})
+
+	// variables sub-table with metatable
+	l.NewTable()
+	l.NewTable()
+	l.PushGoFunction(xd.luaIndexVariables)
+	l.SetField(-2, "__index")
+	l.PushGoFunction(xd.luaNewIndexVariables)
+	l.SetField(-2, "__newindex")
+	l.SetMetaTable(-2)
+	l.SetField(-2, "variables")
+	return 1
+}
+
+// luaXPath evaluates an XPath expression in the current data context.
+func (xd *xtsDocument) luaXPath(l *lua.State) int {
+	expr := lua.CheckString(l, 1)
+	namespaces := xd.luaNamespaces
+	if namespaces == nil {
+		namespaces = xd.data.Ctx.Namespaces
+	}
+	seq, err := evaluateXPath(xd, namespaces, expr)
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+	}
+	PushSequence(l, seq)
+	return 1
+}
+
+// luaNode returns the current data node as a table in the format of
+// xml.decode_xml().
+func (xd *xtsDocument) luaNode(l *lua.State) int {
+	seq := xd.data.Ctx.GetContextSequence()
+	if len(seq) == 0 {
+		l.PushNil()
+		return 1
+	}
+	switch t := seq[0].(type) {
+	case *goxml.Element:
+		luaxml.PushElement(l, t)
+	case *goxml.XMLDocument:
+		if root, err := t.Root(); err == nil {
+			luaxml.PushElement(l, root)
+		} else {
+			l.PushNil()
+		}
+	default:
+		pushItem(l, t)
+	}
+	return 1
+}
+
+// luaRegisterFunction makes a Lua function available as an XPath function:
+// document.register_function(namespace, name, function).
+func (xd *xtsDocument) luaRegisterFunction(l *lua.State) int {
+	ns := lua.CheckString(l, 1)
+	name := lua.CheckString(l, 2)
+	lua.CheckType(l, 3, lua.TypeFunction)
+	if err := registerLayoutFunction(ns, name); err != nil {
+		lua.Errorf(l, "%s", err.Error())
+	}
+	key := ns + " " + name
+	l.Field(lua.RegistryIndex, luaFunctionsKey)
+	l.PushValue(3)
+	l.SetField(-2, key)
+	l.Pop(1)
+	xd.functions[key] = &layoutFunction{lua: true}
+	return 0
+}
+
+func (xd *xtsDocument) luaIndexVariables(l *lua.State) int {
+	// 1: tbl, 2: key
+	name := lua.CheckString(l, 2)
+	seq, err := xd.data.Evaluate("$" + name)
+	if err != nil {
+		l.PushNil()
+		return 1
+	}
+	PushSequence(l, seq)
+	return 1
+}
+
+func (xd *xtsDocument) luaNewIndexVariables(l *lua.State) int {
+	// 1: tbl, 2: key, 3: value
+	name := lua.CheckString(l, 2)
+	xd.data.SetVariable(name, LuaToSequence(l, 3))
+	return 0
+}
+
+// callLuaFunction calls the Lua function that has been registered with
+// document.register_function() under key.
+func (xd *xtsDocument) callLuaFunction(key string, args []xpath.Sequence) (xpath.Sequence, error) {
+	l := xd.luaState()
+	l.Field(lua.RegistryIndex, luaFunctionsKey)
+	l.Field(-1, key)
+	l.Remove(-2)
+	return xd.callLua(l, args)
+}
+
+// callLua calls the function on top of the Lua stack with the arguments and
+// returns the result as a sequence.
+func (xd *xtsDocument) callLua(l *lua.State, args []xpath.Sequence) (xpath.Sequence, error) {
+	for _, arg := range args {
+		PushSequence(l, arg)
+	}
+	top := l.Top() - len(args) - 1
+	if err := l.ProtectedCall(len(args), lua.MultipleReturns, 0); err != nil {
+		return nil, err
+	}
+	var seq xpath.Sequence
+	for i := top + 1; i <= l.Top(); i++ {
+		seq = append(seq, LuaToSequence(l, i)...)
+	}
+	l.SetTop(top)
+	return seq, nil
+}
+
+// cmdLua runs the Lua code in the file given by the file attribute or the
+// Lua code in the element contents. The return values of the script are the
+// result of the command.
+func cmdLua(xd *xtsDocument, layoutelt *goxml.Element) (xpath.Sequence, error) {
+	var err error
+	attValues := &struct {
+		File string
+	}{}
+	if err = getXMLAttributes(xd, layoutelt, attValues); err != nil {
+		return nil, err
+	}
+	var code, chunkname string
+	if attValues.File != "" {
+		fn, err := xd.findFile(attValues.File)
+		if err != nil {
+			return nil, newTypesettingError("Lua", layoutelt.Line, err.Error())
+		}
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, newTypesettingError("Lua", layoutelt.Line, err.Error())
+		}
+		code = string(data)
+		chunkname = "@" + attValues.File
+	} else {
+		var sb strings.Builder
+		for _, cld := range layoutelt.Children() {
+			if cd, ok := cld.(goxml.CharData); ok {
+				sb.WriteString(cd.Contents)
+			}
+		}
+		code = sb.String()
+		chunkname = fmt.Sprintf("=Lua (line %d)", layoutelt.Line)
+	}
+	l := xd.luaState()
+	saveNamespaces := xd.luaNamespaces
+	xd.luaNamespaces = layoutelt.Namespaces
+	defer func() { xd.luaNamespaces = saveNamespaces }()
+	if err = lua.LoadBuffer(l, code, chunkname, "t"); err != nil {
+		l.Pop(1)
+		return nil, newTypesettingError("Lua", layoutelt.Line, err.Error())
+	}
+	seq, err := xd.callLua(l, nil)
+	if err != nil {
+		return nil, newTypesettingError("Lua", layoutelt.Line, err.Error())
+	}
+	return seq, nil
+}
+
+// PushSequence pushes the sequence as one Lua value: nil for the empty
+// sequence, a string, number or boolean for a single item and an array for
+// longer sequences. Maps become tables with string keys, arrays become Lua
+// arrays and elements become tables in the format of xml.decode_xml().
+func PushSequence(l *lua.State, seq xpath.Sequence) {
+	switch len(seq) {
+	case 0:
+		l.PushNil()
+	case 1:
+		pushItem(l, seq[0])
+	default:
+		l.CreateTable(len(seq), 0)
+		for i, itm := range seq {
+			pushItem(l, itm)
+			l.RawSetInt(-2, i+1)
+		}
+	}
+}
+
+func pushItem(l *lua.State, itm xpath.Item) {
+	switch t := itm.(type) {
+	case string:
+		l.PushString(t)
+	case int:
+		l.PushInteger(t)
+	case float64:
+		l.PushNumber(t)
+	case bool:
+		l.PushBoolean(t)
+	case *goxml.Element:
+		luaxml.PushElement(l, t)
+	case *xpath.XPathMap:
+		l.CreateTable(0, len(t.Entries))
+		for _, entry := range t.Entries {
+			l.PushString(xpath.ItemStringvalue(entry.Key))
+			PushSequence(l, entry.Value)
+			l.SetTable(-3)
+		}
+	case *xpath.XPathArray:
+		l.CreateTable(len(t.Members), 0)
+		for i, member := range t.Members {
+			PushSequence(l, member)
+			l.RawSetInt(-2, i+1)
+		}
+	default:
+		l.PushString(xpath.ItemStringvalue(t))
+	}
+}
+
+// LuaToSequence converts the Lua value at index to a sequence. Arrays are
+// flattened, tables with string keys become maps and tables in the format of
+// xml.decode_xml() (type = "element") become elements.
+func LuaToSequence(l *lua.State, index int) xpath.Sequence {
+	index = l.AbsIndex(index)
+	switch l.TypeOf(index) {
+	case lua.TypeNil, lua.TypeNone:
+		return xpath.Sequence{}
+	case lua.TypeBoolean:
+		return xpath.Sequence{l.ToBoolean(index)}
+	case lua.TypeNumber:
+		if l.IsInteger(index) {
+			i, _ := l.ToInteger(index)
+			return xpath.Sequence{i}
+		}
+		f, _ := l.ToNumber(index)
+		return xpath.Sequence{f}
+	case lua.TypeString:
+		s, _ := l.ToString(index)
+		return xpath.Sequence{s}
+	case lua.TypeTable:
+		l.Field(index, "type")
+		typ, _ := l.ToString(-1)
+		l.Pop(1)
+		if typ == "element" {
+			return xpath.Sequence{luaToElement(l, index)}
+		}
+		length := l.RawLength(index)
+		if length == 0 {
+			if m := luaToMap(l, index); len(m.Entries) > 0 {
+				return xpath.Sequence{m}
+			}
+			return xpath.Sequence{}
+		}
+		var seq xpath.Sequence
+		for i := 1; i <= length; i++ {
+			l.RawGetInt(index, i)
+			seq = append(seq, LuaToSequence(l, -1)...)
+			l.Pop(1)
+		}
+		return seq
+	}
+	return xpath.Sequence{fmt.Sprint(l.ToValue(index))}
+}
+
+// luaToMap converts the table at index to an XPath map. The entries are
+// sorted by key.
+func luaToMap(l *lua.State, index int) *xpath.XPathMap {
+	m := &xpath.XPathMap{}
+	l.PushNil()
+	for l.Next(index) {
+		l.PushValue(-2) // ToString changes numbers in place
+		key, _ := l.ToString(-1)
+		l.Pop(1)
+		m.Entries = append(m.Entries, xpath.MapEntry{Key: key, Value: LuaToSequence(l, -1)})
+		l.Pop(1)
+	}
+	slices.SortFunc(m.Entries, func(a, b xpath.MapEntry) int {
+		return strings.Compare(a.Key.(string), b.Key.(string))
+	})
+	return m
+}
+
+// luaToElement converts the table at index (in the format of
+// xml.decode_xml()) to an element. Strings and numbers in the array part
+// become text nodes, tables become child elements.
+func luaToElement(l *lua.State, index int) *goxml.Element {
+	elt := goxml.NewElement()
+	elt.ID = goxml.NewID()
+	l.Field(index, "name")
+	elt.Name, _ = l.ToString(-1)
+	l.Pop(1)
+
+	l.Field(index, "attribs")
+	if l.IsTable(-1) {
+		var attrs []xml.Attr
+		l.PushNil()
+		for l.Next(-2) {
+			name, _ := l.ToString(-2)
+			l.PushValue(-1)
+			value, _ := l.ToString(-1)
+			l.Pop(2)
+			// attributes in a namespace have the key URI:local
+			var attrName xml.Name
+			if i := strings.LastIndexByte(name, ':'); i >= 0 {
+				attrName = xml.Name{Space: name[:i], Local: name[i+1:]}
+			} else {
+				attrName = xml.Name{Local: name}
+			}
+			attrs = append(attrs, xml.Attr{Name: attrName, Value: value})
+		}
+		slices.SortFunc(attrs, func(a, b xml.Attr) int {
+			return cmp.Or(strings.Compare(a.Name.Space, b.Name.Space), strings.Compare(a.Name.Local, b.Name.Local))
+		})
+		for _, attr := range attrs {
+			elt.SetAttribute(attr)
+		}
+	}
+	l.Pop(1)
+
+	length := l.RawLength(index)
+	for i := 1; i <= length; i++ {
+		l.RawGetInt(index, i)
+		switch l.TypeOf(-1) {
+		case lua.TypeTable:
+			for _, itm := range LuaToSequence(l, -1) {
+				if cld, ok := itm.(*goxml.Element); ok {
+					elt.Append(cld)
+				}
+			}
+		case lua.TypeString, lua.TypeNumber:
+			l.PushValue(-1)
+			s, _ := l.ToString(-1)
+			l.Pop(1)
+			elt.Append(goxml.CharData{ID: goxml.NewID(), Contents: s})
+		}
+		l.Pop(1)
+	}
+	return elt
+}
@@ -0,0 +1,374 @@
+package core
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+)
+
+// currencySign is used internally for an unquoted ¤ in a number pattern.
+const currencySign = "\x00"
+
+// numberLocale has the number symbols of a locale.
+type numberLocale struct {
+	decimal        string
+	group          string
+	secondaryGroup int // size of the second and further groups, 0 = same as the first
+	currency       string
+	currencyAfter  bool // the currency symbol is written after the number
+	currencySpace  bool // a no-break space separates currency symbol and number
+}
+
+var numberLocales = map[string]numberLocale{
+	"en":    {decimal: ".", group: ",", currency: "USD"},
+	"en-us": {decimal: ".", group: ",", currency: "USD"},
+	"en-gb": {decimal: ".", group: ",", currency: "GBP"},
+	"en-in": {decimal: ".", group: ",", secondaryGroup: 2, currency: "INR"},
+	"de":    {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: true},
+	"de-de": {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: true},
+	"de-ch": {decimal: ".", group: "’", currency: "CHF", currencySpace: true},
+	"fr":    {decimal: ",", group: "\u202f", currency: "EUR", currencyAfter: true, currencySpace: true},
+	"fr-fr": {decimal: ",", group: "\u202f", currency: "EUR", currencyAfter: true, currencySpace: true},
+	"fr-ch": {decimal: ".", group: "’", currency: "CHF", currencyAfter: true, currencySpace: true},
+	"it":    {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: true},
+	"it-it": {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: true},
+	"es":    {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: true},
+	"es-es": {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: true},
+	"nl":    {decimal: ",", group: ".", currency: "EUR", currencySpace: true},
+	"nl-nl": {decimal: ",", group: ".", currency: "EUR", currencySpace: true},
+}
+
+var currencySymbols = map[string]string{
+	"CNY": "¥",
+	"CZK": "Kč",
+	"DKK": "kr",
+	"EUR": "€",
+	"GBP": "£",
+	"INR": "₹",
+	"JPY": "¥",
+	"NOK": "kr",
+	"PLN": "zł",
+	"SEK": "kr",
+	"USD": "$",
+}
+
+// getNumberLocale returns the locale with the given name such as "de-DE".
+func getNumberLocale(name string) (numberLocale, error) {
+	loc, ok := numberLocales[strings.ToLower(strings.ReplaceAll(name, "_", "-"))]
+	if !ok {
+		return loc, fmt.Errorf("unknown locale %q", name)
+	}
+	return loc, nil
+}
+
+// numberFormatOptions are the settings of sd:format-number() besides the
+// pattern.
+type numberFormatOptions struct {
+	locale           numberLocale
+	rounding         string
+	currency         string
+	currencySymbol   string
+	currencyPosition string // "", "before" or "after"
+}
+
+// numberPattern is a parsed pattern such as "#,##0.00;(#,##0.00)".
+type numberPattern struct {
+	prefix, suffix       string
+	negPrefix, negSuffix string
+	hasNegative          bool
+	minInt               int
+	minFrac, maxFrac     int
+	primary, secondary   int // grouping sizes, 0 = no grouping
+	scale                int // 2 for percent, 3 for per mille
+}
+
+// splitPatternSections splits the pattern at unquoted semicolons.
+func splitPatternSections(pattern string) []string {
+	var sections []string
+	quoted := false
+	start := 0
+	for i, r := range pattern {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			sections = append(sections, pattern[start:i])
+			start = i + 1
+		}
+	}
+	return append(sections, pattern[start:])
+}
+
+// parseAffix returns prefix or suffix text with quotes removed. The unquoted
+// currency sign is replaced by currencySign, percent and per mille set the
+// scale.
+func parseAffix(s string, scale *int) string {
+	var sb strings.Builder
+	quoted := false
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\'':
+			if i+1 < len(runes) && runes[i+1] == '\'' {
+				sb.WriteRune('\'')
+				i++
+			} else {
+				quoted = !quoted
+			}
+		case quoted:
+			sb.WriteRune(r)
+		case r == '¤':
+			if i+1 < len(runes) && runes[i+1] == '¤' {
+				sb.WriteString(currencySign + currencySign)
+				i++
+			} else {
+				sb.WriteString(currencySign)
+			}
+		case r == '%':
+			*scale = 2
+			sb.WriteRune(r)
+		case r == '‰':
+			*scale = 3
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// splitAffixes returns the prefix, the number part and the suffix of a
+// pattern section.
+func splitAffixes(section string) (string, string, string) {
+	quoted := false
+	start, end := -1, -1
+	for i, r := range section {
+		if r == '\'' {
+			quoted = !quoted
+			continue
+		}
+		if quoted {
+			continue
+		}
+		if strings.ContainsRune("#0,.", r) {
+			if start < 0 {
+				start = i
+			}
+			end = i + 1
+		} else if start >= 0 {
+			break
+		}
+	}
+	if start < 0 {
+		return section, "", ""
+	}
+	return section[:start], section[start:end], section[end:]
+}
+
+// parseNumberPattern parses a pattern like "#,##0.00". The pattern can have
+// a second section for negative numbers, separated by a semicolon.
+func parseNumberPattern(pattern string) (*numberPattern, error) {
+	sections := splitPatternSections(pattern)
+	if len(sections) > 2 {
+		return nil, fmt.Errorf("number pattern %q has more than two sections", pattern)
+	}
+	np := &numberPattern{}
+	prefix, number, suffix := splitAffixes(sections[0])
+	if number == "" {
+		return nil, fmt.Errorf("number pattern %q has no digits", pattern)
+	}
+	np.prefix = parseAffix(prefix, &np.scale)
+	np.suffix = parseAffix(suffix, &np.scale)
+
+	intPart, fracPart, _ := strings.Cut(number, ".")
+	if strings.ContainsAny(fracPart, ".,") {
+		return nil, fmt.Errorf("invalid number pattern %q", pattern)
+	}
+	np.maxFrac = len(fracPart)
+	np.minFrac = strings.LastIndex(fracPart, "0") + 1
+	groups := strings.Split(intPart, ",")
+	np.minInt = strings.Count(intPart, "0")
+	if len(groups) > 1 {
+		np.primary = len(groups[len(groups)-1])
+		if len(groups) > 2 {
+			np.secondary = len(groups[len(groups)-2])
+		}
+	}
+
+	if len(sections) == 2 {
+		var scale int
+		negPrefix, _, negSuffix := splitAffixes(sections[1])
+		np.negPrefix = parseAffix(negPrefix, &scale)
+		np.negSuffix = parseAffix(negSuffix, &scale)
+		np.hasNegative = true
+	}
+	return np, nil
+}
+
+// roundDecimal rounds the decimal number given by the digits of the integer
+// and the fractional part to maxFrac fractional digits.
+func roundDecimal(intPart, fracPart string, maxFrac int, mode string, negative bool) (string, string, error) {
+	if len(fracPart) <= maxFrac {
+		return intPart, fracPart, nil
+	}
+	kept, dropped := fracPart[:maxFrac], fracPart[maxFrac:]
+	first := dropped[0]
+	restNonZero := strings.TrimRight(dropped[1:], "0") != ""
+	nonZero := first != '0' || restNonZero
+	digits := intPart + kept
+	var up bool
+	switch mode {
+	case "", "half-up":
+		up = first >= '5'
+	case "half-down":
+		up = first > '5' || first == '5' && restNonZero
+	case "half-even":
+		last := byte('0')
+		if digits != "" {
+			last = digits[len(digits)-1]
+		}
+		up = first > '5' || first == '5' && (restNonZero || (last-'0')%2 == 1)
+	case "up":
+		up = nonZero
+	case "down":
+		up = false
+	case "ceiling":
+		up = nonZero && !negative
+	case "floor":
+		up = nonZero && negative
+	default:
+		return "", "", fmt.Errorf("unknown rounding mode %q", mode)
+	}
+	if up {
+		b := []byte(digits)
+		i := len(b) - 1
+		for ; i >= 0; i-- {
+			if b[i] == '9' {
+				b[i] = '0'
+				continue
+			}
+			b[i]++
+			break
+		}
+		digits = string(b)
+		if i < 0 {
+			digits = "1" + digits
+		}
+	}
+	n := len(digits) - maxFrac
+	return digits[:n], digits[n:], nil
+}
+
+// groupDigits inserts the separator into the integer digits.
+func groupDigits(digits string, primary, secondary int, sep string) string {
+	if primary <= 0 || len(digits) <= primary {
+		return digits
+	}
+	if secondary <= 0 {
+		secondary = primary
+	}
+	groups := []string{digits[len(digits)-primary:]}
+	digits = digits[:len(digits)-primary]
+	for len(digits) > secondary {
+		groups = append([]string{digits[len(digits)-secondary:]}, groups...)
+		digits = digits[:len(digits)-secondary]
+	}
+	if digits != "" {
+		groups = append([]string{digits}, groups...)
+	}
+	return strings.Join(groups, sep)
+}
+
+// formatDecimalPattern formats a decimal number given as a string such as
+// "-1234.5" with the pattern.
+func formatDecimalPattern(str string, pattern string, opts numberFormatOptions) (string, error) {
+	np, err := parseNumberPattern(pattern)
+	if err != nil {
+		return "", err
+	}
+	negative := strings.HasPrefix(str, "-")
+	str = strings.TrimPrefix(str, "-")
+	intPart, fracPart, _ := strings.Cut(str, ".")
+	// percent and per mille: move the decimal point
+	for range np.scale {
+		if fracPart == "" {
+			intPart += "0"
+		} else {
+			intPart += fracPart[:1]
+			fracPart = fracPart[1:]
+		}
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if intPart, fracPart, err = roundDecimal(intPart, fracPart, np.maxFrac, opts.rounding, negative); err != nil {
+		return "", err
+	}
+	for len(fracPart) > np.minFrac && strings.HasSuffix(fracPart, "0") {
+		fracPart = fracPart[:len(fracPart)-1]
+	}
+	if len(fracPart) < np.minFrac {
+		fracPart += strings.Repeat("0", np.minFrac-len(fracPart))
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(intPart) < np.minInt {
+		intPart = strings.Repeat("0", np.minInt-len(intPart)) + intPart
+	}
+	if intPart == "" && fracPart == "" {
+		intPart = "0"
+	}
+	if strings.Trim(intPart+fracPart, "0") == "" {
+		negative = false
+	}
+
+	loc := opts.locale
+	var sb strings.Builder
+	sb.WriteString(groupDigits(intPart, np.primary, cmp.Or(np.secondary, loc.secondaryGroup), loc.group))
+	if fracPart != "" {
+		sb.WriteString(loc.decimal)
+		sb.WriteString(fracPart)
+	}
+	prefix, suffix := np.prefix, np.suffix
+	if negative {
+		if np.hasNegative {
+			prefix, suffix = np.negPrefix, np.negSuffix
+		} else {
+			prefix = "-" + prefix
+		}
+	}
+	ret := prefix + sb.String() + suffix
+
+	currency := opts.currency
+	if currency == "" {
+		currency = loc.currency
+	}
+	symbol := opts.currencySymbol
+	if symbol == "" {
+		if symbol = currencySymbols[currency]; symbol == "" {
+			symbol = currency
+		}
+	}
+	if !strings.Contains(ret, currencySign) && (opts.currency != "" || opts.currencySymbol != "") {
+		// no ¤ in the pattern, add the currency symbol at the position of the
+		// locale
+		after := loc.currencyAfter
+		switch opts.currencyPosition {
+		case "before":
+			after = false
+		case "after":
+			after = true
+		}
+		space := ""
+		if loc.currencySpace || after || len([]rune(symbol)) > 1 {
+			space = "\u00a0"
+		}
+		if after {
+			ret = ret + space + symbol
+		} else if strings.HasPrefix(ret, "-") {
+			ret = "-" + symbol + space + ret[1:]
+		} else {
+			ret = symbol + space + ret
+		}
+	}
+	ret = strings.ReplaceAll(ret, currencySign+currencySign, currency)
+	return strings.ReplaceAll(ret, currencySign, symbol), nil
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatDecimalPattern(t *testing.T) {
+	data := []struct {
+		number  string
+		pattern string
+		opts    string // locale, rounding, currency
+		want    string
+	}{
+		{"1234.5", "#,##0.00", "", "1,234.50"},
+		{"-1234.5", "#,##0.00", "", "-1,234.50"},
+		{"-1234.5", "#,##0.00;(#,##0.00)", "", "(1,234.50)"},
+		{"2.675", "0.00", "", "2.68"},
+		{"2.665", "0.00", ",half-even", "2.66"},
+		{"2.675", "0.00", ",half-even", "2.68"},
+		{"2.679", "0.00", ",down", "2.67"},
+		{"-2.671", "0.00", ",floor", "-2.68"},
+		{"-2.671", "0.00", ",ceiling", "-2.67"},
+		{"9.999", "0.00", "", "10.00"},
+		{"-0.001", "0.00", "", "0.00"},
+		{"0.5", "#.##", "", ".5"},
+		{"1.5", "0.0##", "", "1.5"},
+		{"1.23456", "0.0##", "", "1.235"},
+		{"7", "000", "", "007"},
+		{"0.256", "0.0%", "", "25.6%"},
+		{"0.0125", "0.0‰", "", "12.5‰"},
+		{"1234567.891", "#,##0.00", "de-DE", "1.234.567,89"},
+		{"1234567.891", "#,##0.00", "fr-CH", "1’234’567.89"},
+		{"12345678", "#,##0", "en-IN", "1,23,45,678"},
+		{"12345678", "#,##,##0", "", "1,23,45,678"},
+		{"19.9", "#,##0.00", "de-DE,,EUR", "19,90\u00a0€"},
+		{"19.9", "#,##0.00", "en-US,,USD", "$19.90"},
+		{"-19.9", "#,##0.00", "en-US,,USD", "-$19.90"},
+		{"1234.5", "#,##0.00", "de-CH,,CHF", "CHF\u00a01’234.50"},
+		{"19.9", "¤ #,##0.00", "en,,EUR", "€ 19.90"},
+		{"19.9", "#,##0.00 ¤¤", "en,,EUR", "19.90 EUR"},
+		{"5", "0 'pcs.'", "", "5 pcs."},
+	}
+	for _, tc := range data {
+		opts := numberFormatOptions{locale: numberLocales["en"]}
+		fields := strings.Split(tc.opts, ",")
+		if fields[0] != "" {
+			loc, err := getNumberLocale(fields[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.locale = loc
+		}
+		if len(fields) > 1 {
+			opts.rounding = fields[1]
+		}
+		if len(fields) > 2 {
+			opts.currency = fields[2]
+		}
+		got, err := formatDecimalPattern(tc.number, tc.pattern, opts)
+		if err != nil {
+			t.Errorf("formatDecimalPattern(%q, %q): %s", tc.number, tc.pattern, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("formatDecimalPattern(%q, %q, %q) = %q, want %q", tc.number, tc.pattern, tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestGroupDigits(t *testing.T) {
+	data := []struct {
+		digits             string
+		primary, secondary int
+		want               string
+	}{
+		{"1234567", 3, 0, "1,234,567"},
+		{"123", 3, 0, "123"},
+		{"1234", 3, 3, "1,234"},
+		{"12345678", 3, 2, "1,23,45,678"},
+		{"1234", 0, 0, "1234"},
+	}
+	for _, tc := range data {
+		if got := groupDigits(tc.digits, tc.primary, tc.secondary, ","); got != tc.want {
+			t.Errorf("groupDigits(%q, %d, %d) = %q, want %q", tc.digits, tc.primary, tc.secondary, got, tc.want)
+		}
+	}
+}
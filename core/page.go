@@ -72,7 +72,6 @@ type page struct {
 	pageHeight    bag.ScaledPoint // total height of the (PDF) page
 	pagegrid      *grid
 	markerid      int
-	markerids     chan int
 	atPageShipout func()
 }
 
@@ -184,10 +183,6 @@ func newPage(xd *xtsDocument) (*page, func(), error) {
 		}
 
 	}
-	// per page unique marker ids
-	pg.markerids = make(chan int)
-	go pg.genMarkerIDs(pg.markerids)
-
 	// CHECK
 	docPage := pg.bagPage
 	docPage.Userdata = make(map[any]any)
@@ -195,11 +190,11 @@ func newPage(xd *xtsDocument) (*page, func(), error) {
 	return pg, atPageCreation, nil
 }
 
-func (p *page) genMarkerIDs(ids chan int) {
-	for {
-		ids <- p.markerid
-		p.markerid++
-	}
+// nextMarkerID returns a per page unique marker id.
+func (p *page) nextMarkerID() int {
+	id := p.markerid
+	p.markerid++
+	return id
 }
 
 func (p *page) outputAbsolute(x, y bag.ScaledPoint, vl *node.VList) {
@@ -14,10 +14,11 @@ import (
 
 // getNumDest returns a new start stop node with a ActionDest action and a
 // distinct numeric Value
-func getNumDest() *node.StartStop {
+func (xd *xtsDocument) getNumDest() *node.StartStop {
 	dest := node.NewStartStop()
 	dest.Action = node.ActionDest
-	dest.Value = <-destinationNumbers
+	dest.Value = xd.destinationNumber
+	xd.destinationNumber++
 	return dest
 }
 
@@ -94,8 +95,10 @@ func (m marker) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
 }
 
 type auxfile struct {
-	Marker   mapmarker `xml:"marker"`
-	LastPage int       `xml:"lastpage"`
+	Marker   mapmarker    `xml:"marker"`
+	LastPage int          `xml:"lastpage"`
+	TOC      []tocEntry   `xml:"toc>entry"`
+	Index    []indexEntry `xml:"index>entry"`
 }
 
 func (d *xtsDocument) writeAuxXML() error {
@@ -108,6 +111,11 @@ func (d *xtsDocument) writeAuxXML() error {
 	}
 	defer f.Close()
 	aux.Marker = d.marker
+	d.sortTOC()
+	aux.TOC = d.toc
+	d.checkTOC()
+	aux.Index = d.index
+	d.checkIndex()
 
 	data, err := xml.MarshalIndent(aux, "", "  ")
 	if err != nil {
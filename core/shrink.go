@@ -0,0 +1,275 @@
+package core
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/boxesandglue/boxesandglue/frontend"
+	"golang.org/x/net/html"
+)
+
+// fit="shrink" typesets the text of a TextBlock or a Td repeatedly with
+// decreasing font size and letter spacing until it is not higher than the
+// maximum height. The text is parsed once and the font sizes of the parsed
+// text are scaled, so text with mixed font sizes keeps its proportions.
+
+const fontsizeStep = bag.Factor / 2 // 0.5pt
+
+// letterSpacingFactors are tried for each font size, relative to the font
+// size.
+var letterSpacingFactors = []float64{0, -0.02, -0.04}
+
+// shrinkCell is a Td with fit="shrink". The td element has a data-vlist-id
+// attribute with an ID that is not in the pending vlists of the CSS builder,
+// so htmlbag keeps the contents of the cell and the table can find the cell
+// in the parsed HTML.
+type shrinkCell struct {
+	id          string          // the value of data-vlist-id
+	width       bag.ScaledPoint // 0: the width of the cell without padding and border
+	maxheight   bag.ScaledPoint
+	minfontsize bag.ScaledPoint
+	line        int
+	items       []any           // the parsed contents of the cell
+	cellWidth   bag.ScaledPoint // the width of the contents in the table
+	contents    *node.VList     // the contents of the cell in the last formatted table
+}
+
+// shrinkText is a text with its font size, leading, letter spacing and
+// vertical margins before shrinking.
+type shrinkText struct {
+	te                           *frontend.Text
+	size, leading, letterspacing bag.ScaledPoint
+	margintop, marginbottom      bag.ScaledPoint
+}
+
+// collectShrinkTexts returns the texts in items and all texts below them.
+func collectShrinkTexts(items []any, texts []shrinkText) []shrinkText {
+	for _, itm := range items {
+		te, ok := itm.(*frontend.Text)
+		if !ok {
+			continue
+		}
+		st := shrinkText{te: te}
+		st.size, _ = te.Settings[frontend.SettingSize].(bag.ScaledPoint)
+		st.leading, _ = te.Settings[frontend.SettingLeading].(bag.ScaledPoint)
+		st.letterspacing, _ = te.Settings[frontend.SettingLetterSpacing].(bag.ScaledPoint)
+		st.margintop, _ = te.Settings[frontend.SettingMarginTop].(bag.ScaledPoint)
+		st.marginbottom, _ = te.Settings[frontend.SettingMarginBottom].(bag.ScaledPoint)
+		texts = append(texts, st)
+		texts = collectShrinkTexts(te.Items, texts)
+	}
+	return texts
+}
+
+// scaleTexts sets the font size, the leading and the vertical margins of
+// each text to fs/base times the original value, so texts with different
+// sizes keep their ratio. The letter spacing is changed by factor times the
+// new font size.
+func scaleTexts(texts []shrinkText, fs, base bag.ScaledPoint, factor float64) {
+	scale := func(v bag.ScaledPoint) bag.ScaledPoint {
+		return bag.ScaledPoint(int64(v) * int64(fs) / int64(base))
+	}
+	for _, st := range texts {
+		if st.size == 0 {
+			continue
+		}
+		size := scale(st.size)
+		st.te.Settings[frontend.SettingSize] = size
+		if st.leading != 0 {
+			st.te.Settings[frontend.SettingLeading] = scale(st.leading)
+		}
+		st.te.Settings[frontend.SettingLetterSpacing] = scale(st.letterspacing) + bag.MultiplyFloat(size, factor)
+		if st.margintop != 0 {
+			st.te.Settings[frontend.SettingMarginTop] = scale(st.margintop)
+		}
+		if st.marginbottom != 0 {
+			st.te.Settings[frontend.SettingMarginBottom] = scale(st.marginbottom)
+		}
+	}
+}
+
+// maxFontSize returns the size of the largest glyph in the list or 0.
+func maxFontSize(n node.Node) bag.ScaledPoint {
+	var fs bag.ScaledPoint
+	for e := n; e != nil; e = e.Next() {
+		switch t := e.(type) {
+		case *node.Glyph:
+			if t.Font != nil {
+				fs = max(fs, t.Font.Size)
+			}
+		case *node.HList:
+			fs = max(fs, maxFontSize(t.List))
+		case *node.VList:
+			fs = max(fs, maxFontSize(t.List))
+		}
+	}
+	return fs
+}
+
+// shrinkToFit calls format to typeset the parsed text in items. If the
+// result is higher than maxheight, all texts in items are scaled down, so the
+// size of the largest text decreases in steps of 0.5pt down to minfontsize,
+// and format is called again. For each size, the letter spacing is reduced
+// before the next smaller size is tried. The chosen size is written to the
+// protocol.
+func (xd *xtsDocument) shrinkToFit(items []any, format func() (*node.VList, error), maxheight, minfontsize bag.ScaledPoint, cmdname string, line int) (*node.VList, error) {
+	vl, err := format()
+	if err != nil {
+		return nil, err
+	}
+	if vl.Height+vl.Depth <= maxheight {
+		return vl, nil
+	}
+	fontsize := maxFontSize(vl.List)
+	if fontsize == 0 {
+		return vl, nil
+	}
+	texts := collectShrinkTexts(items, nil)
+	for fs := fontsize; fs >= minfontsize; fs -= fontsizeStep {
+		for _, f := range letterSpacingFactors {
+			if fs == fontsize && f == 0 {
+				continue
+			}
+			scaleTexts(texts, fs, fontsize, f)
+			if vl, err = format(); err != nil {
+				return nil, err
+			}
+			if vl.Height+vl.Depth <= maxheight {
+				slog.Info(fmt.Sprintf("%s (line %d): shrink to fit", cmdname, line), "font-size", fs.String()+"pt", "letter-spacing", bag.MultiplyFloat(fs, f).String()+"pt")
+				return vl, nil
+			}
+		}
+	}
+	slog.Warn(fmt.Sprintf("%s (line %d): text does not fit into %spt with the minimum font size %spt", cmdname, line, maxheight, minfontsize), "height", (vl.Height+vl.Depth).String()+"pt")
+	return vl, nil
+}
+
+// tableShrinkCells returns the cells with fit="shrink" in the table and
+// removes them from the cells that are not formatted yet.
+func (xd *xtsDocument) tableShrinkCells(table *html.Node) []*shrinkCell {
+	var cells []*shrinkCell
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if c.Data == "td" {
+				for _, attr := range c.Attr {
+					if sc, ok := xd.shrinkCells[attr.Val]; ok && attr.Key == "data-vlist-id" {
+						cells = append(cells, sc)
+						delete(xd.shrinkCells, attr.Val)
+					}
+				}
+			}
+			walk(c)
+		}
+	}
+	walk(table)
+	return cells
+}
+
+// shrinkTable formats the HTML document with a table with the width. The
+// first pass gets the contents and the widths of the shrink cells. Then the
+// contents of each cell are shrunk on their own and the table is formatted
+// again with the shrunk cells.
+func (xd *xtsDocument) shrinkTable(doc *html.Node, width bag.ScaledPoint, cells []*shrinkCell) (*node.VList, error) {
+	vl, err := xd.formatTable(doc, width, cells)
+	if err != nil || len(cells) == 0 {
+		return vl, err
+	}
+	for _, sc := range cells {
+		if sc.contents == nil {
+			return nil, fmt.Errorf("table cell not found")
+		}
+		if _, err = xd.shrinkToFit(sc.items, func() (*node.VList, error) {
+			return xd.formatCellContents(sc.items, sc.cellWidth)
+		}, sc.maxheight, sc.minfontsize, "Td", sc.line); err != nil {
+			return nil, err
+		}
+	}
+	return xd.formatTable(doc, width, cells)
+}
+
+// formatTable formats the HTML document with a table with the width. The
+// contents of the cells are formatted with the width of the cell (or the
+// width of the Td) and kept in the cells.
+func (xd *xtsDocument) formatTable(doc *html.Node, width bag.ScaledPoint, cells []*shrinkCell) (*node.VList, error) {
+	te, err := xd.cssbuilder.ParseHTMLFromNode(doc)
+	if err != nil {
+		return nil, err
+	}
+	if len(cells) > 0 {
+		ids := make(map[string]*shrinkCell, len(cells))
+		for _, sc := range cells {
+			ids[sc.id] = sc
+		}
+		xd.hookShrinkCells(te, ids)
+	}
+	return xd.cssbuilder.CreateVlist(te, width)
+}
+
+// hookShrinkCells replaces the contents of the shrink cells in te by a
+// function that formats the contents with the width of the cell and
+// remembers the result. The contents of the first pass are used in all later
+// passes, so they keep the shrunk font sizes.
+func (xd *xtsDocument) hookShrinkCells(te *frontend.Text, cells map[string]*shrinkCell) {
+	for _, itm := range te.Items {
+		t, ok := itm.(*frontend.Text)
+		if !ok {
+			continue
+		}
+		id, _ := t.Settings[frontend.SettingPrerenderedVListID].(string)
+		sc, ok := cells[id]
+		if !ok {
+			xd.hookShrinkCells(t, cells)
+			continue
+		}
+		if sc.items == nil {
+			sc.items = t.Items
+		}
+		t.Items = []any{frontend.FormatToVList(func(wd bag.ScaledPoint) (*node.VList, error) {
+			if sc.width > 0 {
+				wd = sc.width
+			}
+			sc.cellWidth = wd
+			vl, err := xd.formatCellContents(sc.items, wd)
+			if err != nil {
+				return nil, err
+			}
+			sc.contents = vl
+			return vl, nil
+		})}
+	}
+}
+
+// formatCellContents formats the items of a table cell the same way as
+// the table does.
+func (xd *xtsDocument) formatCellContents(items []any, width bag.ScaledPoint) (*node.VList, error) {
+	var head node.Node
+	for _, itm := range items {
+		var vl *node.VList
+		var err error
+		switch t := itm.(type) {
+		case *frontend.Text:
+			if isBox, ok := t.Settings[frontend.SettingBox].(bool); ok && isBox {
+				vl, err = xd.cssbuilder.CreateVlist(t, width)
+			} else {
+				vl, _, err = xd.document.FormatParagraph(t, width)
+			}
+		case frontend.FormatToVList:
+			vl, err = t(width)
+		default:
+			slog.Error(fmt.Sprintf("formatCellContents: unknown type %T", t))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if vl != nil {
+			head = node.InsertAfter(head, node.Tail(head), vl)
+		}
+	}
+	return node.Vpack(head), nil
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/speedata/goxpath"
+	"golang.org/x/net/html"
+)
+
+// measureWidth is the line width for sd:text-width(), wide enough that the
+// text is not broken into lines.
+const measureWidth = 100000 * bag.Factor
+
+// typesetText formats the text as a paragraph with the CSS class in the same
+// way as TextBlock does, but the result is not placed.
+func (xd *xtsDocument) typesetText(text, class string, width bag.ScaledPoint) (*node.VList, error) {
+	p := &html.Node{Type: html.ElementNode, Data: "p"}
+	if class != "" {
+		p.Attr = append(p.Attr, html.Attribute{Key: "class", Val: class})
+	}
+	p.AppendChild(&html.Node{Type: html.TextNode, Data: text})
+	doc, body := newHTMLDocument()
+	body.AppendChild(p)
+	return xd.formatHTMLDocument(doc, width)
+}
+
+// naturalWidth returns the width of the longest line in the list without
+// the stretchable glue at the end of the lines. Lists that contain other
+// lists (paragraphs, the box around the text block) are searched
+// recursively.
+func naturalWidth(n node.Node) bag.ScaledPoint {
+	var maxwd bag.ScaledPoint
+	for e := n; e != nil; e = e.Next() {
+		switch t := e.(type) {
+		case *node.VList:
+			maxwd = max(maxwd, naturalWidth(t.List))
+		case *node.HList:
+			maxwd = max(maxwd, lineWidth(t))
+		}
+	}
+	return maxwd
+}
+
+// lineWidth returns the width of the contents of a line up to the first
+// infinitely stretchable glue.
+func lineWidth(hl *node.HList) bag.ScaledPoint {
+	stop := node.Tail(hl.List)
+	for e := hl.List; e != nil; e = e.Next() {
+		if _, ok := e.(*node.VList); ok {
+			return naturalWidth(hl.List)
+		}
+	}
+	for e := hl.List; e != nil; e = e.Next() {
+		stop = e
+		if gl, ok := e.(*node.Glue); ok && gl.StretchOrder > 0 {
+			break
+		}
+	}
+	wd, _, _ := node.Dimensions(hl.List, stop, node.Horizontal)
+	return wd
+}
+
+// widthFromSequence converts a number of grid cells or a length such as
+// "3cm" to scaled points.
+func (xd *xtsDocument) widthFromSequence(seq goxpath.Sequence) (bag.ScaledPoint, error) {
+	str := strings.TrimSpace(seq.Stringvalue())
+	if cells, err := strconv.Atoi(str); err == nil {
+		xd.setupPage()
+		return xd.currentGrid.width(coord(cells)), nil
+	}
+	return bag.SP(str)
+}
+
+// fnTextWidth returns the width of the text on one line as a length such as
+// "52.3pt": sd:text-width(text, css class).
+func fnTextWidth(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
+	class := ""
+	if len(args) > 1 {
+		class = args[1].Stringvalue()
+	}
+	vl, err := xd.typesetText(args[0].Stringvalue(), class, measureWidth)
+	if err != nil {
+		return nil, fmt.Errorf("sd:text-width(): %w", err)
+	}
+	return goxpath.Sequence{fmt.Sprintf("%spt", naturalWidth(vl.List))}, nil
+}
+
+// fnTextHeight returns the height of the text typeset with the given width
+// (number of grid cells or a length) as a length such as "24pt":
+// sd:text-height(text, width, css class).
+func fnTextHeight(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
+	width, err := xd.widthFromSequence(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("sd:text-height(): %w", err)
+	}
+	class := ""
+	if len(args) > 2 {
+		class = args[2].Stringvalue()
+	}
+	vl, err := xd.typesetText(args[0].Stringvalue(), class, width)
+	if err != nil {
+		return nil, fmt.Errorf("sd:text-height(): %w", err)
+	}
+	return goxpath.Sequence{fmt.Sprintf("%spt", vl.Height+vl.Depth)}, nil
+}
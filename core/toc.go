@@ -0,0 +1,177 @@
+package core
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/speedata/goxml"
+	"github.com/speedata/goxpath"
+	"golang.org/x/net/html"
+)
+
+// tocEntry is an entry of the table of contents. The entries are collected
+// during shipout and saved in the aux file, so the table of contents can be
+// typeset in the next run.
+type tocEntry struct {
+	Level int    `xml:"level,attr"`
+	Page  int    `xml:"page,attr"`
+	Dest  string `xml:"dest,attr"`
+	Text  string `xml:",chardata"`
+	order int    // entries on the same page are sorted by creation
+}
+
+// sortTOC sorts the entries by page and order of creation.
+func (xd *xtsDocument) sortTOC() {
+	slices.SortStableFunc(xd.toc, func(a, b tocEntry) int {
+		return cmp.Or(cmp.Compare(a.Page, b.Page), cmp.Compare(a.order, b.order))
+	})
+}
+
+// tocEntries returns the entries of the previous run up to maxlevel (0 =
+// all levels).
+func (xd *xtsDocument) tocEntries(maxlevel int) []tocEntry {
+	xd.tocUsed = true
+	if xd.aux == nil {
+		return nil
+	}
+	var entries []tocEntry
+	for _, e := range xd.aux.TOC {
+		if maxlevel == 0 || e.Level <= maxlevel {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// checkTOC logs a message if the table of contents is used and has changed
+// since the previous run.
+func (xd *xtsDocument) checkTOC() {
+	if !xd.tocUsed {
+		return
+	}
+	var old []tocEntry
+	if xd.aux != nil {
+		old = xd.aux.TOC
+	}
+	equal := slices.EqualFunc(old, xd.toc, func(a, b tocEntry) bool {
+		return a.Level == b.Level && a.Page == b.Page && a.Dest == b.Dest && a.Text == b.Text
+	})
+	if !equal {
+		slog.Warn("The table of contents has changed, another run is necessary (--runs 2)")
+	}
+}
+
+func cmdTOCEntry(xd *xtsDocument, layoutelt *goxml.Element) (goxpath.Sequence, error) {
+	var err error
+	attValues := &struct {
+		Select string `sdxml:"mustexist"`
+		Level  int    `sdxml:"default:1"`
+		Name   string
+	}{}
+	if err = getXMLAttributes(xd, layoutelt, attValues); err != nil {
+		return nil, err
+	}
+	var eval goxpath.Sequence
+	eval, err = evaluateXPath(xd, layoutelt.Namespaces, attValues.Select)
+	if err != nil {
+		return nil, newTypesettingErrorf("TOCEntry", layoutelt.Line, "error parsing select XPath expression %s", err)
+	}
+	xd.tocNumber++
+	name := attValues.Name
+	if name == "" {
+		name = fmt.Sprintf("toc-%d", xd.tocNumber)
+	}
+	entry := tocEntry{
+		Level: attValues.Level,
+		Dest:  name,
+		Text:  eval.Stringvalue(),
+		order: xd.tocNumber,
+	}
+	dest := getNameDest(name)
+	dest.Attributes = node.H{
+		"page": xd.currentPage,
+	}
+	// the page number is known when the page is shipped out
+	dest.ShipoutCallback = func(n node.Node) string {
+		startStop := n.(*node.StartStop)
+		entry.Page = startStop.Attributes["page"].(*page).pagenumber
+		xd.toc = append(xd.toc, entry)
+		return ""
+	}
+	return goxpath.Sequence{dest}, nil
+}
+
+// tocLink returns an HTML link to the destination with the text.
+func tocLink(dest, text string) *html.Node {
+	a := &html.Node{Type: html.ElementNode, Data: "a"}
+	a.Attr = append(a.Attr, html.Attribute{Key: "link", Val: dest})
+	a.AppendChild(&html.Node{Type: html.TextNode, Data: text})
+	return a
+}
+
+func cmdTableOfContents(xd *xtsDocument, layoutelt *goxml.Element) (goxpath.Sequence, error) {
+	var err error
+	attValues := &struct {
+		Class    string
+		Leader   string `sdxml:"default:."`
+		Maxlevel int
+		Indent   bag.ScaledPoint `sdxml:"default:12pt"`
+	}{}
+	if err = getXMLAttributes(xd, layoutelt, attValues); err != nil {
+		return nil, err
+	}
+	var ret goxpath.Sequence
+	for _, e := range xd.tocEntries(attValues.Maxlevel) {
+		p := &html.Node{Type: html.ElementNode, Data: "p"}
+		class := "toc toc" + strconv.Itoa(e.Level)
+		if attValues.Class != "" {
+			class += " " + attValues.Class
+		}
+		p.Attr = append(p.Attr,
+			html.Attribute{Key: "class", Val: class},
+			html.Attribute{Key: "style", Val: fmt.Sprintf("margin-left: %spt", attValues.Indent*bag.ScaledPoint(e.Level-1))},
+		)
+		p.AppendChild(tocLink(e.Dest, e.Text))
+		leader := &html.Node{Type: html.ElementNode, Data: "span"}
+		leader.Attr = append(leader.Attr, html.Attribute{Key: "style", Val: fmt.Sprintf("content: leader(%q)", attValues.Leader)})
+		p.AppendChild(leader)
+		p.AppendChild(tocLink(e.Dest, strconv.Itoa(e.Page)))
+		ret = append(ret, p)
+	}
+	if len(ret) == 0 {
+		slog.Info("TableOfContents: no entries, the table of contents is available in the next run")
+	}
+	return ret, nil
+}
+
+// fnTOCEntries returns the entries of the table of contents from the
+// previous run as entry elements with the attributes level, page and dest:
+// sd:toc-entries(maxlevel).
+func fnTOCEntries(ctx *goxpath.Context, args []goxpath.Sequence) (goxpath.Sequence, error) {
+	xd := ctx.Store["xd"].(*xtsDocument)
+	maxlevel := 0
+	if len(args) > 0 && len(args[0]) > 0 {
+		var err error
+		if maxlevel, err = args[0].IntValue(); err != nil {
+			return nil, fmt.Errorf("sd:toc-entries(): %w", err)
+		}
+	}
+	var seq goxpath.Sequence
+	for _, e := range xd.tocEntries(maxlevel) {
+		elt := goxml.NewElement()
+		elt.ID = goxml.NewID()
+		elt.Name = "entry"
+		elt.SetAttribute(xml.Attr{Name: xml.Name{Local: "level"}, Value: strconv.Itoa(e.Level)})
+		elt.SetAttribute(xml.Attr{Name: xml.Name{Local: "page"}, Value: strconv.Itoa(e.Page)})
+		elt.SetAttribute(xml.Attr{Name: xml.Name{Local: "dest"}, Value: e.Dest})
+		elt.Append(goxml.CharData{ID: goxml.NewID(), Contents: e.Text})
+		seq = append(seq, elt)
+	}
+	return seq, nil
+}
@@ -14,7 +14,6 @@ require (
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/pelletier/go-toml/v2 v2.0.8
 	github.com/speedata/go-lua v0.1.6
-	github.com/speedata/goxlsx v1.0.2
 	github.com/speedata/goxml v1.0.8
 	github.com/speedata/goxpath v1.0.9
 	github.com/speedata/goxslt v0.0.1
@@ -24,6 +23,7 @@ require (
 	golang.org/x/net v0.48.0
 	golang.org/x/sys v0.42.0
 	golang.org/x/text v0.32.0
+	modernc.org/sqlite v1.50.1
 )
 
 require (
@@ -31,9 +31,16 @@ require (
 	github.com/andybalholm/cascadia v1.3.3 // indirect
 	github.com/boxesandglue/gofpdi v1.0.22 // indirect
 	github.com/dlclark/regexp2 v1.4.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/gammazero/deque v0.2.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v1.0.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/speedata/barcode v1.1.1 // indirect
 	github.com/speedata/css v1.0.5 // indirect
 	github.com/speedata/hyphenation v1.0.2 // indirect
+	modernc.org/libc v1.72.3 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.11.0 // indirect
 )
@@ -8,6 +8,7 @@ type Config struct {
 	Libdir     string
 	Xtsversion string
 	Builddir   string
+	Extensions []string // files with the description of extension commands
 }
 
 // SetBasedir sets the root of the speedata xts source files
@@ -2,6 +2,7 @@ package genschema
 
 import (
 	"encoding/xml"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -116,6 +117,43 @@ func readCommandsFile(basedir string) (*commandsXML, error) {
 	return c, err
 }
 
+// addExtensionFile reads a file in the format of commands.xml with additional
+// commands (registered with core.RegisterCommand) and adds them to c. The
+// contents of a define with the name of an existing define is appended to it,
+// so an extension can make its commands available in "Commands", "Objects" or
+// "Textvalues".
+func (c *commandsXML) addExtensionFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	ext := &commandsXML{}
+	if err = xml.Unmarshal(data, ext); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	for _, extcmd := range ext.Commands {
+		for _, cmd := range c.Commands {
+			if cmd.Name == extcmd.Name {
+				return fmt.Errorf("%s: command %s already exists", filename, extcmd.Name)
+			}
+		}
+		c.Commands = append(c.Commands, extcmd)
+	}
+defines:
+	for _, extdef := range ext.Defines {
+		for i, def := range c.Defines {
+			if def.Name == extdef.Name {
+				c.Defines[i].Text = append(def.Text, extdef.Text...)
+				continue defines
+			}
+		}
+		c.Defines = append(c.Defines, extdef)
+	}
+	c.DefineAttrs = append(c.DefineAttrs, ext.DefineAttrs...)
+	c.DefineList = append(c.DefineList, ext.DefineList...)
+	return nil
+}
+
 func (c *choiceXML) GetDescription(lang string) string {
 	for _, v := range c.Description {
 		if v.Lang == lang {
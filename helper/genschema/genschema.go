@@ -27,6 +27,11 @@ func DoThings(cfg *config.Config) error {
 	if err != nil {
 		return err
 	}
+	for _, fn := range cfg.Extensions {
+		if err = c.addExtensionFile(fn); err != nil {
+			return err
+		}
+	}
 	var buf []byte
 	rngSchemaENPath := filepath.Join(basedir, "schema", "layoutschema-en.rng")
 	rngSchemaDEPath := filepath.Join(basedir, "schema", "layoutschema-de.rng")
@@ -21,6 +21,7 @@ func main() {
 	op := optionparser.NewOptionParser()
 	op.Command("genschema", "Generate schema (in language de, en and schema xsd and rng)")
 	op.Command("doc", "Generate xts documentation (standalone)")
+	op.On("--extension FILE", "Add the commands described in FILE to the schema (genschema)", &cfg.Extensions)
 	err := op.Parse()
 	if err != nil {
 		log.Fatal(err)
@@ -1,23 +1,29 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
+	"path/filepath"
 
 	"github.com/mitchellh/mapstructure"
 	lua "github.com/speedata/go-lua"
+	xpath "github.com/speedata/goxpath"
 	"github.com/speedata/xts/core"
 	"github.com/speedata/xts/xts/luacsv"
+	"github.com/speedata/xts/xts/luadb"
 	"github.com/speedata/xts/xts/luahttp"
+	"github.com/speedata/xts/xts/luajson"
+	"github.com/speedata/xts/xts/luaruntime"
 	"github.com/speedata/xts/xts/luaxlsx"
 	"github.com/speedata/xts/xts/luaxml"
 )
 
 var (
-	options map[string]any
-	l       *lua.State
+	options    map[string]any
+	l          *lua.State
+	luaRuntime = luaruntime.New()
 )
 
 func lerr(errormessage string) int {
@@ -47,44 +53,40 @@ func findFile(l *lua.State) int {
 	return 1
 }
 
-func execute(l *lua.State) int {
-	lua.CheckType(l, 1, lua.TypeTable)
-	var cmd string
-	var arguments []string
-
-	length := l.RawLength(1)
-	for i := 1; i <= length; i++ {
-		l.RawGetInt(1, i)
-		s, _ := l.ToString(-1)
-		l.Pop(1)
-		if i == 1 {
-			cmd = s
-		} else {
-			arguments = append(arguments, s)
-		}
-	}
-	command := exec.Command(cmd, arguments...)
-	command.Stdout = os.Stdout
-	command.Stdin = os.Stdin
-	err := command.Run()
-	if err != nil {
-		return lerr(err.Error())
-	}
-	l.PushBoolean(true)
-	return 1
-}
-
 var exports = []lua.RegistryFunction{
 	{Name: "find_file", Function: findFile},
-	{Name: "execute", Function: execute},
+	{Name: "publish", Function: publish},
 }
 
 func runtimeLoader(l *lua.State) int {
 	lua.NewLibrary(l, exports)
+	lua.SetFunctions(l, luaRuntime.Functions(configuration.Safe), 0)
 	fillRuntimeModule(l)
 	return 1
 }
 
+// luaModules returns the modules that the filter and the Lua code in the
+// layout can load with require(). In safe mode the modules with network and
+// database access are not available and csv and xml can't write files.
+func luaModules() map[string]lua.Function {
+	if configuration.Safe {
+		return map[string]lua.Function{
+			"csv":  luacsv.OpenSafe,
+			"xml":  luaxml.OpenSafe,
+			"xlsx": luaxlsx.Open,
+			"json": luajson.Open,
+		}
+	}
+	return map[string]lua.Function{
+		"csv":  luacsv.Open,
+		"xml":  luaxml.Open,
+		"xlsx": luaxlsx.Open,
+		"json": luajson.Open,
+		"http": luahttp.Open,
+		"db":   luadb.Open,
+	}
+}
+
 // set projectdir and variables table
 func fillRuntimeModule(l *lua.State) {
 	// variables sub-table with metatable
@@ -172,8 +174,7 @@ func newIndexVariables(l *lua.State) int {
 	}
 	// 1: tbl, 2: key, 3: value
 	variableName := lua.CheckString(l, 2)
-	value := lua.CheckString(l, 3)
-	configuration.VariablesMap[variableName] = value
+	configuration.VariablesMap[variableName] = core.LuaToSequence(l, 3)
 	return 0
 }
 
@@ -185,7 +186,14 @@ func indexVariables(l *lua.State) int {
 	}
 	// 1: tbl, 2: key
 	variableName := lua.CheckString(l, 2)
-	l.PushString(fmt.Sprintf("%s", configuration.VariablesMap[variableName]))
+	switch t := configuration.VariablesMap[variableName].(type) {
+	case nil:
+		l.PushNil()
+	case xpath.Sequence:
+		core.PushSequence(l, t)
+	default:
+		l.PushString(fmt.Sprint(t))
+	}
 	return 1
 }
 
@@ -209,25 +217,89 @@ func errorLog(l *lua.State) int {
 	return 0
 }
 
-// When runtime.finalizer is set, call that function after
-// the publishing run
-func runFinalizerCallback() {
-	l.Global("runtime")
-	if l.IsNil(-1) {
-		l.Pop(1)
-		return
+// maxFinalizerReruns is the number of times the finalizer can request another
+// publishing run.
+const maxFinalizerReruns = 5
+
+// When runtime.finalizer is set, call that function after the publishing run
+// with a table that describes the result. The finalizer can return "rerun" to
+// request another publishing run or false and an error message to mark the job
+// as failed. runErr is the error of the publishing run, it is returned
+// together with the error of the finalizer. If skipped is true, the filter has
+// skipped the publishing run and the finalizer cannot request another run.
+func runFinalizerCallback(info core.PublishingInfo, runErr error, protocolFilename string, skipped bool) (bool, error) {
+	if l == nil {
+		return false, runErr
 	}
+	l.Global("runtime")
 	if !l.IsTable(-1) {
 		l.Pop(1)
-		return
+		return false, runErr
 	}
 	l.Field(-1, "finalizer")
-	if l.IsFunction(-1) {
-		l.Call(0, 0)
-	} else {
+	l.Remove(-2) // remove runtime table
+	if !l.IsFunction(-1) {
 		l.Pop(1)
+		return false, runErr
+	}
+
+	// the finalizer may read the protocol, which has all entries so far but
+	// no closing </log> yet
+	if enc != nil {
+		enc.Flush()
+	}
+	protocolPath, _ := filepath.Abs(protocolFilename)
+	pushPublishingInfo(l, configuration.Jobname, info, errCount, warnCount, runErr)
+	l.PushString(protocolPath)
+	l.SetField(-2, "protocol")
+	if skipped {
+		l.PushBoolean(true)
+		l.SetField(-2, "skipped")
+	}
+
+	if err := l.ProtectedCall(1, 2, 0); err != nil {
+		return false, errors.Join(runErr, fmt.Errorf("finalizer: %w", err))
+	}
+	defer l.Pop(2)
+	switch l.TypeOf(-2) {
+	case lua.TypeString:
+		if s, _ := l.ToString(-2); s == "rerun" {
+			if skipped {
+				slog.Warn("Finalizer requested another run, but the filter skipped the publishing run")
+				break
+			}
+			return true, runErr
+		}
+	case lua.TypeBoolean:
+		if l.ToBoolean(-2) {
+			break
+		}
+		msg, ok := l.ToString(-1)
+		if !ok {
+			msg = "job marked as failed"
+		}
+		return false, errors.Join(runErr, fmt.Errorf("finalizer: %s", msg))
+	}
+	return false, runErr
+}
+
+// runWithFinalizer calls run and then the finalizer. As long as the finalizer
+// requests another run, run is called again, at most maxFinalizerReruns
+// times.
+func runWithFinalizer(run func() (core.PublishingInfo, error), protocolFilename string) (core.PublishingInfo, error) {
+	for finalizerRuns := 0; ; finalizerRuns++ {
+		info, err := run()
+		rerun, err := runFinalizerCallback(info, err, protocolFilename, false)
+		if !rerun {
+			return info, err
+		}
+		if finalizerRuns == maxFinalizerReruns {
+			slog.Warn(fmt.Sprintf("Finalizer requested more than %d additional runs, stop", maxFinalizerReruns))
+			return info, err
+		}
+		slog.Info("Finalizer requested another run")
+		errCount, warnCount = 0, 0
 	}
-	l.Pop(1) // pop runtime table
 }
 
 // preloadModule registers a module loader in package.preload[name]
@@ -239,26 +311,34 @@ func preloadModule(l *lua.State, name string, loader lua.Function) {
 	l.Pop(2) // pop preload and package
 }
 
-func runLuaScript(filename string) error {
+// runLuaScript runs the Lua filter. It returns false if the filter returns
+// false, which means that the publishing run should be skipped (for example
+// because the filter has started its own runs with runtime.publish()).
+func runLuaScript(filename string) (bool, error) {
 	if l == nil {
 		l = lua.NewState()
 		lua.OpenLibraries(l)
+		if configuration.Safe {
+			core.RestrictLuaLibraries(l)
+		}
 	}
 
 	var err error
 	if err = mapstructure.Decode(configuration, &options); err != nil {
-		return err
+		return false, err
 	}
 
 	preloadModule(l, "runtime", runtimeLoader)
-	preloadModule(l, "csv", luacsv.Open)
-	preloadModule(l, "xml", luaxml.Open)
-	preloadModule(l, "xlsx", luaxlsx.Open)
-	preloadModule(l, "http", luahttp.Open)
+	for name, loader := range luaModules() {
+		preloadModule(l, name, loader)
+	}
 
+	top := l.Top()
 	if err := lua.DoFile(l, filename); err != nil {
-		return err
+		return false, err
 	}
+	publishRun := !(l.Top() > top && l.IsBoolean(top+1) && !l.ToBoolean(top+1))
+	l.SetTop(top)
 
 	decConfig := mapstructure.DecoderConfig{
 		WeaklyTypedInput: true,
@@ -266,11 +346,11 @@ func runLuaScript(filename string) error {
 	}
 	dec, err := mapstructure.NewDecoder(&decConfig)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if err = dec.Decode(options); err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return publishRun, nil
 }
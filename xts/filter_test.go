@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+	"github.com/speedata/xts/core"
+)
+
+// setFinalizer creates a new Lua state with runtime.finalizer set to the
+// function in code.
+func setFinalizer(t *testing.T, code string) {
+	t.Helper()
+	oldL := l
+	t.Cleanup(func() { l = oldL })
+	l = lua.NewState()
+	lua.OpenLibraries(l)
+	if err := lua.DoString(l, "runtime = {} runtime.finalizer = "+code); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinalizerRerunLimit(t *testing.T) {
+	setFinalizer(t, `function(info) return "rerun" end`)
+	runs := 0
+	_, err := runWithFinalizer(func() (core.PublishingInfo, error) {
+		runs++
+		return core.PublishingInfo{}, nil
+	}, "protocol.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + maxFinalizerReruns; runs != want {
+		t.Errorf("got %d runs, want %d", runs, want)
+	}
+}
+
+func TestFinalizerError(t *testing.T) {
+	setFinalizer(t, `function(info) return false, "check failed: " .. info.error end`)
+	runErr := errors.New("run failed")
+	_, err := runWithFinalizer(func() (core.PublishingInfo, error) {
+		return core.PublishingInfo{}, runErr
+	}, "protocol.xml")
+	if !errors.Is(err, runErr) {
+		t.Errorf("got %v, want the error of the run", err)
+	}
+	if want := "run failed\nfinalizer: check failed: run failed"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestFinalizerSkippedRun(t *testing.T) {
+	setFinalizer(t, `function(info) if info.skipped then return "rerun" end return false, "not skipped" end`)
+	rerun, err := runFinalizerCallback(core.PublishingInfo{}, nil, "protocol.xml", true)
+	if rerun || err != nil {
+		t.Errorf("got %t, %v, want false, nil", rerun, err)
+	}
+}
+
+func TestFinalizerProtocol(t *testing.T) {
+	protocol := filepath.ToSlash(filepath.Join(t.TempDir(), "protocol.xml"))
+	oldLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(oldLogger) })
+	if err := setupLog(protocol); err != nil {
+		t.Fatal(err)
+	}
+	defer teardownLog()
+	slog.Warn("before the finalizer")
+	setFinalizer(t, `function(info)
+	  local f = io.open(info.protocol) local s = f:read("a") f:close()
+	  if not s:find("before the finalizer", 1, true) then return false, "entry missing" end
+	  return false, "check failed"
+	end`)
+	runErr := core.TypesettingError{Logged: true, Msg: "run failed"}
+	_, err := runFinalizerCallback(core.PublishingInfo{}, runErr, protocol, false)
+	if err == nil || err.Error() != "run failed\nfinalizer: check failed" {
+		t.Fatalf("got %v", err)
+	}
+	// the error of the run is already logged, only the finalizer error counts
+	errBefore := errCount
+	logError(err)
+	if n := errCount - errBefore; n != 1 {
+		t.Errorf("got %d logged errors, want 1", n)
+	}
+}
+
+func TestSafeModeFilter(t *testing.T) {
+	t.Chdir(t.TempDir())
+	oldL, oldSafe := l, configuration.Safe
+	t.Cleanup(func() { l, configuration.Safe = oldL, oldSafe })
+	l, configuration.Safe = nil, true
+	files := map[string]string{
+		"in.csv":  "a,b\n1,2\n",
+		"mod.lua": "return {}",
+		"x.xsl": `<xsl:stylesheet xmlns:xsl="http://www.w3.org/1999/XSL/Transform" version="3.0">
+<xsl:template name="main"><a/></xsl:template></xsl:stylesheet>`,
+		"filter.lua": `csv = require("csv") xml = require("xml")
+pcall(csv.encode, {{"a"}}, "out.csv")
+pcall(csv.to_xml, "in.csv", {out = "out.xml"})
+pcall(xml.encode_table, {type = "element", name = "a"}, "table.xml")
+pcall(xml.run_xslt, {stylesheet = "x.xsl", initialtemplate = "main", out = "xslt.xml"})
+if pcall(require, "mod") then error("mod.lua loaded") end
+assert(csv.decode("in.csv"))`,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(name, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := runLuaScript("filter.lua"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !slices.Contains([]string{"in.csv", "mod.lua", "x.xsl", "filter.lua"}, e.Name()) {
+			t.Errorf("the filter created %s in safe mode", e.Name())
+		}
+	}
+}
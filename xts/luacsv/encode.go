@@ -0,0 +1,220 @@
+package luacsv
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+
+	lua "github.com/speedata/go-lua"
+	"github.com/speedata/xts/xts/luaxml"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+// cellString returns the value at index as a CSV field.
+func cellString(l *lua.State, index int) (string, error) {
+	switch l.TypeOf(index) {
+	case lua.TypeNil, lua.TypeNone:
+		return "", nil
+	case lua.TypeBoolean:
+		if l.ToBoolean(index) {
+			return "true", nil
+		}
+		return "false", nil
+	case lua.TypeString, lua.TypeNumber:
+		l.PushValue(index) // ToString changes numbers in place
+		s, _ := l.ToString(-1)
+		l.Pop(1)
+		return s, nil
+	}
+	return "", fmt.Errorf("cannot write a value of type %s", lua.TypeNameOf(l, index))
+}
+
+// encode writes a CSV file: csv.encode(rows, filename, options). The rows are
+// arrays of values or tables keyed by the column names in options.header.
+func encode(l *lua.State) int {
+	lua.CheckType(l, 1, lua.TypeTable)
+	filename := lua.CheckString(l, 2)
+	opts, err := readOptions(l, 3)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	var header []string
+	var crlf bool
+	if l.IsTable(3) {
+		l.Field(3, "header")
+		if l.IsTable(-1) {
+			length := l.RawLength(-1)
+			for i := 1; i <= length; i++ {
+				l.RawGetInt(-1, i)
+				s, _ := l.ToString(-1)
+				header = append(header, s)
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+		l.Field(3, "crlf")
+		crlf = l.ToBoolean(-1)
+		l.Pop(1)
+	}
+
+	numRows := l.RawLength(1)
+	// rows with column names and no header: use all names in sorted order
+	if header == nil {
+		names := map[string]bool{}
+		for i := 1; i <= numRows; i++ {
+			l.RawGetInt(1, i)
+			if l.IsTable(-1) && l.RawLength(-1) == 0 {
+				l.PushNil()
+				for l.Next(-2) {
+					if l.TypeOf(-2) == lua.TypeString {
+						name, _ := l.ToString(-2)
+						names[name] = true
+					}
+					l.Pop(1)
+				}
+			}
+			l.Pop(1)
+		}
+		for name := range names {
+			header = append(header, name)
+		}
+		sort.Strings(header)
+	}
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Comma = opts.separator
+	w.UseCRLF = crlf
+	if len(header) > 0 {
+		w.Write(header)
+	}
+	for i := 1; i <= numRows; i++ {
+		l.RawGetInt(1, i)
+		if !l.IsTable(-1) {
+			return lerr(l, fmt.Sprintf("row %d: expected a table", i))
+		}
+		var record []string
+		if length := l.RawLength(-1); length > 0 {
+			for j := 1; j <= length; j++ {
+				l.RawGetInt(-1, j)
+				s, err := cellString(l, -1)
+				if err != nil {
+					return lerr(l, fmt.Sprintf("row %d, column %d: %s", i, j, err.Error()))
+				}
+				record = append(record, s)
+				l.Pop(1)
+			}
+		} else {
+			for _, name := range header {
+				l.Field(-1, name)
+				s, err := cellString(l, -1)
+				if err != nil {
+					return lerr(l, fmt.Sprintf("row %d, column %s: %s", i, name, err.Error()))
+				}
+				record = append(record, s)
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+		w.Write(record)
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return lerr(l, err.Error())
+	}
+	data := b.Bytes()
+	// UTF-8 files are written without byte order mark
+	if enc, _ := getEncoding(opts.charset); enc != xunicode.UTF8BOM {
+		if data, err = enc.NewEncoder().Bytes(data); err != nil {
+			return lerr(l, err.Error())
+		}
+	}
+	if err = os.WriteFile(filename, data, 0o644); err != nil {
+		return lerr(l, err.Error())
+	}
+	l.SetTop(0)
+	l.PushBoolean(true)
+	return 1
+}
+
+// toXML reads a CSV file and writes it as an XML file:
+// csv.to_xml(filename, options). Each record is a row element. In header mode
+// the fields are elements named after the column, otherwise col elements.
+func toXML(l *lua.State) int {
+	filename := lua.CheckString(l, 1)
+	opts, err := readOptions(l, 2)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	out, rootname, rowname := "data.xml", "data", "row"
+	if l.IsTable(2) {
+		for _, f := range []struct {
+			name string
+			val  *string
+		}{{"out", &out}, {"root", &rootname}, {"row", &rowname}} {
+			l.Field(2, f.name)
+			if s, ok := l.ToString(-1); ok {
+				*f.val = s
+			}
+			l.Pop(1)
+		}
+	}
+	records, err := readFile(filename, opts)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	var header []string
+	if opts.header && len(records) > 0 {
+		header = records[0]
+		records = records[1:]
+	}
+	numColumns := len(header)
+	if len(records) > 0 {
+		numColumns = len(records[0])
+	}
+	columns, err := selectColumns(opts, header, numColumns)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = "col"
+		if c < len(header) {
+			names[i] = luaxml.XMLName(header[c])
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	enc := xml.NewEncoder(&b)
+	enc.Indent("", "  ")
+	root := xml.StartElement{Name: xml.Name{Local: rootname}}
+	enc.EncodeToken(root)
+	for _, record := range records {
+		row := xml.StartElement{Name: xml.Name{Local: rowname}}
+		enc.EncodeToken(row)
+		for i, c := range columns {
+			if c >= len(record) {
+				continue
+			}
+			if err = enc.EncodeElement(record[c], xml.StartElement{Name: xml.Name{Local: names[i]}}); err != nil {
+				return lerr(l, err.Error())
+			}
+		}
+		enc.EncodeToken(row.End())
+	}
+	enc.EncodeToken(root.End())
+	if err = enc.Flush(); err != nil {
+		return lerr(l, err.Error())
+	}
+	b.WriteByte('\n')
+	if err = os.WriteFile(out, b.Bytes(), 0o644); err != nil {
+		return lerr(l, err.Error())
+	}
+	l.SetTop(0)
+	l.PushBoolean(true)
+	return 1
+}
@@ -7,9 +7,12 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"strings"
 
 	lua "github.com/speedata/go-lua"
+	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
 )
 
 var reCarriageReturn = regexp.MustCompile(`\r`)
@@ -21,99 +24,228 @@ func lerr(l *lua.State, errormessage string) int {
 	return 2
 }
 
-func decode(l *lua.State) int {
-	if l.Top() < 1 {
-		return lerr(l, "The first argument of decode must be the filename of the CSV.")
-	}
-	filename := lua.CheckString(l, 1)
+// options are the options of decode, encode and to_xml.
+type options struct {
+	charset    string
+	separator  rune
+	comment    rune
+	lazyQuotes bool
+	header     bool
+	// columns are the selected columns, either numbers (1 based) or
+	// column names from the header row.
+	columns []any
+}
 
-	columns := []int{}
-	var charset, separator string
+// readOptions reads the options table at index. Missing fields keep the
+// defaults.
+func readOptions(l *lua.State, index int) (*options, error) {
+	opts := &options{separator: ',', lazyQuotes: true}
+	if !l.IsTable(index) {
+		return opts, nil
+	}
+	l.Field(index, "charset")
+	if l.IsString(-1) {
+		opts.charset, _ = l.ToString(-1)
+	}
+	l.Pop(1)
 
-	if l.Top() > 1 {
-		if l.IsTable(-1) {
-			l.Field(-1, "charset")
-			if l.IsString(-1) {
-				charset, _ = l.ToString(-1)
-			}
-			l.Pop(1)
+	l.Field(index, "separator")
+	if s, ok := l.ToString(-1); ok && s != "" {
+		opts.separator = []rune(s)[0]
+	}
+	l.Pop(1)
 
-			l.Field(-1, "separator")
-			if l.IsString(-1) {
-				separator, _ = l.ToString(-1)
-			}
-			l.Pop(1)
+	l.Field(index, "comment")
+	if s, ok := l.ToString(-1); ok && s != "" {
+		opts.comment = []rune(s)[0]
+	}
+	l.Pop(1)
 
-			l.Field(-1, "columns")
-			if l.IsTable(-1) {
-				length := l.RawLength(-1)
-				for i := 1; i <= length; i++ {
-					l.RawGetInt(-1, i)
-					if n, ok := l.ToNumber(-1); ok {
-						columns = append(columns, int(n))
-					}
-					l.Pop(1)
-				}
+	l.Field(index, "lazyquotes")
+	if l.IsBoolean(-1) {
+		opts.lazyQuotes = l.ToBoolean(-1)
+	}
+	l.Pop(1)
+
+	l.Field(index, "header")
+	opts.header = l.ToBoolean(-1)
+	l.Pop(1)
+
+	l.Field(index, "columns")
+	if l.IsTable(-1) {
+		length := l.RawLength(-1)
+		for i := 1; i <= length; i++ {
+			l.RawGetInt(-1, i)
+			if l.IsNumber(-1) {
+				n, _ := l.ToNumber(-1)
+				opts.columns = append(opts.columns, int(n))
+			} else if s, ok := l.ToString(-1); ok {
+				opts.columns = append(opts.columns, s)
 			}
 			l.Pop(1)
 		}
 	}
+	l.Pop(1)
+	if _, err := getEncoding(opts.charset); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
 
-	var err error
-	var rd io.Reader
+// getEncoding returns the encoding for the charset name. UTF-16 without byte
+// order mark is read as little endian.
+func getEncoding(charset string) (encoding.Encoding, error) {
+	switch strings.ToUpper(charset) {
+	case "", "UTF-8", "UTF8":
+		return unicode.UTF8BOM, nil
+	case "ISO-8859-1", "LATIN1":
+		return charmap.ISO8859_1, nil
+	case "ISO-8859-15", "LATIN9":
+		return charmap.ISO8859_15, nil
+	case "WINDOWS-1252", "CP1252":
+		return charmap.Windows1252, nil
+	case "UTF-16":
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	case "UTF-16LE":
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), nil
+	case "UTF-16BE":
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), nil
+	}
+	return nil, fmt.Errorf("unknown charset %q", charset)
+}
 
-	rd, err = os.Open(filename)
+// readFile reads the CSV file and returns all records.
+func readFile(filename string, opts *options) ([][]string, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return lerr(l, err.Error())
+		return nil, err
 	}
+	defer f.Close()
 
-	switch charset {
-	case "ISO-8859-1":
-		rd = charmap.ISO8859_1.NewDecoder().Reader(rd)
+	enc, err := getEncoding(opts.charset)
+	if err != nil {
+		return nil, err
 	}
-
-	data, err := io.ReadAll(rd)
+	data, err := io.ReadAll(enc.NewDecoder().Reader(f))
 	if err != nil {
-		return lerr(l, err.Error())
+		return nil, err
 	}
 
 	data = reCarriageReturn.ReplaceAll(data, []byte{10})
-	br := bytes.NewReader(data)
-	reader := csv.NewReader(br)
-	if separator != "" {
-		reader.Comma = rune(separator[0])
-	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = opts.separator
+	reader.Comment = opts.comment
+	reader.LazyQuotes = opts.lazyQuotes
+	return reader.ReadAll()
+}
 
-	reader.LazyQuotes = true
+// selectColumns returns the 0 based indexes of the selected columns. Column
+// names are looked up in the header.
+func selectColumns(opts *options, header []string, numColumns int) ([]int, error) {
+	if len(opts.columns) == 0 {
+		columns := make([]int, numColumns)
+		for i := range columns {
+			columns[i] = i
+		}
+		return columns, nil
+	}
+	columns := make([]int, 0, len(opts.columns))
+	for _, c := range opts.columns {
+		switch t := c.(type) {
+		case int:
+			if t < 1 || t > numColumns {
+				return nil, fmt.Errorf("Column %d out of range. Must be between 1 and %d (# of columns)", t, numColumns)
+			}
+			columns = append(columns, t-1)
+		case string:
+			idx := -1
+			for i, name := range header {
+				if name == t {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				return nil, fmt.Errorf("Column %q not found in the header", t)
+			}
+			columns = append(columns, idx)
+		}
+	}
+	return columns, nil
+}
 
-	records, err := reader.ReadAll()
+// decode reads a CSV file. It returns a table of rows, each row is a table of
+// column values. In header mode the first row contains the column names, the
+// rows are tables keyed by column name and the second return value is the
+// list of selected column names.
+func decode(l *lua.State) int {
+	if l.Top() < 1 {
+		return lerr(l, "The first argument of decode must be the filename of the CSV.")
+	}
+	filename := lua.CheckString(l, 1)
+	opts, err := readOptions(l, 2)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	records, err := readFile(filename, opts)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	var header []string
+	if opts.header && len(records) > 0 {
+		header = records[0]
+		records = records[1:]
+	}
+	numColumns := len(header)
+	if len(records) > 0 {
+		numColumns = len(records[0])
+	}
+	columns, err := selectColumns(opts, header, numColumns)
 	if err != nil {
 		return lerr(l, err.Error())
 	}
 
-	l.NewTable() // rows
+	l.CreateTable(len(records), 0) // rows
 	for i, row := range records {
-		if i == 0 && len(columns) == 0 {
-			for z := 1; z <= len(row); z++ {
-				columns = append(columns, z)
-			}
-		}
 		l.NewTable() // col
 		for j, entry := range columns {
-			if entry-1 < 0 || entry > len(row) {
-				return lerr(l, fmt.Sprintf("Column %d out of range. Must be between 1 and %d (# of columns)", entry, len(row)))
+			if entry >= len(row) {
+				return lerr(l, fmt.Sprintf("Column %d out of range. Must be between 1 and %d (# of columns)", entry+1, len(row)))
+			}
+			l.PushString(row[entry])
+			if opts.header && entry < len(header) && header[entry] != "" {
+				l.SetField(-2, header[entry])
+			} else {
+				l.RawSetInt(-2, j+1)
 			}
-			l.PushString(row[entry-1])
-			l.RawSetInt(-2, j+1)
 		}
 		l.RawSetInt(-2, i+1)
 	}
-
-	return 1
+	if !opts.header {
+		return 1
+	}
+	l.CreateTable(len(columns), 0)
+	for j, entry := range columns {
+		if entry < len(header) {
+			l.PushString(header[entry])
+			l.RawSetInt(-2, j+1)
+		}
+	}
+	return 2
 }
 
 // Open starts this lua module
 func Open(l *lua.State) int {
+	lua.NewLibrary(l, []lua.RegistryFunction{
+		{Name: "decode", Function: decode},
+		{Name: "encode", Function: encode},
+		{Name: "to_xml", Function: toXML},
+	})
+	return 1
+}
+
+// OpenSafe starts this lua module without the functions that write files.
+func OpenSafe(l *lua.State) int {
 	lua.NewLibrary(l, []lua.RegistryFunction{
 		{Name: "decode", Function: decode},
 	})
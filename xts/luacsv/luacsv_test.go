@@ -0,0 +1,56 @@
+package luacsv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func runLua(t *testing.T, code string) string {
+	t.Helper()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lua.Require(l, "csv", Open, true)
+	l.Pop(1)
+	if err := lua.DoString(l, code); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := l.ToString(-1)
+	return s
+}
+
+func TestDecode(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"plain.csv":  []byte("\xef\xbb\xbfid;name;price\n# comment\n1;Pen;2.50\n2;\"Ink\";4\n"),
+		"cp1252.csv": []byte("id,name\n1,\x80 5\n"),
+		"utf16.csv":  {0xff, 0xfe, 'a', 0, ',', 0, 'b', 0, '\n', 0},
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := []struct {
+		code string
+		want string
+	}{
+		{`local d, h = csv.decode("plain.csv", {separator = ";", comment = "#", header = true}) return h[1] .. d[2].name .. d[1].price`, "idInk2.50"},
+		{`local d = csv.decode("plain.csv", {separator = ";", comment = "#", header = true, columns = {"price", 2}}) return d[1].price .. d[1].name .. tostring(d[1].id)`, "2.50Pennil"},
+		{`local d = csv.decode("cp1252.csv", {charset = "Windows-1252"}) return d[2][2]`, "€ 5"},
+		{`local d = csv.decode("utf16.csv", {charset = "UTF-16"}) return d[1][1] .. d[1][2]`, "ab"},
+		{`local ok, msg = csv.decode("plain.csv", {charset = "EBCDIC"}) return msg`, `unknown charset "EBCDIC"`},
+		{`csv.encode({{1, "a;b", true}, {2.5}}, "out.csv", {separator = ";", header = {"x", "y", "z"}}) return io.open("out.csv"):read("a")`, "x;y;z\n1;\"a;b\";true\n2.5\n"},
+		{`csv.encode({{b = 1, a = "x"}, {a = "y"}}, "out.csv") return io.open("out.csv"):read("a")`, "a,b\nx,1\ny,\n"},
+		{`csv.to_xml("plain.csv", {separator = ";", comment = "#", header = true, out = "out.xml"}) return io.open("out.xml"):read("a")`,
+			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<data>\n  <row>\n    <id>1</id>\n    <name>Pen</name>\n    <price>2.50</price>\n  </row>\n  <row>\n    <id>2</id>\n    <name>Ink</name>\n    <price>4</price>\n  </row>\n</data>\n"},
+	}
+	t.Chdir(dir)
+	for _, tc := range data {
+		if got := runLua(t, tc.code); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
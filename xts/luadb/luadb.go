@@ -0,0 +1,360 @@
+// Package luadb provides the Lua module db for reading SQLite databases.
+package luadb
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	lua "github.com/speedata/go-lua"
+
+	// register the pure Go SQLite driver
+	_ "modernc.org/sqlite"
+)
+
+const luaDatabaseTypeName = "db.database"
+
+// rowsMetaTable is the name of the metatable for the state of a rows
+// iterator.
+const rowsMetaTable = "db.rows"
+
+func lerr(l *lua.State, errormessage string) int {
+	l.SetTop(0)
+	l.PushBoolean(false)
+	l.PushString(errormessage)
+	return 2
+}
+
+// database is the value behind the userdata returned by db.open().
+type database struct {
+	filename string
+	db       *sql.DB
+}
+
+// OpenDatabase opens the SQLite database file. Unless create is true, the
+// file must exist.
+func OpenDatabase(filename string, create bool) (*sql.DB, error) {
+	if !create {
+		if _, err := os.Stat(filename); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenReadOnly opens the existing SQLite database file for reading. All
+// statements that change the database fail.
+func OpenReadOnly(filename string) (*sql.DB, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	path := (&url.URL{Path: filepath.ToSlash(filename)}).EscapedPath()
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=query_only(1)")
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Query runs the query on the database and returns the column names and the
+// rows. The values are int64, float64, string, bool or nil.
+func Query(db *sql.DB, query string, args ...any) ([]string, [][]any, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	var result [][]any
+	for rows.Next() {
+		values, err := scanRow(rows, len(columns))
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, values)
+	}
+	return columns, result, rows.Err()
+}
+
+// scanRow returns the values of the current row.
+func scanRow(rows *sql.Rows, n int) ([]any, error) {
+	values := make([]any, n)
+	ptrs := make([]any, n)
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		switch t := v.(type) {
+		case []byte:
+			values[i] = string(t)
+		case time.Time:
+			values[i] = t.Format(time.RFC3339)
+		}
+	}
+	return values, nil
+}
+
+func pushValue(l *lua.State, v any) {
+	switch t := v.(type) {
+	case nil:
+		l.PushNil()
+	case int64:
+		l.PushInteger(int(t))
+	case float64:
+		l.PushNumber(t)
+	case bool:
+		l.PushBoolean(t)
+	case string:
+		l.PushString(t)
+	default:
+		l.PushString(fmt.Sprint(t))
+	}
+}
+
+// pushRow pushes a table with the values keyed by column name. NULL values
+// are missing in the table.
+func pushRow(l *lua.State, columns []string, values []any) {
+	l.CreateTable(0, len(columns))
+	for i, col := range columns {
+		pushValue(l, values[i])
+		l.SetField(-2, col)
+	}
+}
+
+// queryArguments reads the query parameters starting at index. The
+// parameters are either given one by one or as a single table: an array for
+// positional parameters (?) or a table with names for named parameters
+// (:name, @name or $name).
+func queryArguments(l *lua.State, index int) []any {
+	var args []any
+	if l.Top() == index && l.IsTable(index) {
+		if length := l.RawLength(index); length > 0 {
+			for i := 1; i <= length; i++ {
+				l.RawGetInt(index, i)
+				args = append(args, toValue(l, -1))
+				l.Pop(1)
+			}
+			return args
+		}
+		l.PushNil()
+		for l.Next(index) {
+			name, _ := l.ToString(-2)
+			args = append(args, sql.Named(name, toValue(l, -1)))
+			l.Pop(1)
+		}
+		return args
+	}
+	for i := index; i <= l.Top(); i++ {
+		args = append(args, toValue(l, i))
+	}
+	return args
+}
+
+func toValue(l *lua.State, index int) any {
+	switch l.TypeOf(index) {
+	case lua.TypeNil, lua.TypeNone:
+		return nil
+	case lua.TypeBoolean:
+		return l.ToBoolean(index)
+	case lua.TypeNumber:
+		if l.IsInteger(index) {
+			i, _ := l.ToInteger(index)
+			return int64(i)
+		}
+		f, _ := l.ToNumber(index)
+		return f
+	}
+	s, _ := l.ToString(index)
+	return s
+}
+
+func checkDatabase(l *lua.State) *database {
+	ud := lua.CheckUserData(l, 1, luaDatabaseTypeName)
+	if v, ok := ud.(*database); ok {
+		if v.db == nil {
+			lua.Errorf(l, "database %s is closed", v.filename)
+		}
+		return v
+	}
+	lua.ArgumentError(l, 1, "database expected")
+	return nil
+}
+
+// dbQuery returns all rows of the query and the list of column names:
+// rows, columns = conn:query(sql, params...).
+func dbQuery(l *lua.State) int {
+	d := checkDatabase(l)
+	query := lua.CheckString(l, 2)
+	rows, err := d.db.Query(query, queryArguments(l, 3)...)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	l.NewTable()
+	i := 1
+	for rows.Next() {
+		values, err := scanRow(rows, len(columns))
+		if err != nil {
+			return lerr(l, err.Error())
+		}
+		pushRow(l, columns, values)
+		l.RawSetInt(-2, i)
+		i++
+	}
+	if err = rows.Err(); err != nil {
+		return lerr(l, err.Error())
+	}
+	l.CreateTable(len(columns), 0)
+	for i, col := range columns {
+		l.PushString(col)
+		l.RawSetInt(-2, i+1)
+	}
+	return 2
+}
+
+// closeRows closes the result set of a rows iterator. The generic for calls
+// it when the loop ends, also on break or error.
+func closeRows(l *lua.State) int {
+	if rows, ok := l.ToUserData(1).(*sql.Rows); ok {
+		rows.Close()
+	}
+	return 0
+}
+
+// dbRows returns an iterator over the rows of the query:
+// for row in conn:rows(sql, params...) do ... end. Errors are raised as Lua
+// errors. The fourth return value is a to-be-closed value that closes the
+// result set when the loop is left early.
+func dbRows(l *lua.State) int {
+	d := checkDatabase(l)
+	query := lua.CheckString(l, 2)
+	rows, err := d.db.Query(query, queryArguments(l, 3)...)
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		lua.Errorf(l, "%s", err.Error())
+	}
+	l.PushGoFunction(func(l *lua.State) int {
+		if !rows.Next() {
+			err := rows.Err()
+			rows.Close()
+			if err != nil {
+				lua.Errorf(l, "%s", err.Error())
+			}
+			l.PushNil()
+			return 1
+		}
+		values, err := scanRow(rows, len(columns))
+		if err != nil {
+			rows.Close()
+			lua.Errorf(l, "%s", err.Error())
+		}
+		pushRow(l, columns, values)
+		return 1
+	})
+	l.PushNil()
+	l.PushNil()
+	if lua.NewMetaTable(l, rowsMetaTable) {
+		l.PushGoFunction(closeRows)
+		l.SetField(-2, "__close")
+	}
+	l.Pop(1)
+	l.PushUserData(rows)
+	lua.SetMetaTableNamed(l, rowsMetaTable)
+	return 4
+}
+
+// dbExec runs a statement that returns no rows and returns the number of
+// affected rows: n = conn:exec(sql, params...).
+func dbExec(l *lua.State) int {
+	d := checkDatabase(l)
+	query := lua.CheckString(l, 2)
+	res, err := d.db.Exec(query, queryArguments(l, 3)...)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	n, _ := res.RowsAffected()
+	l.PushInteger(int(n))
+	return 1
+}
+
+func dbClose(l *lua.State) int {
+	d := checkDatabase(l)
+	err := d.db.Close()
+	d.db = nil
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	l.PushBoolean(true)
+	return 1
+}
+
+// openDB opens a database file: db.open(filename, {create = true}).
+func openDB(l *lua.State) int {
+	if l.Top() < 1 {
+		return lerr(l, "The first argument of open must be the filename of the database.")
+	}
+	filename := lua.CheckString(l, 1)
+	create := false
+	if l.IsTable(2) {
+		l.Field(2, "create")
+		create = l.ToBoolean(-1)
+		l.Pop(1)
+	}
+	db, err := OpenDatabase(filename, create)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+
+	if lua.NewMetaTable(l, luaDatabaseTypeName) {
+		l.NewTable()
+		lua.SetFunctions(l, []lua.RegistryFunction{
+			{Name: "query", Function: dbQuery},
+			{Name: "rows", Function: dbRows},
+			{Name: "exec", Function: dbExec},
+			{Name: "close", Function: dbClose},
+		}, 0)
+		l.SetField(-2, "__index")
+	}
+	l.Pop(1)
+
+	l.PushUserData(&database{filename: filename, db: db})
+	lua.SetMetaTableNamed(l, luaDatabaseTypeName)
+	return 1
+}
+
+// Open sets up the db Lua module.
+func Open(l *lua.State) int {
+	lua.NewLibrary(l, []lua.RegistryFunction{
+		{Name: "open", Function: openDB},
+	})
+	return 1
+}
@@ -0,0 +1,64 @@
+package luadb
+
+import (
+	"path/filepath"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func runLua(t *testing.T, code string) string {
+	t.Helper()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lua.Require(l, "db", Open, true)
+	l.Pop(1)
+	if err := lua.DoString(l, code); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := l.ToString(-1)
+	return s
+}
+
+func TestDB(t *testing.T) {
+	fn := filepath.ToSlash(filepath.Join(t.TempDir(), "products.db"))
+	runLua(t, `local conn = assert(db.open("`+fn+`", {create = true}))
+conn:exec("CREATE TABLE products (id INTEGER, name TEXT, price REAL, note TEXT)")
+conn:exec("INSERT INTO products VALUES (?, ?, ?, ?)", 1, "Pen", 1.5, nil)
+conn:exec("INSERT INTO products VALUES (:id, :name, :price, :note)", {id = 2, name = "Ink", price = 7.25, note = "blue"})
+conn:close()`)
+
+	data := []struct {
+		code string
+		want string
+	}{
+		{`local rows, cols = conn:query("SELECT * FROM products ORDER BY id") return #rows .. table.concat(cols, ",") .. rows[2].name .. math.type(rows[1].id) .. tostring(rows[1].note)`, "2id,name,price,noteInkintegernil"},
+		{`local rows = conn:query("SELECT name FROM products WHERE price > ?", {5}) return rows[1].name`, "Ink"},
+		{`local s = "" for row in conn:rows("SELECT name, price FROM products ORDER BY id") do s = s .. row.name .. row.price .. ";" end return s`, "Pen1.5;Ink7.25;"},
+		{`for row in conn:rows("SELECT name FROM products") do break end return tostring(conn:exec("DELETE FROM products WHERE id = 3"))`, "0"},
+		{`local ok, msg = conn:query("SELECT * FROM missing") return tostring(ok) .. (msg ~= nil and "msg" or "")`, "falsemsg"},
+		{`local ok, msg = db.open("missing.db") return tostring(ok)`, "false"},
+	}
+	for _, tc := range data {
+		code := `local conn = assert(db.open("` + fn + `")) ` + tc.code
+		if got := runLua(t, code); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+
+	db, err := OpenReadOnly(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cols, rows, err := Query(db, "SELECT name, note FROM products WHERE id = ?", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 2 || len(rows) != 1 || rows[0][0] != "Ink" || rows[0][1] != "blue" {
+		t.Errorf("Query: got %v %v", cols, rows)
+	}
+	if _, _, err = Query(db, "DELETE FROM products"); err == nil {
+		t.Error("Query: DELETE on a read-only database got no error")
+	}
+}
@@ -1,11 +1,12 @@
 package luahttp
 
 import (
-	"context"
+	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
-	"time"
 
 	lua "github.com/speedata/go-lua"
 )
@@ -51,121 +52,115 @@ func httpRequest(l *lua.State) int {
 
 func doRequestAndPush(l *lua.State, method string, urlIdx, optIdx int) int {
 	url, _ := l.ToString(urlIdx)
-
-	req, err := http.NewRequest(method, url, nil)
+	rc, err := readRequestConfig(l, method, url, optIdx)
 	if err != nil {
+		l.SetTop(0)
 		l.PushNil()
 		l.PushString(err.Error())
 		return 2
 	}
 
-	// Parse options table if present
-	if l.IsTable(optIdx) {
-		// headers
-		l.Field(optIdx, "headers")
-		if l.IsTable(-1) {
-			l.PushNil()
-			for l.Next(-2) {
-				key, _ := l.ToString(-2)
-				value, _ := l.ToString(-1)
-				req.Header.Set(key, value)
-				l.Pop(1)
-			}
-		}
-		l.Pop(1)
-
-		// cookies
-		l.Field(optIdx, "cookies")
-		if l.IsTable(-1) {
-			l.PushNil()
-			for l.Next(-2) {
-				key, _ := l.ToString(-2)
-				value, _ := l.ToString(-1)
-				req.AddCookie(&http.Cookie{Name: key, Value: value})
-				l.Pop(1)
-			}
-		}
-		l.Pop(1)
-
-		// query
-		l.Field(optIdx, "query")
-		if l.IsString(-1) {
-			q, _ := l.ToString(-1)
-			req.URL.RawQuery = q
-		}
-		l.Pop(1)
-
-		// body
-		l.Field(optIdx, "body")
-		if l.IsString(-1) {
-			body, _ := l.ToString(-1)
-			req.ContentLength = int64(len(body))
-			req.Body = io.NopCloser(strings.NewReader(body))
-		}
-		l.Pop(1)
-
-		// timeout
-		l.Field(optIdx, "timeout")
-		if !l.IsNoneOrNil(-1) {
-			var duration time.Duration
-			if n, ok := l.ToNumber(-1); ok {
-				duration = time.Second * time.Duration(int(n))
-			} else if s, ok := l.ToString(-1); ok {
-				duration, err = time.ParseDuration(s)
-				if err != nil {
-					l.Pop(1)
-					l.PushNil()
-					l.PushString(err.Error())
-					return 2
-				}
-			}
-			if duration > 0 {
-				ctx, cancel := context.WithTimeout(req.Context(), duration)
-				defer cancel()
-				req = req.WithContext(ctx)
-			}
+	var body []byte
+	var bodySize int
+	res, err := rc.do(func(res *http.Response) error {
+		if rc.streamIdx > 0 {
+			var err error
+			bodySize, err = streamBody(l, rc.streamIdx, res.Body)
+			return err
 		}
-		l.Pop(1)
-
-		// auth
-		l.Field(optIdx, "auth")
-		if l.IsTable(-1) {
-			l.Field(-1, "user")
-			l.Field(-2, "pass")
-			if l.IsString(-2) && l.IsString(-1) {
-				user, _ := l.ToString(-2)
-				pass, _ := l.ToString(-1)
-				req.SetBasicAuth(user, pass)
-			} else {
-				l.Pop(3) // pass, user, auth
-				l.PushNil()
-				l.PushString("auth table must contain non-nil user and pass fields")
-				return 2
-			}
-			l.Pop(2) // pass, user
-		}
-		l.Pop(1) // auth
+		var err error
+		body, err = io.ReadAll(res.Body)
+		bodySize = len(body)
+		return err
+	})
+	if err != nil {
+		l.SetTop(0)
+		l.PushNil()
+		l.PushString(err.Error())
+		return 2
 	}
 
-	res, err := client.Do(req)
+	pushHTTPResponse(l, res, string(body), bodySize)
+	return 1
+}
+
+// httpDownload writes the response body of a GET request to a file:
+// http.download(url, filename, options). The file is only created if the
+// server responds with a 2xx status code.
+func httpDownload(l *lua.State) int {
+	url := lua.CheckString(l, 1)
+	filename := lua.CheckString(l, 2)
+	rc, err := readRequestConfig(l, "GET", url, 3)
 	if err != nil {
+		l.SetTop(0)
 		l.PushNil()
 		l.PushString(err.Error())
 		return 2
 	}
-	defer res.Body.Close()
-
-	body, err := io.ReadAll(res.Body)
+	var bodySize int64
+	res, err := rc.do(func(res *http.Response) error {
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("download %s: %s", url, res.Status)
+		}
+		f, err := os.CreateTemp(filepath.Dir(filename), ".download-*")
+		if err != nil {
+			return err
+		}
+		if bodySize, err = io.Copy(f, res.Body); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		if err = f.Close(); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		if err = os.Rename(f.Name(), filename); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		return nil
+	})
 	if err != nil {
+		l.SetTop(0)
 		l.PushNil()
 		l.PushString(err.Error())
 		return 2
 	}
-
-	pushHTTPResponse(l, res, string(body), len(body))
+	pushHTTPResponse(l, res, "", int(bodySize))
 	return 1
 }
 
+// streamBody calls the Lua function at index fnIdx for each chunk of the body.
+// Reading stops if the function returns false.
+func streamBody(l *lua.State, fnIdx int, body io.Reader) (int, error) {
+	buf := make([]byte, 32*1024)
+	total := 0
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			total += n
+			l.PushValue(fnIdx)
+			l.PushString(string(buf[:n]))
+			if err := l.ProtectedCall(1, 1, 0); err != nil {
+				l.Pop(1)
+				return total, err
+			}
+			stop := l.IsBoolean(-1) && !l.ToBoolean(-1)
+			l.Pop(1)
+			if stop {
+				return total, nil
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
 func pushHTTPResponse(l *lua.State, res *http.Response, body string, bodySize int) {
 	if lua.NewMetaTable(l, luaHTTPResponseTypeName) {
 		l.PushGoFunction(httpResponseIndex)
@@ -230,6 +225,7 @@ func Open(l *lua.State) int {
 	lua.NewLibrary(l, []lua.RegistryFunction{
 		{"get", httpGet},
 		{"delete", httpDelete},
+		{"download", httpDownload},
 		{"head", httpHead},
 		{"patch", httpPatch},
 		{"post", httpPost},
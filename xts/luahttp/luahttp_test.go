@@ -0,0 +1,102 @@
+package luahttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func runLua(t *testing.T, code string) string {
+	t.Helper()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lua.Require(l, "http", Open, true)
+	l.Pop(1)
+	if err := lua.DoString(l, code); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := l.ToString(-1)
+	return s
+}
+
+func TestHTTP(t *testing.T) {
+	var flaky, busy, flakyPost atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Query().Get("name"))
+	})
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if flaky.Add(1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	mux.HandleFunc("/busy", func(w http.ResponseWriter, r *http.Request) {
+		if busy.Add(1) < 2 {
+			w.Header().Set("Retry-After", "3600")
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	mux.HandleFunc("/flakypost", func(w http.ResponseWriter, r *http.Request) {
+		if flakyPost.Add(1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, r.Method)
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, fh, err := r.FormFile("pdf")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(f)
+		fmt.Fprintf(w, "%s %s %s %s", r.FormValue("title"), fh.Filename, fh.Header.Get("Content-Type"), data)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "out.pdf"), []byte("%PDF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	data := []struct {
+		code string
+		want string
+	}{
+		{`return http.get(URL .. "/hello", {query = "name=xts"}).body`, "hello xts"},
+		{`return http.get(URL .. "/flaky").status_code`, "503"},
+		{`local r = http.get(URL .. "/flaky", {retries = 3, retry_delay = 0.001}) return r.body`, "ok"},
+		{`local r = http.get(URL .. "/busy", {retries = 1, retry_max_delay = 0.001}) return r.body`, "ok"},
+		{`return http.post(URL .. "/flakypost", {retries = 1, retry_delay = 0.001}).status_code`, "503"},
+		{`local r = http.post(URL .. "/flakypost", {retries = 1, retry_delay = 0.001, retry_all_methods = true}) return r.body`, "POST"},
+		{`local r = http.post(URL .. "/upload", {multipart = {title = "Catalog", pdf = {file = "out.pdf"}}}) return r.body`, "Catalog out.pdf application/pdf %PDF"},
+		{`local r = http.download(URL .. "/hello?name=file", "hello.txt") return r.body_size .. io.open("hello.txt"):read("a")`, "10hello file"},
+		{`local r, msg = http.download(URL .. "/missing", "missing.txt") return tostring(r) .. tostring(io.open("missing.txt"))`, "nilnil"},
+		{`local s = "" local r = http.get(URL .. "/hello", {stream = function(chunk) s = s .. chunk end}) return s .. r.body_size .. r.body`, "hello 6"},
+	}
+	for _, tc := range data {
+		code := strings.ReplaceAll(tc.code, "URL", `"`+srv.URL+`"`)
+		if got := runLua(t, code); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package luahttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// requestConfig holds everything needed to send a request, so it can be sent
+// again for a retry.
+type requestConfig struct {
+	method      string
+	url         string
+	header      http.Header
+	cookies     []*http.Cookie
+	query       *string
+	body        func() (io.Reader, error)
+	bodyLength  int64
+	timeout     time.Duration
+	user, pass  string
+	basicAuth   bool
+	retries     int
+	retryDelay  time.Duration
+	maxDelay    time.Duration
+	retryAll    bool // also retry methods that are not idempotent
+	streamIdx   int  // stack index of the stream function, 0 = none
+	contentType string
+}
+
+// multipartField is one part of a multipart/form-data body. If file is set,
+// the contents of the file are sent.
+type multipartField struct {
+	name        string
+	value       string
+	file        string
+	filename    string
+	contentType string
+}
+
+// parseDuration reads a number of seconds or a duration string such as "5s".
+func parseDuration(l *lua.State, index int) (time.Duration, error) {
+	if l.IsNumber(index) {
+		n, _ := l.ToNumber(index)
+		return time.Duration(n * float64(time.Second)), nil
+	}
+	s, _ := l.ToString(index)
+	return time.ParseDuration(s)
+}
+
+// readRequestConfig reads the options table at optIdx.
+func readRequestConfig(l *lua.State, method, url string, optIdx int) (*requestConfig, error) {
+	rc := &requestConfig{
+		method:     method,
+		url:        url,
+		header:     http.Header{},
+		retryDelay: time.Second,
+		maxDelay:   time.Minute,
+	}
+	if _, err := http.NewRequest(method, url, nil); err != nil {
+		return nil, err
+	}
+	if !l.IsTable(optIdx) {
+		return rc, nil
+	}
+	var err error
+
+	// headers
+	l.Field(optIdx, "headers")
+	if l.IsTable(-1) {
+		l.PushNil()
+		for l.Next(-2) {
+			key, _ := l.ToString(-2)
+			value, _ := l.ToString(-1)
+			rc.header.Set(key, value)
+			l.Pop(1)
+		}
+	}
+	l.Pop(1)
+
+	// cookies
+	l.Field(optIdx, "cookies")
+	if l.IsTable(-1) {
+		l.PushNil()
+		for l.Next(-2) {
+			key, _ := l.ToString(-2)
+			value, _ := l.ToString(-1)
+			rc.cookies = append(rc.cookies, &http.Cookie{Name: key, Value: value})
+			l.Pop(1)
+		}
+	}
+	l.Pop(1)
+
+	// query
+	l.Field(optIdx, "query")
+	if l.IsString(-1) {
+		q, _ := l.ToString(-1)
+		rc.query = &q
+	}
+	l.Pop(1)
+
+	// body
+	l.Field(optIdx, "body")
+	if l.IsString(-1) {
+		body, _ := l.ToString(-1)
+		rc.bodyLength = int64(len(body))
+		rc.body = func() (io.Reader, error) { return strings.NewReader(body), nil }
+	}
+	l.Pop(1)
+
+	// multipart
+	l.Field(optIdx, "multipart")
+	if l.IsTable(-1) {
+		fields, err := readMultipart(l)
+		if err != nil {
+			l.Pop(1)
+			return nil, err
+		}
+		boundary := multipart.NewWriter(io.Discard).Boundary()
+		rc.body = func() (io.Reader, error) { return multipartBody(fields, boundary), nil }
+		rc.bodyLength = -1
+		rc.contentType = "multipart/form-data; boundary=" + boundary
+	}
+	l.Pop(1)
+
+	// timeout
+	l.Field(optIdx, "timeout")
+	if !l.IsNoneOrNil(-1) {
+		if rc.timeout, err = parseDuration(l, -1); err != nil {
+			l.Pop(1)
+			return nil, err
+		}
+	}
+	l.Pop(1)
+
+	// retries
+	l.Field(optIdx, "retries")
+	if n, ok := l.ToInteger(-1); ok {
+		rc.retries = n
+	}
+	l.Pop(1)
+
+	l.Field(optIdx, "retry_delay")
+	if !l.IsNoneOrNil(-1) {
+		if rc.retryDelay, err = parseDuration(l, -1); err != nil {
+			l.Pop(1)
+			return nil, err
+		}
+	}
+	l.Pop(1)
+
+	l.Field(optIdx, "retry_max_delay")
+	if !l.IsNoneOrNil(-1) {
+		if rc.maxDelay, err = parseDuration(l, -1); err != nil {
+			l.Pop(1)
+			return nil, err
+		}
+	}
+	l.Pop(1)
+
+	l.Field(optIdx, "retry_all_methods")
+	rc.retryAll = l.ToBoolean(-1)
+	l.Pop(1)
+
+	// stream
+	l.Field(optIdx, "stream")
+	if l.IsFunction(-1) {
+		rc.streamIdx = l.AbsIndex(-1)
+	} else {
+		l.Pop(1)
+	}
+
+	// auth
+	l.Field(optIdx, "auth")
+	if l.IsTable(-1) {
+		l.Field(-1, "user")
+		l.Field(-2, "pass")
+		if l.IsString(-2) && l.IsString(-1) {
+			rc.user, _ = l.ToString(-2)
+			rc.pass, _ = l.ToString(-1)
+			rc.basicAuth = true
+		} else {
+			l.Pop(3) // pass, user, auth
+			return nil, fmt.Errorf("auth table must contain non-nil user and pass fields")
+		}
+		l.Pop(2) // pass, user
+	}
+	l.Pop(1) // auth
+	return rc, nil
+}
+
+// readMultipart reads the table on top of the stack. Each key is a form field
+// name, the value is either a string or a table with the fields file,
+// filename and content_type. The fields are sorted by name.
+func readMultipart(l *lua.State) ([]multipartField, error) {
+	var fields []multipartField
+	l.PushNil()
+	for l.Next(-2) {
+		name, _ := l.ToString(-2)
+		f := multipartField{name: name}
+		if l.IsTable(-1) {
+			for _, opt := range []struct {
+				key string
+				val *string
+			}{{"file", &f.file}, {"filename", &f.filename}, {"content_type", &f.contentType}, {"value", &f.value}} {
+				l.Field(-1, opt.key)
+				*opt.val, _ = l.ToString(-1)
+				l.Pop(1)
+			}
+			if f.file != "" {
+				if _, err := os.Stat(f.file); err != nil {
+					l.Pop(2)
+					return nil, err
+				}
+				if f.filename == "" {
+					f.filename = filepath.Base(f.file)
+				}
+				if f.contentType == "" {
+					f.contentType = mime.TypeByExtension(filepath.Ext(f.file))
+				}
+				if f.contentType == "" {
+					f.contentType = "application/octet-stream"
+				}
+			}
+		} else {
+			l.PushValue(-1) // ToString changes numbers in place
+			f.value, _ = l.ToString(-1)
+			l.Pop(1)
+		}
+		fields = append(fields, f)
+		l.Pop(1)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields, nil
+}
+
+// multipartBody returns a reader with the multipart body. Files are read
+// while the body is sent.
+func multipartBody(fields []multipartField, boundary string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		mw := multipart.NewWriter(pw)
+		mw.SetBoundary(boundary)
+		var err error
+		for _, f := range fields {
+			if f.file == "" {
+				if err = mw.WriteField(f.name, f.value); err != nil {
+					break
+				}
+				continue
+			}
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, f.name, f.filename))
+			h.Set("Content-Type", f.contentType)
+			var w io.Writer
+			if w, err = mw.CreatePart(h); err != nil {
+				break
+			}
+			var file *os.File
+			if file, err = os.Open(f.file); err != nil {
+				break
+			}
+			_, err = io.Copy(w, file)
+			file.Close()
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// newRequest creates the request for one attempt.
+func (rc *requestConfig) newRequest(ctx context.Context) (*http.Request, error) {
+	var body io.Reader
+	if rc.body != nil {
+		var err error
+		if body, err = rc.body(); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, rc.method, rc.url, body)
+	if err != nil {
+		return nil, err
+	}
+	if rc.body != nil {
+		req.ContentLength = rc.bodyLength
+	}
+	if rc.contentType != "" {
+		req.Header.Set("Content-Type", rc.contentType)
+	}
+	for k, v := range rc.header {
+		req.Header[k] = v
+	}
+	for _, c := range rc.cookies {
+		req.AddCookie(c)
+	}
+	if rc.query != nil {
+		req.URL.RawQuery = *rc.query
+	}
+	if rc.basicAuth {
+		req.SetBasicAuth(rc.user, rc.pass)
+	}
+	return req, nil
+}
+
+// idempotent reports whether sending the request twice has the same effect
+// as sending it once, so it can be retried safely.
+func (rc *requestConfig) idempotent() bool {
+	switch rc.method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// do sends the request and calls handle with the response. Requests that
+// fail or get a 5xx response are repeated up to rc.retries times, requests
+// with a method that is not idempotent only if rc.retryAll is set. The delay
+// between the attempts doubles each time unless the server sends a
+// Retry-After header. It is never longer than rc.maxDelay.
+func (rc *requestConfig) do(handle func(*http.Response) error) (*http.Response, error) {
+	delay := rc.retryDelay
+	retries := rc.retries
+	if !rc.retryAll && !rc.idempotent() {
+		retries = 0
+	}
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if rc.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, rc.timeout)
+		}
+		req, err := rc.newRequest(ctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		res, err := client.Do(req)
+		if (err != nil || res.StatusCode >= 500) && attempt < retries {
+			wait := delay
+			if res != nil {
+				if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && secs >= 0 {
+					wait = rc.maxDelay
+					if time.Duration(secs) < rc.maxDelay/time.Second {
+						wait = time.Duration(secs) * time.Second
+					}
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+			}
+			cancel()
+			time.Sleep(min(wait, rc.maxDelay))
+			delay = min(delay*2, rc.maxDelay)
+			continue
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		err = handle(res)
+		res.Body.Close()
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+}
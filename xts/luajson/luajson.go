@@ -0,0 +1,382 @@
+package luajson
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// nullKey is the name of the registry entry that holds the json.null value.
+const nullKey = "json.null"
+
+func lerr(l *lua.State, errormessage string) int {
+	l.SetTop(0)
+	l.PushBoolean(false)
+	l.PushString(errormessage)
+	return 2
+}
+
+// decodeOptions are the options of json.decode.
+type decodeOptions struct {
+	nullIndex  int  // stack index of the value for JSON null, 0 = json.null
+	bigStrings bool // numbers that don't fit in a Lua number are returned as strings
+}
+
+func decode(l *lua.State) int {
+	str := lua.CheckString(l, 1)
+	opts := decodeOptions{}
+	if l.IsTable(2) {
+		l.Field(2, "null")
+		if l.IsNil(-1) {
+			l.Pop(1)
+		} else {
+			opts.nullIndex = l.Top()
+		}
+		l.Field(2, "bignumbers")
+		if s, ok := l.ToString(-1); ok {
+			switch s {
+			case "string":
+				opts.bigStrings = true
+			case "number":
+			default:
+				return lerr(l, fmt.Sprintf("unknown value for bignumbers: %q (expected \"string\" or \"number\")", s))
+			}
+		}
+		l.Pop(1)
+	}
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return lerr(l, err.Error())
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return lerr(l, "extra data after JSON value")
+	}
+	pushValue(l, v, opts)
+	return 1
+}
+
+func pushValue(l *lua.State, v any, opts decodeOptions) {
+	switch t := v.(type) {
+	case nil:
+		if opts.nullIndex > 0 {
+			l.PushValue(opts.nullIndex)
+		} else {
+			l.Field(lua.RegistryIndex, nullKey)
+		}
+	case bool:
+		l.PushBoolean(t)
+	case string:
+		l.PushString(t)
+	case json.Number:
+		pushNumber(l, t, opts)
+	case []any:
+		l.CreateTable(len(t), 0)
+		for i, itm := range t {
+			pushValue(l, itm, opts)
+			l.RawSetInt(-2, i+1)
+		}
+	case map[string]any:
+		l.CreateTable(0, len(t))
+		for k, itm := range t {
+			pushValue(l, itm, opts)
+			l.SetField(-2, k)
+		}
+	}
+}
+
+// pushNumber pushes an integer if the number is an integer in the range of a
+// Lua integer, otherwise a float. With bignumbers = "string" numbers that lose
+// precision as a float are pushed as strings.
+func pushNumber(l *lua.State, n json.Number, opts decodeOptions) {
+	s := n.String()
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		l.PushInteger(int(i))
+		return
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if opts.bigStrings && (err != nil || significantDigits(s) > 15) {
+		l.PushString(s)
+		return
+	}
+	l.PushNumber(f)
+}
+
+// significantDigits returns the number of significant digits in the JSON
+// number s.
+func significantDigits(s string) int {
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.Replace(strings.TrimPrefix(s, "-"), ".", "", 1)
+	return len(strings.Trim(s, "0"))
+}
+
+// toGo converts the Lua value at the given index to a value for
+// encoding/json. Tables with the keys 1..n are arrays, all other tables are
+// objects.
+func toGo(l *lua.State, index int, depth int) (any, error) {
+	if depth > 100 {
+		return nil, fmt.Errorf("nesting too deep (recursive table?)")
+	}
+	index = l.AbsIndex(index)
+	switch l.TypeOf(index) {
+	case lua.TypeNil:
+		return nil, nil
+	case lua.TypeBoolean:
+		return l.ToBoolean(index), nil
+	case lua.TypeNumber:
+		if l.IsInteger(index) {
+			i, _ := l.ToInteger(index)
+			return i, nil
+		}
+		f, _ := l.ToNumber(index)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("cannot encode %v", f)
+		}
+		return f, nil
+	case lua.TypeString:
+		s, _ := l.ToString(index)
+		return s, nil
+	case lua.TypeTable:
+		if isNull(l, index) {
+			return nil, nil
+		}
+		length := l.RawLength(index)
+		count := 0
+		l.PushNil()
+		for l.Next(index) {
+			count++
+			l.Pop(1)
+		}
+		if length > 0 && length == count {
+			arr := make([]any, length)
+			for i := 1; i <= length; i++ {
+				l.RawGetInt(index, i)
+				v, err := toGo(l, -1, depth+1)
+				l.Pop(1)
+				if err != nil {
+					return nil, err
+				}
+				arr[i-1] = v
+			}
+			return arr, nil
+		}
+		obj := make(map[string]any, count)
+		l.PushNil()
+		for l.Next(index) {
+			var key string
+			switch l.TypeOf(-2) {
+			case lua.TypeString:
+				key, _ = l.ToString(-2)
+			case lua.TypeNumber:
+				// copy the key, ToString would change the key for Next
+				l.PushValue(-2)
+				key, _ = l.ToString(-1)
+				l.Pop(1)
+			default:
+				typename := lua.TypeNameOf(l, -2)
+				l.Pop(2)
+				return nil, fmt.Errorf("cannot encode table key of type %s", typename)
+			}
+			v, err := toGo(l, -1, depth+1)
+			if err != nil {
+				l.Pop(2)
+				return nil, err
+			}
+			obj[key] = v
+			l.Pop(1)
+		}
+		return obj, nil
+	}
+	return nil, fmt.Errorf("cannot encode value of type %s", lua.TypeNameOf(l, index))
+}
+
+// isNull returns true if the value at index is json.null.
+func isNull(l *lua.State, index int) bool {
+	l.Field(lua.RegistryIndex, nullKey)
+	ret := l.RawEqual(index, -1)
+	l.Pop(1)
+	return ret
+}
+
+// encode returns the value as a JSON string. The keys of objects are sorted,
+// so the output is the same for the same input.
+func encode(l *lua.State) int {
+	lua.CheckAny(l, 1)
+	var pretty bool
+	indent := "  "
+	if l.IsTable(2) {
+		l.Field(2, "pretty")
+		pretty = l.ToBoolean(-1)
+		l.Pop(1)
+		l.Field(2, "indent")
+		if s, ok := l.ToString(-1); ok {
+			indent = s
+		}
+		l.Pop(1)
+	}
+	v, err := toGo(l, 1, 0)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if pretty {
+		enc.SetIndent("", indent)
+	}
+	if err = enc.Encode(v); err != nil {
+		return lerr(l, err.Error())
+	}
+	l.PushString(strings.TrimSuffix(b.String(), "\n"))
+	return 1
+}
+
+// toXML converts a decoded JSON structure to the table format of
+// xml.encode_table. Object keys become child elements in sorted order, keys
+// starting with @ become attributes and the elements of an array are repeated
+// elements with the name of the key.
+func toXML(l *lua.State) int {
+	lua.CheckAny(l, 1)
+	rootname := lua.OptString(l, 2, "root")
+	itemname := lua.OptString(l, 3, "item")
+	v, err := toGo(l, 1, 0)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	c := xmlConverter{l: l, itemname: itemname}
+	if _, ok := v.([]any); ok {
+		c.newElement(rootname)
+		c.appendChildren(itemname, v)
+		return 1
+	}
+	c.pushElement(rootname, v)
+	return 1
+}
+
+type xmlConverter struct {
+	l        *lua.State
+	itemname string
+}
+
+func (c xmlConverter) newElement(name string) {
+	c.l.NewTable()
+	c.l.PushString("element")
+	c.l.SetField(-2, "type")
+	c.l.PushString(name)
+	c.l.SetField(-2, "name")
+}
+
+// appendChild appends the value on top of the stack to the element below.
+func (c xmlConverter) appendChild() {
+	n := c.l.RawLength(-2)
+	c.l.RawSetInt(-2, n+1)
+}
+
+// appendChildren appends one element for v to the element on top of the
+// stack or one element for each entry if v is an array.
+func (c xmlConverter) appendChildren(name string, v any) {
+	if arr, ok := v.([]any); ok {
+		for _, itm := range arr {
+			if _, nested := itm.([]any); nested {
+				c.newElement(name)
+				c.appendChildren(c.itemname, itm)
+				c.appendChild()
+				continue
+			}
+			c.pushElement(name, itm)
+			c.appendChild()
+		}
+		return
+	}
+	c.pushElement(name, v)
+	c.appendChild()
+}
+
+// pushElement pushes an element with the given name and the contents v.
+func (c xmlConverter) pushElement(name string, v any) {
+	c.newElement(name)
+	switch t := v.(type) {
+	case nil:
+	case map[string]any:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var hasAttributes bool
+		for _, k := range keys {
+			if attname, ok := strings.CutPrefix(k, "@"); ok {
+				if !hasAttributes {
+					c.l.NewTable()
+					hasAttributes = true
+				}
+				c.l.PushString(scalarString(t[k]))
+				c.l.SetField(-2, attname)
+			}
+		}
+		if hasAttributes {
+			c.l.SetField(-2, "attribs")
+		}
+		for _, k := range keys {
+			if strings.HasPrefix(k, "@") {
+				continue
+			}
+			if k == "#text" {
+				c.l.PushString(scalarString(t[k]))
+				c.appendChild()
+				continue
+			}
+			c.appendChildren(k, t[k])
+		}
+	default:
+		c.l.PushString(scalarString(v))
+		c.appendChild()
+	}
+}
+
+func scalarString(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case string:
+		return t
+	}
+	return fmt.Sprint(v)
+}
+
+// Open starts the json Lua module.
+func Open(l *lua.State) int {
+	lua.NewLibrary(l, []lua.RegistryFunction{
+		{Name: "decode", Function: decode},
+		{Name: "encode", Function: encode},
+		{Name: "to_xml", Function: toXML},
+	})
+	l.Field(lua.RegistryIndex, nullKey)
+	if l.IsNil(-1) {
+		l.Pop(1)
+		l.NewTable()
+		l.NewTable()
+		l.PushGoFunction(func(l *lua.State) int {
+			l.PushString("null")
+			return 1
+		})
+		l.SetField(-2, "__tostring")
+		l.SetMetaTable(-2)
+		l.PushValue(-1)
+		l.SetField(lua.RegistryIndex, nullKey)
+	}
+	l.SetField(-2, "null")
+	return 1
+}
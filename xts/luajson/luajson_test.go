@@ -0,0 +1,54 @@
+package luajson
+
+import (
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func runLua(t *testing.T, code string) string {
+	t.Helper()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lua.Require(l, "json", Open, true)
+	l.Pop(1)
+	if err := lua.DoString(l, code); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := l.ToString(-1)
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := []struct {
+		code string
+		want string
+	}{
+		{`return json.encode(json.decode('{"b":[1,2.5,null],"a":true}'))`, `{"a":true,"b":[1,2.5,null]}`},
+		{`return json.encode({z = 1, a = {x = "<&>"}}, {pretty = true})`, "{\n  \"a\": {\n    \"x\": \"<&>\"\n  },\n  \"z\": 1\n}"},
+		{`local t = json.decode('[null]', {null = false}) return tostring(t[1])`, "false"},
+		{`return json.decode('12345678901234567890123', {bignumbers = "string"})`, "12345678901234567890123"},
+		{`return math.type(json.decode('9007199254740993'))`, "integer"},
+		{`local ok, msg = json.decode('{"a":') return tostring(ok)`, "false"},
+		{`return tostring(json.null)`, "null"},
+	}
+	for _, tc := range data {
+		if got := runLua(t, tc.code); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestToXML(t *testing.T) {
+	code := `
+	local data = json.decode('{"@id":"1","name":"XTS","tags":["a","b"],"price":9.5}')
+	local tbl = json.to_xml(data, "product")
+	local ret = {tbl.name, tbl.attribs.id}
+	for _, cld in ipairs(tbl) do
+		ret[#ret + 1] = cld.name .. "=" .. cld[1]
+	end
+	return table.concat(ret, " ")`
+	if got, want := runLua(t, code), "product 1 name=XTS price=9.5 tags=a tags=b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
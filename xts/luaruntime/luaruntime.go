@@ -0,0 +1,274 @@
+// Package luaruntime contains the file system and process functions of the
+// runtime Lua module.
+package luaruntime
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// Runtime holds the state of the functions, currently the temporary
+// directories that are removed by Cleanup.
+type Runtime struct {
+	// Stdout and Stderr receive the output of execute unless the quiet option
+	// is set. Nil means no output.
+	Stdout   io.Writer
+	Stderr   io.Writer
+	tempdirs []string
+}
+
+// New returns a Runtime that passes the output of external commands to
+// os.Stdout and os.Stderr.
+func New() *Runtime {
+	return &Runtime{Stdout: os.Stdout, Stderr: os.Stderr}
+}
+
+func lerr(l *lua.State, errormessage string) int {
+	l.SetTop(0)
+	l.PushBoolean(false)
+	l.PushString(errormessage)
+	return 2
+}
+
+// Functions returns the functions for the runtime module. In safe mode only
+// the functions without access to the file system, the environment and
+// external programs are returned.
+func (r *Runtime) Functions(safe bool) []lua.RegistryFunction {
+	fns := []lua.RegistryFunction{
+		{Name: "timer", Function: r.timer},
+	}
+	if safe {
+		return fns
+	}
+	return append(fns, []lua.RegistryFunction{
+		{Name: "dir", Function: r.dir},
+		{Name: "execute", Function: r.execute},
+		{Name: "getenv", Function: r.getenv},
+		{Name: "glob", Function: r.glob},
+		{Name: "read_file", Function: r.readFile},
+		{Name: "setenv", Function: r.setenv},
+		{Name: "tempdir", Function: r.tempdir},
+		{Name: "write_file", Function: r.writeFile},
+	}...)
+}
+
+// Cleanup removes the temporary directories created with tempdir().
+func (r *Runtime) Cleanup() error {
+	var err error
+	for _, d := range r.tempdirs {
+		if rmErr := os.RemoveAll(d); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	r.tempdirs = nil
+	return err
+}
+
+// dir returns the entries of a directory, sorted by name. Each entry is a
+// table with the fields name, path, isdir, size and modtime.
+func (r *Runtime) dir(l *lua.State) int {
+	dirname := lua.OptString(l, 1, ".")
+	entries, err := os.ReadDir(dirname)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	l.CreateTable(len(entries), 0)
+	for i, entry := range entries {
+		l.CreateTable(0, 5)
+		l.PushString(entry.Name())
+		l.SetField(-2, "name")
+		l.PushString(filepath.Join(dirname, entry.Name()))
+		l.SetField(-2, "path")
+		l.PushBoolean(entry.IsDir())
+		l.SetField(-2, "isdir")
+		if fi, err := entry.Info(); err == nil {
+			l.PushInteger(int(fi.Size()))
+			l.SetField(-2, "size")
+			l.PushInteger(int(fi.ModTime().Unix()))
+			l.SetField(-2, "modtime")
+		}
+		l.RawSetInt(-2, i+1)
+	}
+	return 1
+}
+
+// glob returns the sorted names of all files matching the pattern.
+func (r *Runtime) glob(l *lua.State) int {
+	pattern := lua.CheckString(l, 1)
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	sort.Strings(matches)
+	l.CreateTable(len(matches), 0)
+	for i, m := range matches {
+		l.PushString(m)
+		l.RawSetInt(-2, i+1)
+	}
+	return 1
+}
+
+func (r *Runtime) readFile(l *lua.State) int {
+	filename := lua.CheckString(l, 1)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	l.PushString(string(data))
+	return 1
+}
+
+// writeFile writes the string to the file. If the third argument is true, the
+// string is appended to the file.
+func (r *Runtime) writeFile(l *lua.State) int {
+	filename := lua.CheckString(l, 1)
+	contents := lua.CheckString(l, 2)
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if l.ToBoolean(3) {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(filename, flag, 0o644)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	if _, err = f.WriteString(contents); err != nil {
+		f.Close()
+		return lerr(l, err.Error())
+	}
+	if err = f.Close(); err != nil {
+		return lerr(l, err.Error())
+	}
+	l.PushBoolean(true)
+	return 1
+}
+
+// getenv returns the value of the environment variable or nil if it is not
+// set.
+func (r *Runtime) getenv(l *lua.State) int {
+	if val, ok := os.LookupEnv(lua.CheckString(l, 1)); ok {
+		l.PushString(val)
+	} else {
+		l.PushNil()
+	}
+	return 1
+}
+
+// setenv sets the environment variable, nil removes it.
+func (r *Runtime) setenv(l *lua.State) int {
+	name := lua.CheckString(l, 1)
+	var err error
+	if l.IsNoneOrNil(2) {
+		err = os.Unsetenv(name)
+	} else {
+		err = os.Setenv(name, lua.CheckString(l, 2))
+	}
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	l.PushBoolean(true)
+	return 1
+}
+
+// tempdir creates a new temporary directory which is removed after the
+// publishing run.
+func (r *Runtime) tempdir(l *lua.State) int {
+	d, err := os.MkdirTemp("", "xts")
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	r.tempdirs = append(r.tempdirs, d)
+	l.PushString(d)
+	return 1
+}
+
+// timer returns a function that returns the number of seconds since the call
+// of timer and a human readable string.
+func (r *Runtime) timer(l *lua.State) int {
+	start := time.Now()
+	l.PushGoFunction(func(l *lua.State) int {
+		dur := time.Since(start)
+		l.PushNumber(dur.Seconds())
+		l.PushString(dur.Round(time.Millisecond).String())
+		return 2
+	})
+	return 1
+}
+
+// execute runs an external program. The first argument is a table with the
+// program name and its arguments, the optional second argument a table with
+// the options dir (working directory), stdin (string) and quiet (don't pass
+// the output to the terminal). execute returns true and a result table
+// (exitcode, stdout, stderr) if the program exits with 0, otherwise false, an
+// error message and the result table. The result table is missing if the
+// program could not be started.
+func (r *Runtime) execute(l *lua.State) int {
+	lua.CheckType(l, 1, lua.TypeTable)
+	var cmdArgs []string
+	length := l.RawLength(1)
+	for i := 1; i <= length; i++ {
+		l.RawGetInt(1, i)
+		s, _ := l.ToString(-1)
+		l.Pop(1)
+		cmdArgs = append(cmdArgs, s)
+	}
+	if len(cmdArgs) == 0 {
+		return lerr(l, "execute: no command given")
+	}
+	command := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	var stdout, stderr bytes.Buffer
+	quiet := false
+	if l.IsTable(2) {
+		l.Field(2, "dir")
+		if s, ok := l.ToString(-1); ok {
+			command.Dir = s
+		}
+		l.Pop(1)
+		l.Field(2, "stdin")
+		if s, ok := l.ToString(-1); ok {
+			command.Stdin = strings.NewReader(s)
+		}
+		l.Pop(1)
+		l.Field(2, "quiet")
+		quiet = l.ToBoolean(-1)
+		l.Pop(1)
+	}
+	if command.Stdin == nil {
+		command.Stdin = os.Stdin
+	}
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	if !quiet && r.Stdout != nil {
+		command.Stdout = io.MultiWriter(&stdout, r.Stdout)
+	}
+	if !quiet && r.Stderr != nil {
+		command.Stderr = io.MultiWriter(&stderr, r.Stderr)
+	}
+	err := command.Run()
+	if command.ProcessState == nil {
+		return lerr(l, err.Error())
+	}
+	l.SetTop(0)
+	if err != nil {
+		l.PushBoolean(false)
+		l.PushString(fmt.Sprintf("%s: %s", cmdArgs[0], err.Error()))
+	} else {
+		l.PushBoolean(true)
+	}
+	l.CreateTable(0, 3)
+	l.PushInteger(command.ProcessState.ExitCode())
+	l.SetField(-2, "exitcode")
+	l.PushString(stdout.String())
+	l.SetField(-2, "stdout")
+	l.PushString(stderr.String())
+	l.SetField(-2, "stderr")
+	return l.Top()
+}
@@ -0,0 +1,88 @@
+package luaruntime
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func newState(r *Runtime, safe bool) *lua.State {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lua.NewLibrary(l, r.Functions(safe))
+	l.SetGlobal("runtime")
+	return l
+}
+
+func runLua(t *testing.T, l *lua.State, code string) string {
+	t.Helper()
+	if err := lua.DoString(l, code); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := l.ToString(-1)
+	return s
+}
+
+func TestFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	r := &Runtime{}
+	l := newState(r, false)
+	code := `
+	assert(runtime.write_file("a.txt", "hello"))
+	assert(runtime.write_file("a.txt", " world", true))
+	assert(runtime.write_file("b.txt", ""))
+	local names = {}
+	for _, e in ipairs(runtime.dir(".")) do names[#names + 1] = e.name .. ":" .. e.size end
+	local globbed = table.concat(runtime.glob("*.txt"), ",")
+	local ok, msg = runtime.read_file("missing.txt")
+	return runtime.read_file("a.txt") .. "|" .. table.concat(names, ",") .. "|" .. globbed .. "|" .. tostring(ok)`
+	if got, want := runLua(t, l, code), "hello world|a.txt:11,b.txt:0|a.txt,b.txt|false"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTempdirAndEnv(t *testing.T) {
+	r := &Runtime{}
+	l := newState(r, false)
+	t.Setenv("XTS_TEST_VAR", "value")
+	dir := runLua(t, l, `local d = runtime.tempdir() assert(runtime.getenv("XTS_TEST_VAR") == "value") assert(runtime.getenv("XTS_TEST_UNSET") == nil) return d`)
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("tempdir %s not removed", dir)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	r := &Runtime{}
+	l := newState(r, false)
+	code := `
+	local ok, res = runtime.execute({"sh", "-c", "cat; echo err >&2"}, {stdin = "in"})
+	local ok2, msg, res2 = runtime.execute({"sh", "-c", "exit 3"})
+	return tostring(ok) .. res.exitcode .. res.stdout .. res.stderr .. tostring(ok2) .. res2.exitcode`
+	if got, want := runLua(t, l, code), "true0inerr\nfalse3"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	dir := t.TempDir()
+	code = `local ok, res = runtime.execute({"pwd"}, {dir = "` + filepath.ToSlash(dir) + `", quiet = true}) return res.stdout`
+	if got := runLua(t, l, code); filepath.Clean(got[:len(got)-1]) != dir {
+		t.Errorf("pwd = %q, want %q", got, dir)
+	}
+}
+
+func TestSafe(t *testing.T) {
+	l := newState(&Runtime{}, true)
+	if got := runLua(t, l, `return tostring(runtime.execute) .. tostring(runtime.read_file) .. type(runtime.timer)`); got != "nilnilfunction" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,597 @@
+package goxlsx
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// builtinNumFmts are the number formats that Excel does not store in the
+// styles.
+var builtinNumFmts = map[int]string{
+	0:  "General",
+	1:  "0",
+	2:  "0.00",
+	3:  "#,##0",
+	4:  "#,##0.00",
+	9:  "0%",
+	10: "0.00%",
+	11: "0.00E+00",
+	12: "# ?/?",
+	13: "# ??/??",
+	14: "mm-dd-yy",
+	15: "d-mmm-yy",
+	16: "d-mmm",
+	17: "mmm-yy",
+	18: "h:mm AM/PM",
+	19: "h:mm:ss AM/PM",
+	20: "h:mm",
+	21: "h:mm:ss",
+	22: "m/d/yy h:mm",
+	37: "#,##0 ;(#,##0)",
+	38: "#,##0 ;[Red](#,##0)",
+	39: "#,##0.00;(#,##0.00)",
+	40: "#,##0.00;[Red](#,##0.00)",
+	45: "mm:ss",
+	46: "[h]:mm:ss",
+	47: "mmss.0",
+	48: "##0.0E+0",
+	49: "@",
+}
+
+type tokenKind int
+
+const (
+	tkLiteral tokenKind = iota
+	tkCode              // a single format character such as 0, #, y or m
+	tkElapsed           // [h], [m] or [s]
+	tkAMPM              // AM/PM or A/P
+)
+
+type fmtToken struct {
+	kind tokenKind
+	text string
+}
+
+// splitSections splits a format code at the semicolons that are not quoted.
+func splitSections(code string) []string {
+	var sections []string
+	start, quoted, escaped := 0, false, false
+	for i, r := range code {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			sections = append(sections, code[start:i])
+			start = i + 1
+		}
+	}
+	return append(sections, code[start:])
+}
+
+// tokenize splits one section of a format code into literals and format
+// characters. Colors, conditions and fill characters are removed.
+func tokenize(section string) []fmtToken {
+	var tokens []fmtToken
+	runes := []rune(section)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch r {
+		case '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != '"' {
+				j++
+			}
+			tokens = append(tokens, fmtToken{tkLiteral, string(runes[i+1 : min(j, len(runes))])})
+			i = j
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+				tokens = append(tokens, fmtToken{tkLiteral, string(runes[i])})
+			}
+		case '_':
+			// space with the width of the next character
+			i++
+			tokens = append(tokens, fmtToken{tkLiteral, " "})
+		case '*':
+			// fill character
+			i++
+		case '[':
+			j := i + 1
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			content := string(runes[i+1 : min(j, len(runes))])
+			i = j
+			lower := strings.ToLower(content)
+			switch {
+			case strings.HasPrefix(content, "$"):
+				// currency and locale: [$€-407]
+				symbol, _, _ := strings.Cut(content[1:], "-")
+				tokens = append(tokens, fmtToken{tkLiteral, symbol})
+			case strings.Trim(lower, "hms") == "" && lower != "":
+				tokens = append(tokens, fmtToken{tkElapsed, lower})
+			}
+		case 'A', 'a':
+			rest := strings.ToUpper(string(runes[i:]))
+			switch {
+			case strings.HasPrefix(rest, "AM/PM"):
+				tokens = append(tokens, fmtToken{tkAMPM, "AM/PM"})
+				i += 4
+			case strings.HasPrefix(rest, "A/P"):
+				tokens = append(tokens, fmtToken{tkAMPM, string(runes[i : i+3])})
+				i += 2
+			default:
+				tokens = append(tokens, fmtToken{tkLiteral, string(r)})
+			}
+		case '0', '#', '?', '.', ',', '%', '@', '/', 'E', 'e', 'y', 'Y', 'm', 'M', 'd', 'D', 'h', 'H', 's', 'S':
+			tokens = append(tokens, fmtToken{tkCode, string(r)})
+		default:
+			tokens = append(tokens, fmtToken{tkLiteral, string(r)})
+		}
+	}
+	return tokens
+}
+
+// IsDateFormat returns true if the number format code formats dates or times.
+func IsDateFormat(code string) bool {
+	if code == "" || strings.EqualFold(code, "General") {
+		return false
+	}
+	for _, tok := range tokenize(splitSections(code)[0]) {
+		switch tok.kind {
+		case tkElapsed, tkAMPM:
+			return true
+		case tkCode:
+			switch strings.ToLower(tok.text) {
+			case "y", "m", "d", "h", "s":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formatGeneral formats the number like the General format of Excel with up to
+// 11 characters.
+func formatGeneral(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e11 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if a := math.Abs(v); a >= 1e11 || a < 1e-9 {
+		return strings.Replace(strconv.FormatFloat(v, 'E', 5, 64), "E+0", "E+", 1)
+	}
+	digits := 10 - int(math.Max(0, math.Floor(math.Log10(math.Abs(v)))))
+	return strconv.FormatFloat(math.Round(v*math.Pow10(digits))/math.Pow10(digits), 'f', -1, 64)
+}
+
+// FormatValue formats a number with an Excel number format code as Excel
+// displays it.
+func FormatValue(v float64, code string, date1904 bool) string {
+	if code == "" || strings.EqualFold(code, "General") {
+		return formatGeneral(v)
+	}
+	sections := splitSections(code)
+	section := sections[0]
+	negative := false
+	switch {
+	case v < 0 && len(sections) > 1 && sections[1] != "":
+		section = sections[1]
+		v = -v
+	case v < 0:
+		negative = true
+		v = -v
+	case v == 0 && len(sections) > 2 && sections[2] != "":
+		section = sections[2]
+	}
+	if strings.EqualFold(strings.TrimSpace(section), "General") {
+		s := formatGeneral(v)
+		if negative {
+			s = "-" + s
+		}
+		return s
+	}
+	tokens := tokenize(section)
+	if IsDateFormat(section) {
+		return formatDate(DateFromSerial(v, date1904), v, tokens)
+	}
+	return formatNumber(v, negative, tokens)
+}
+
+// FormatText formats a string with the text section of the format code.
+func FormatText(s, code string) string {
+	sections := splitSections(code)
+	section := ""
+	switch {
+	case len(sections) > 3:
+		section = sections[3]
+	case len(sections) == 1 && strings.Contains(code, "@"):
+		section = sections[0]
+	default:
+		return s
+	}
+	var sb strings.Builder
+	for _, tok := range tokenize(section) {
+		if tok.kind == tkCode && tok.text == "@" {
+			sb.WriteString(s)
+		} else if tok.kind == tkLiteral {
+			sb.WriteString(tok.text)
+		}
+	}
+	return sb.String()
+}
+
+func isDigitPlaceholder(tok fmtToken) bool {
+	return tok.kind == tkCode && (tok.text == "0" || tok.text == "#" || tok.text == "?")
+}
+
+// formatNumber formats v (>= 0) with the tokens of a number format.
+func formatNumber(v float64, negative bool, tokens []fmtToken) string {
+	first, last := -1, -1
+	for i, tok := range tokens {
+		if isDigitPlaceholder(tok) {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+		if tok.kind == tkCode && tok.text == "%" {
+			v *= 100
+		}
+		if tok.kind == tkCode && tok.text == "/" {
+			// fractions are not supported
+			return formatGeneral(v)
+		}
+	}
+	var prefix, suffix strings.Builder
+	if first < 0 {
+		for _, tok := range tokens {
+			if tok.kind == tkCode && tok.text == "@" {
+				prefix.WriteString(formatGeneral(v))
+			} else if tok.kind == tkLiteral || tok.kind == tkCode && tok.text == "%" {
+				prefix.WriteString(tok.text)
+			}
+		}
+		return prefix.String()
+	}
+
+	// commas directly after the last digit placeholder divide by 1000
+	for i := last + 1; i < len(tokens) && tokens[i].kind == tkCode && tokens[i].text == ","; i++ {
+		v /= 1000
+		tokens[i] = fmtToken{tkLiteral, ""}
+	}
+
+	var intPattern, fracPattern, expPattern []string
+	hasDot, thousands, exponent, expSign := false, false, false, ""
+	for i := first; i <= last; i++ {
+		tok := tokens[i]
+		switch {
+		case tok.kind == tkCode && (tok.text == "E" || tok.text == "e") && !exponent:
+			exponent = true
+			if i+1 <= last && tokens[i+1].kind == tkLiteral && (tokens[i+1].text == "+" || tokens[i+1].text == "-") {
+				expSign = tokens[i+1].text
+				i++
+			}
+		case exponent && isDigitPlaceholder(tok):
+			expPattern = append(expPattern, tok.text)
+		case tok.kind == tkCode && tok.text == ".":
+			hasDot = true
+		case tok.kind == tkCode && tok.text == ",":
+			thousands = !hasDot
+		case isDigitPlaceholder(tok) && hasDot:
+			fracPattern = append(fracPattern, tok.text)
+		case isDigitPlaceholder(tok):
+			intPattern = append(intPattern, tok.text)
+		default:
+			suffix.WriteString(tok.text)
+		}
+	}
+	for _, tok := range tokens[:first] {
+		if tok.kind == tkLiteral || tok.kind == tkCode && tok.text == "%" {
+			prefix.WriteString(tok.text)
+		}
+	}
+	for _, tok := range tokens[last+1:] {
+		if tok.kind == tkLiteral || tok.kind == tkCode && tok.text == "%" {
+			suffix.WriteString(tok.text)
+		}
+	}
+
+	exp := 0
+	if exponent && v != 0 {
+		exp = int(math.Floor(math.Log10(v)))
+		if n := len(intPattern); n > 1 && intPattern[0] == "#" {
+			// engineering notation: the exponent is a multiple of the number
+			// of integer digits
+			exp = int(math.Floor(float64(exp)/float64(n))) * n
+		} else {
+			exp -= max(len(intPattern), 1) - 1
+		}
+		v /= math.Pow10(exp)
+	}
+
+	s := strconv.FormatFloat(v, 'f', len(fracPattern), 64)
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if exponent && strings.HasPrefix(intPart, "10") && len(intPart) > len(intPattern) {
+		// rounding produced another digit
+		v /= 10
+		exp++
+		s = strconv.FormatFloat(v, 'f', len(fracPattern), 64)
+		intPart, fracPart, _ = strings.Cut(s, ".")
+	}
+
+	zeros, spaces := 0, 0
+	for _, p := range intPattern {
+		switch p {
+		case "0":
+			zeros++
+		case "?":
+			spaces++
+		}
+	}
+	if intPart == "0" && zeros == 0 {
+		intPart = ""
+	}
+	for len(intPart) < zeros {
+		intPart = "0" + intPart
+	}
+	if thousands {
+		intPart = groupThousands(intPart)
+	}
+	for len(intPart) < zeros+spaces {
+		intPart = " " + intPart
+	}
+
+	// optional digits (#, ?) after the decimal point
+	for i := len(fracPattern) - 1; i >= 0 && fracPattern[i] != "0" && strings.HasSuffix(fracPart, "0"); i-- {
+		fracPart = fracPart[:len(fracPart)-1]
+		if fracPattern[i] == "?" {
+			fracPart += " "
+		}
+	}
+
+	var sb strings.Builder
+	if negative && strings.Trim(intPart+fracPart, "0 ") != "" {
+		sb.WriteString("-")
+	}
+	sb.WriteString(prefix.String())
+	sb.WriteString(intPart)
+	if hasDot {
+		sb.WriteString(".")
+		sb.WriteString(fracPart)
+	}
+	if exponent {
+		sb.WriteString("E")
+		if exp < 0 {
+			sb.WriteString("-")
+		} else if expSign == "+" {
+			sb.WriteString("+")
+		}
+		e := strconv.Itoa(abs(exp))
+		for len(e) < len(expPattern) {
+			e = "0" + e
+		}
+		sb.WriteString(e)
+	}
+	sb.WriteString(suffix.String())
+	return sb.String()
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+func groupThousands(digits string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+	var sb strings.Builder
+	for i, r := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// DateFromSerial converts an Excel serial date to a time. date1904 is true for
+// workbooks with the 1904 date system.
+func DateFromSerial(v float64, date1904 bool) time.Time {
+	base := time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+	if date1904 {
+		base = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+	} else if v < 61 {
+		// Excel treats 1900 as a leap year, so dates before March 1900 are off
+		// by one.
+		base = base.AddDate(0, 0, 1)
+	}
+	days := math.Floor(v)
+	ms := math.Round((v - days) * 86400 * 1000)
+	return base.AddDate(0, 0, int(days)).Add(time.Duration(ms) * time.Millisecond)
+}
+
+// formatDate formats the time with the tokens of a date format. v is the
+// serial value for elapsed times such as [h].
+func formatDate(t time.Time, v float64, tokens []fmtToken) string {
+	// group runs of the same letter
+	type unit struct {
+		kind tokenKind
+		text string
+	}
+	var units []unit
+	hasAMPM := false
+	hasFraction := false
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.kind == tkAMPM {
+			hasAMPM = true
+		}
+		if tok.kind != tkCode {
+			units = append(units, unit{tok.kind, tok.text})
+			continue
+		}
+		letter := strings.ToLower(tok.text)
+		if letter == "." && i+1 < len(tokens) && tokens[i+1].kind == tkCode && tokens[i+1].text == "0" {
+			// fractional seconds
+			text := "."
+			for i+1 < len(tokens) && tokens[i+1].kind == tkCode && tokens[i+1].text == "0" {
+				text += "0"
+				i++
+			}
+			units = append(units, unit{tkCode, text})
+			hasFraction = true
+			continue
+		}
+		text := letter
+		for i+1 < len(tokens) && tokens[i+1].kind == tkCode && strings.ToLower(tokens[i+1].text) == letter && strings.Contains("ymdhs", letter) {
+			text += letter
+			i++
+		}
+		units = append(units, unit{tkCode, text})
+	}
+	if !hasFraction {
+		t = t.Round(time.Second)
+	}
+
+	// m is the minute if it follows an hour or precedes a second
+	isMinute := make([]bool, len(units))
+	for i, u := range units {
+		if u.kind != tkCode || (u.text != "m" && u.text != "mm") {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			if units[j].kind == tkCode && units[j].text != "" && strings.Contains("ymdhs", units[j].text[:1]) {
+				isMinute[i] = units[j].text[0] == 'h'
+				break
+			}
+			if units[j].kind == tkElapsed {
+				isMinute[i] = units[j].text[0] == 'h'
+				break
+			}
+		}
+		for j := i + 1; j < len(units) && !isMinute[i]; j++ {
+			if units[j].kind == tkCode && units[j].text != "" && strings.Contains("ymdhs", units[j].text[:1]) {
+				isMinute[i] = units[j].text[0] == 's'
+				break
+			}
+			if units[j].kind == tkElapsed {
+				isMinute[i] = units[j].text[0] == 's'
+				break
+			}
+		}
+	}
+
+	pad := func(n int) string {
+		if n < 10 {
+			return "0" + strconv.Itoa(n)
+		}
+		return strconv.Itoa(n)
+	}
+	hour := t.Hour()
+	if hasAMPM {
+		hour %= 12
+		if hour == 0 {
+			hour = 12
+		}
+	}
+	var sb strings.Builder
+	for i, u := range units {
+		switch u.kind {
+		case tkLiteral:
+			sb.WriteString(u.text)
+		case tkAMPM:
+			am := t.Hour() < 12
+			switch u.text {
+			case "AM/PM":
+				if am {
+					sb.WriteString("AM")
+				} else {
+					sb.WriteString("PM")
+				}
+			default:
+				// A/P or a/p
+				if am {
+					sb.WriteString(u.text[:1])
+				} else {
+					sb.WriteString(u.text[2:])
+				}
+			}
+		case tkElapsed:
+			seconds := math.Round(v * 86400)
+			var n float64
+			switch u.text[0] {
+			case 'h':
+				n = math.Floor(seconds / 3600)
+			case 'm':
+				n = math.Floor(seconds / 60)
+			default:
+				n = seconds
+			}
+			s := strconv.Itoa(int(n))
+			for len(s) < len(u.text) {
+				s = "0" + s
+			}
+			sb.WriteString(s)
+		case tkCode:
+			switch {
+			case u.text == "yy":
+				sb.WriteString(pad(t.Year() % 100))
+			case strings.HasPrefix(u.text, "y"):
+				sb.WriteString(strconv.Itoa(t.Year()))
+			case (u.text == "m" || u.text == "mm") && isMinute[i]:
+				if u.text == "m" {
+					sb.WriteString(strconv.Itoa(t.Minute()))
+				} else {
+					sb.WriteString(pad(t.Minute()))
+				}
+			case u.text == "m":
+				sb.WriteString(strconv.Itoa(int(t.Month())))
+			case u.text == "mm":
+				sb.WriteString(pad(int(t.Month())))
+			case u.text == "mmm":
+				sb.WriteString(t.Month().String()[:3])
+			case u.text == "mmmmm":
+				sb.WriteString(t.Month().String()[:1])
+			case strings.HasPrefix(u.text, "m"):
+				sb.WriteString(t.Month().String())
+			case u.text == "d":
+				sb.WriteString(strconv.Itoa(t.Day()))
+			case u.text == "dd":
+				sb.WriteString(pad(t.Day()))
+			case u.text == "ddd":
+				sb.WriteString(t.Weekday().String()[:3])
+			case strings.HasPrefix(u.text, "d"):
+				sb.WriteString(t.Weekday().String())
+			case u.text == "h":
+				sb.WriteString(strconv.Itoa(hour))
+			case strings.HasPrefix(u.text, "h"):
+				sb.WriteString(pad(hour))
+			case u.text == "s":
+				sb.WriteString(strconv.Itoa(t.Second()))
+			case strings.HasPrefix(u.text, "s"):
+				sb.WriteString(pad(t.Second()))
+			case strings.HasPrefix(u.text, "."):
+				frac := strconv.Itoa(t.Nanosecond() / 1000000)
+				for len(frac) < 3 {
+					frac = "0" + frac
+				}
+				sb.WriteString("." + frac[:min(len(u.text)-1, 3)])
+			default:
+				if !unicode.IsLetter(rune(u.text[0])) || u.text == "e" {
+					sb.WriteString(u.text)
+				}
+			}
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,35 @@
+package goxlsx
+
+import "testing"
+
+func TestFormatValue(t *testing.T) {
+	data := []struct {
+		v    float64
+		code string
+		want string
+	}{
+		{1234.5, "General", "1234.5"},
+		{1.0 / 3, "General", "0.3333333333"},
+		{1234.5, "#,##0.00", "1,234.50"},
+		{-1234.5, "#,##0.00", "-1,234.50"},
+		{-1234.5, "#,##0.00;(#,##0.00)", "(1,234.50)"},
+		{0, "0.00;-0.00;\"zero\"", "zero"},
+		{0.256, "0.0%", "25.6%"},
+		{12345, "0.00E+00", "1.23E+04"},
+		{0.5, "#.##", ".5"},
+		{1500000, "#,##0.0,,\" M\"", "1.5 M"},
+		{19.9, "#,##0.00 [$€-407]", "19.90 €"},
+		{19.9, "[$$-409]#,##0.00", "$19.90"},
+		{46023, "dd.mm.yyyy", "01.01.2026"},
+		{46023.75, "yyyy-mm-dd hh:mm", "2026-01-01 18:00"},
+		{46023.75, "h:mm AM/PM", "6:00 PM"},
+		{46023, "d mmmm yyyy, dddd", "1 January 2026, Thursday"},
+		{1.5, "[h]:mm", "36:00"},
+		{0.5, "mm:ss", "00:00"},
+	}
+	for _, tc := range data {
+		if got := FormatValue(tc.v, tc.code, false); got != tc.want {
+			t.Errorf("FormatValue(%v, %q) = %q, want %q", tc.v, tc.code, got, tc.want)
+		}
+	}
+}
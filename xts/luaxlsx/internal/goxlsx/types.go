@@ -0,0 +1,147 @@
+package goxlsx
+
+import (
+	"encoding/xml"
+)
+
+type relationship struct {
+	Type   string
+	Target string
+}
+
+// Worksheet represents a single worksheet in an excel file.
+// A worksheet is a rectangular area of cells, each cell can contain a value.
+type Worksheet struct {
+	Name        string
+	MaxRow      int
+	MaxColumn   int
+	MinRow      int
+	MinColumn   int
+	filename    string
+	id          string
+	rid         string
+	rows        map[int]*row
+	merged      []MergedRange
+	spreadsheet *Spreadsheet
+}
+
+// CellType is the type of a cell value.
+type CellType int
+
+const (
+	// CellEmpty is a cell without a value.
+	CellEmpty CellType = iota
+	// CellNumber is a number. Dates are numbers with a date format.
+	CellNumber
+	// CellString is a shared, inline or formula string.
+	CellString
+	// CellBoolean is 0 or 1.
+	CellBoolean
+	// CellError is an error such as #DIV/0!.
+	CellError
+	// CellDate is a date in ISO 8601 format.
+	CellDate
+)
+
+// MergedRange is a range of merged cells. The value is in the top left cell.
+type MergedRange struct {
+	Ref       string
+	MinColumn int
+	MinRow    int
+	MaxColumn int
+	MaxRow    int
+}
+
+type cell struct {
+	Type  CellType
+	Value string
+	Style int
+}
+
+type row struct {
+	Num   int
+	Cells map[int]*cell
+}
+
+// Spreadsheet represents the whole .xlsx file.
+type Spreadsheet struct {
+	filepath          string
+	worksheets        []*Worksheet
+	sharedStrings     []string
+	uncompressedFiles map[string][]byte
+	relationships     map[string]relationship
+	numFmts           []string // number format code for each cell style
+	date1904          bool
+}
+
+// ------------------------------------------------------------------------
+
+type sheet struct {
+	Name    string `xml:"name,attr"`
+	SheetID string `xml:"sheetId,attr"`
+	Rid     string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+}
+
+type workbook struct {
+	XMLName    xml.Name `xml:"http://schemas.openxmlformats.org/spreadsheetml/2006/main workbook"`
+	WorkbookPr struct {
+		Date1904 string `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []sheet `xml:"sheets>sheet"`
+}
+
+type numFmt struct {
+	ID   int    `xml:"numFmtId,attr"`
+	Code string `xml:"formatCode,attr"`
+}
+
+type xf struct {
+	NumFmtID int `xml:"numFmtId,attr"`
+}
+
+type styleSheet struct {
+	NumFmts []numFmt `xml:"numFmts>numFmt"`
+	CellXfs []xf     `xml:"cellXfs>xf"`
+}
+
+type si struct {
+	T string `xml:"t"`
+}
+type sst struct {
+	XMLName     xml.Name `xml:"http://schemas.openxmlformats.org/spreadsheetml/2006/main sst"`
+	Count       int      `xml:"count,attr"`
+	UniqueCount int      `xml:"uniqueCount,attr"`
+	Si          []si     `xml:"si"`
+}
+
+type xlsxColumn struct {
+	R    string `xml:"r,attr"`
+	T    string `xml:"t,attr"`
+	V    string `xml:"v"`
+	Text string `xml:"is>t"`
+}
+type xlsxRow struct {
+	Rownumber int          `xml:"r,attr"`
+	Cols      []xlsxColumn `xml:"c"`
+}
+
+type xslxDimension struct {
+	Ref string `xml:"ref,attr"`
+}
+
+type xlsxWorksheet struct {
+	XMLName   xml.Name      `xml:"http://schemas.openxmlformats.org/spreadsheetml/2006/main worksheet"`
+	Dimension xslxDimension `xml:"dimension"`
+	Row       []xlsxRow     `xml:"sheetData>row"`
+}
+
+type xslxRelationship struct {
+	ID     string `xml:"Id,attr"`
+	Type   string `xml:"Type,attr"`
+	Target string `xml:"Target,attr"`
+}
+
+type xslxRelationships struct {
+	XMLName      xml.Name `xml:"http://schemas.openxmlformats.org/package/2006/relationships Relationships"`
+	Relationship []xslxRelationship
+}
@@ -0,0 +1,612 @@
+// Package goxlsx accesses Excel 2007 (.xslx) for reading. It is the reader
+// of github.com/speedata/goxlsx v1.0.2 with cell types, number formats and
+// merged cells. Use the upstream package again once these are released
+// there.
+package goxlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ExcelNulltime is signalling if a time field cannot be parsed
+	ExcelNulltime time.Time
+)
+
+func init() {
+	ExcelNulltime = time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+}
+
+// NumWorksheets returns the number of worksheets in a file.
+func (s *Spreadsheet) NumWorksheets() int {
+	return len(s.worksheets)
+}
+
+func readWorkbook(data []byte, s *Spreadsheet) ([]*Worksheet, error) {
+	wb := &workbook{}
+	err := xml.Unmarshal(data, wb)
+	if err != nil {
+		return nil, err
+	}
+
+	s.date1904 = wb.WorkbookPr.Date1904 == "1" || wb.WorkbookPr.Date1904 == "true"
+
+	var worksheets []*Worksheet
+
+	for i := 0; i < len(wb.Sheets); i++ {
+		w := &Worksheet{}
+		w.spreadsheet = s
+		w.Name = wb.Sheets[i].Name
+		w.id = wb.Sheets[i].SheetID
+		w.rid = wb.Sheets[i].Rid
+		worksheets = append(worksheets, w)
+	}
+	return worksheets, nil
+}
+
+func readStrings(data []byte) ([]string, error) {
+	var (
+		err           error
+		token         xml.Token
+		sharedStrings []string
+		buf           []string
+		intext        bool
+		inphonetic    bool
+	)
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err = d.Token()
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+		switch x := token.(type) {
+		case xml.StartElement:
+			// when there is no char data, there must be an empty string for sharedStrings
+			switch x.Name.Local {
+			case "si":
+				buf = []string{}
+			case "t":
+				intext = true
+			case "rPh":
+				// phonetic hints are not part of the text
+				inphonetic = true
+			case "sst":
+				// root element
+				for i := 0; i < len(x.Attr); i++ {
+					if x.Attr[i].Name.Local == "uniqueCount" {
+						count, err := strconv.Atoi(x.Attr[i].Value)
+						if err != nil {
+							return nil, err
+						}
+						sharedStrings = make([]string, 0, count)
+					}
+				}
+			}
+		case xml.CharData:
+			if intext && !inphonetic {
+				buf = append(buf, string(x.Copy()))
+			}
+		case xml.EndElement:
+			switch x.Name.Local {
+			case "t":
+				intext = false
+			case "rPh":
+				inphonetic = false
+			case "si":
+				sharedStrings = append(sharedStrings, strings.Join(buf, ""))
+			}
+		}
+
+	}
+	return sharedStrings, nil
+}
+
+// OpenFile reads a file located at the given path and returns a spreadsheet object.
+func OpenFile(path string) (*Spreadsheet, error) {
+	xlsx := new(Spreadsheet)
+	xlsx.filepath = path
+	xlsx.uncompressedFiles = make(map[string][]byte)
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		buf := make([]byte, f.UncompressedSize64)
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		size, err := io.ReadFull(rc, buf)
+		if err != nil {
+			return nil, err
+		}
+		if size != int(f.UncompressedSize64) {
+			return nil, fmt.Errorf("read (%d) not equal to uncompressed size (%d)", size, f.UncompressedSize64)
+		}
+
+		xlsx.uncompressedFiles[f.Name] = buf
+	}
+	xlsx.relationships, err = readRelationships(xlsx.uncompressedFiles["xl/_rels/workbook.xml.rels"])
+	if err != nil {
+		return nil, err
+	}
+	xlsx.worksheets, err = readWorkbook(xlsx.uncompressedFiles["xl/workbook.xml"], xlsx)
+	if err != nil {
+		return nil, err
+	}
+	xlsx.sharedStrings, err = readStrings(xlsx.uncompressedFiles["xl/sharedStrings.xml"])
+	if err != nil {
+		return nil, err
+	}
+	xlsx.uncompressedFiles["xl/sharedStrings.xml"] = nil
+	xlsx.numFmts, err = readStyles(xlsx.uncompressedFiles["xl/styles.xml"])
+	if err != nil {
+		return nil, err
+	}
+
+	return xlsx, nil
+}
+
+// readStyles returns the number format code of each cell style.
+func readStyles(data []byte) ([]string, error) {
+	if data == nil {
+		return nil, nil
+	}
+	styles := &styleSheet{}
+	if err := xml.Unmarshal(data, styles); err != nil {
+		return nil, err
+	}
+	custom := make(map[int]string)
+	for _, nf := range styles.NumFmts {
+		custom[nf.ID] = nf.Code
+	}
+	numFmts := make([]string, 0, len(styles.CellXfs))
+	for _, xf := range styles.CellXfs {
+		code, ok := custom[xf.NumFmtID]
+		if !ok {
+			code = builtinNumFmts[xf.NumFmtID]
+		}
+		numFmts = append(numFmts, code)
+	}
+	return numFmts, nil
+}
+
+func readRelationships(data []byte) (map[string]relationship, error) {
+	rels := &xslxRelationships{}
+	err := xml.Unmarshal(data, rels)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]relationship)
+	for _, v := range rels.Relationship {
+		ret[v.ID] = relationship{Type: v.Type, Target: v.Target}
+	}
+	return ret, nil
+}
+
+// Position returns the column and the row of a cell reference such as
+// "AC101".
+func Position(ref string) (int, int) {
+	return stringToPosition(ref)
+}
+
+// excelpos is something like "AC101"
+func stringToPosition(excelpos string) (int, int) {
+	var columnnumber, rownumber rune
+	for _, v := range excelpos {
+		if v >= 'A' && v <= 'Z' {
+			columnnumber = columnnumber*26 + v - 'A' + 1
+		}
+		if v >= '0' && v <= '9' {
+			rownumber = rownumber*10 + v - '0'
+		}
+	}
+	return int(columnnumber), int(rownumber)
+}
+
+// Cell returns the contents of cell at column, row, where 1,1 is the top left corner. The return value is always a string.
+// The user is in charge to convert this value to a number, if necessary. Formulae are not returned.
+func (ws *Worksheet) Cell(column, row int) string {
+	xrow := ws.rows[row]
+	if xrow == nil {
+		return ""
+	}
+	if xrow.Cells[column] == nil {
+		return ""
+	}
+	val := xrow.Cells[column].Value
+	return strings.Replace(val, "_x000D_", "", -1)
+}
+
+// Cellf returns the contents of cell at column, row, where 1,1 is the top left corner.
+// The return value is always a float64 and an error code != nil if the cell contents can't be
+// decoded as a float.
+func (ws *Worksheet) Cellf(column, row int) (float64, error) {
+	var tmpstr string
+	xrow := ws.rows[row]
+	if xrow == nil {
+		return 0, errors.New("Not a float")
+	}
+	if xrow.Cells[column] == nil {
+		return 0, errors.New("Not a float")
+	}
+	tmpstr = xrow.Cells[column].Value
+	flt, err := strconv.ParseFloat(tmpstr, 64)
+	return flt, err
+}
+
+// DateFromString return value as time. If the time cannot be parsed, it returns ExcelNullTime.
+func DateFromString(strfloat string) time.Time {
+	if strfloat == "" {
+		return ExcelNulltime
+	}
+	fl, err := strconv.ParseFloat(strfloat, 40)
+	if err != nil {
+		return ExcelNulltime
+	}
+	dur := time.Duration(fl * 60 * 60 * 24)
+	return ExcelNulltime.Add(dur * 1000 * 1000 * 1000)
+}
+
+// Cellt returns value as time. If the time cannot be parsed, it returns ExcelNullTime.
+func (ws *Worksheet) Cellt(column, row int) time.Time {
+	return DateFromString(ws.Cell(column, row))
+}
+
+func (ws *Worksheet) getCell(column, row int) *cell {
+	xrow := ws.rows[row]
+	if xrow == nil {
+		return nil
+	}
+	return xrow.Cells[column]
+}
+
+// CellType returns the type of the cell at column, row. Dates stored as
+// numbers are of type CellNumber, see IsDate.
+func (ws *Worksheet) CellType(column, row int) CellType {
+	if c := ws.getCell(column, row); c != nil {
+		return c.Type
+	}
+	return CellEmpty
+}
+
+// NumberFormat returns the number format code of the cell at column, row
+// such as "#,##0.00" or "dd.mm.yyyy" or an empty string.
+func (ws *Worksheet) NumberFormat(column, row int) string {
+	c := ws.getCell(column, row)
+	if c == nil || ws.spreadsheet == nil {
+		return ""
+	}
+	if c.Style >= 0 && c.Style < len(ws.spreadsheet.numFmts) {
+		return ws.spreadsheet.numFmts[c.Style]
+	}
+	return ""
+}
+
+// IsDate returns true if the cell at column, row is a date: a number with a
+// date or time format or an ISO 8601 date.
+func (ws *Worksheet) IsDate(column, row int) bool {
+	switch ws.CellType(column, row) {
+	case CellDate:
+		return true
+	case CellNumber:
+		return IsDateFormat(ws.NumberFormat(column, row))
+	}
+	return false
+}
+
+// CellDate returns the date of the cell at column, row. Numbers are
+// converted with the date system of the file. The error is not nil if the
+// cell is not a number or a date.
+func (ws *Worksheet) CellDate(column, row int) (time.Time, error) {
+	c := ws.getCell(column, row)
+	if c == nil {
+		return ExcelNulltime, errors.New("Not a date")
+	}
+	switch c.Type {
+	case CellDate:
+		t, err := time.Parse("2006-01-02T15:04:05", c.Value)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", c.Value)
+		}
+		return t, err
+	case CellNumber:
+		flt, err := strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			return ExcelNulltime, err
+		}
+		return DateFromSerial(flt, ws.spreadsheet != nil && ws.spreadsheet.date1904).Round(time.Second), nil
+	}
+	return ExcelNulltime, errors.New("Not a date")
+}
+
+// FormattedCell returns the contents of the cell at column, row formatted
+// with its number format as Excel displays it.
+func (ws *Worksheet) FormattedCell(column, row int) string {
+	c := ws.getCell(column, row)
+	if c == nil {
+		return ""
+	}
+	val := strings.Replace(c.Value, "_x000D_", "", -1)
+	code := ws.NumberFormat(column, row)
+	switch c.Type {
+	case CellNumber:
+		if flt, err := strconv.ParseFloat(val, 64); err == nil {
+			return FormatValue(flt, code, ws.spreadsheet != nil && ws.spreadsheet.date1904)
+		}
+	case CellString:
+		return FormatText(val, code)
+	case CellBoolean:
+		if val == "1" || val == "true" {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return val
+}
+
+// Rows returns the numbers of the rows with values in ascending order.
+func (ws *Worksheet) Rows() []int {
+	rows := make([]int, 0, len(ws.rows))
+	for r, xrow := range ws.rows {
+		if len(xrow.Cells) > 0 {
+			rows = append(rows, r)
+		}
+	}
+	sort.Ints(rows)
+	return rows
+}
+
+// Columns returns the column numbers of the cells with values in the row in
+// ascending order.
+func (ws *Worksheet) Columns(row int) []int {
+	xrow := ws.rows[row]
+	if xrow == nil {
+		return nil
+	}
+	columns := make([]int, 0, len(xrow.Cells))
+	for c := range xrow.Cells {
+		columns = append(columns, c)
+	}
+	sort.Ints(columns)
+	return columns
+}
+
+// MergedRanges returns the ranges of merged cells.
+func (ws *Worksheet) MergedRanges() []MergedRange {
+	return ws.merged
+}
+
+// MergedRange returns the merged range that contains the cell at column, row
+// or nil.
+func (ws *Worksheet) MergedRange(column, row int) *MergedRange {
+	for i, mr := range ws.merged {
+		if column >= mr.MinColumn && column <= mr.MaxColumn && row >= mr.MinRow && row <= mr.MaxRow {
+			return &ws.merged[i]
+		}
+	}
+	return nil
+}
+
+func (s *Spreadsheet) readWorksheet(data []byte) (*Worksheet, error) {
+	r := bytes.NewReader(data)
+	dec := xml.NewDecoder(r)
+	ws := &Worksheet{spreadsheet: s}
+	rows := make(map[int]*row)
+
+	var (
+		err          error
+		token        xml.Token
+		rownum       int
+		currentRow   *row
+		currentCell  *cell
+		celltype     string
+		incell       bool
+		cellnumber   int
+		value        strings.Builder
+		hasDimension bool
+	)
+	for {
+		token, err = dec.Token()
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+		switch x := token.(type) {
+		case xml.StartElement:
+			switch x.Name.Local {
+			case "dimension":
+				for _, a := range x.Attr {
+					if a.Name.Local == "ref" {
+						// example: ref="A1:AC101" or (see #1) "A1" without the second part
+						tmp := strings.Split(a.Value, ":")
+						if len(tmp) == 1 {
+							// no area, just a single cell
+							ws.MinColumn, ws.MinRow = stringToPosition(tmp[0])
+							ws.MaxColumn, ws.MaxRow = ws.MinColumn, ws.MinRow
+						} else {
+							ws.MinColumn, ws.MinRow = stringToPosition(tmp[0])
+							ws.MaxColumn, ws.MaxRow = stringToPosition(tmp[1])
+						}
+						hasDimension = ws.MaxRow > 0
+					}
+				}
+			case "row":
+				// rows and cells without a reference follow the previous one
+				rownum++
+				cellnumber = 0
+				currentRow = &row{}
+				currentRow.Cells = make(map[int]*cell)
+				for _, a := range x.Attr {
+					if a.Name.Local == "r" {
+						rownum, err = strconv.Atoi(a.Value)
+						if err != nil {
+							return nil, err
+						}
+					}
+				}
+				currentRow.Num = rownum
+				rows[rownum] = currentRow
+			case "v", "t":
+				incell = currentCell != nil
+			case "c":
+				cellnumber++
+				currentCell = &cell{}
+				celltype = ""
+				value.Reset()
+				for _, a := range x.Attr {
+					switch a.Name.Local {
+					case "r":
+						cellnumber, _ = stringToPosition(a.Value)
+					case "t":
+						celltype = a.Value
+					case "s":
+						currentCell.Style, _ = strconv.Atoi(a.Value)
+					}
+				}
+			case "mergeCell":
+				for _, a := range x.Attr {
+					if a.Name.Local == "ref" {
+						mr := MergedRange{Ref: a.Value}
+						first, last, ok := strings.Cut(a.Value, ":")
+						if !ok {
+							last = first
+						}
+						mr.MinColumn, mr.MinRow = stringToPosition(first)
+						mr.MaxColumn, mr.MaxRow = stringToPosition(last)
+						ws.merged = append(ws.merged, mr)
+					}
+				}
+			}
+		case xml.EndElement:
+			switch x.Name.Local {
+			case "v", "t":
+				incell = false
+			case "c":
+				if s.setCell(currentCell, celltype, value.String()) && currentRow != nil {
+					currentRow.Cells[cellnumber] = currentCell
+				}
+				currentCell = nil
+			}
+		case xml.CharData:
+			if incell {
+				value.Write(x)
+			}
+		}
+	}
+	ws.rows = rows
+	if !hasDimension {
+		ws.computeDimension()
+	}
+	return ws, nil
+}
+
+// setCell sets the type and the value of the cell from the cell type
+// attribute t and the contents. It returns false if the cell has no value.
+func (s *Spreadsheet) setCell(c *cell, t, value string) bool {
+	if c == nil {
+		return false
+	}
+	switch t {
+	case "s":
+		idx, err := strconv.Atoi(value)
+		if err != nil || idx < 0 || idx >= len(s.sharedStrings) {
+			return false
+		}
+		c.Type, c.Value = CellString, s.sharedStrings[idx]
+	case "str", "inlineStr":
+		c.Type, c.Value = CellString, value
+	case "b":
+		c.Type, c.Value = CellBoolean, value
+	case "e":
+		c.Type, c.Value = CellError, value
+	case "d":
+		c.Type, c.Value = CellDate, value
+	default:
+		if value == "" {
+			return false
+		}
+		c.Type, c.Value = CellNumber, value
+	}
+	return true
+}
+
+// computeDimension sets the minimum and maximum row and column for
+// worksheets without a dimension element.
+func (ws *Worksheet) computeDimension() {
+	first := true
+	for r, row := range ws.rows {
+		for c := range row.Cells {
+			if first {
+				ws.MinRow, ws.MaxRow, ws.MinColumn, ws.MaxColumn = r, r, c, c
+				first = false
+				continue
+			}
+			ws.MinRow, ws.MaxRow = min(ws.MinRow, r), max(ws.MaxRow, r)
+			ws.MinColumn, ws.MaxColumn = min(ws.MinColumn, c), max(ws.MaxColumn, c)
+		}
+	}
+}
+
+// GetWorksheet returns the worksheet with the given number, starting at 0.
+func (s *Spreadsheet) GetWorksheet(number int) (*Worksheet, error) {
+	if number >= len(s.worksheets) || number < 0 {
+		return nil, errors.New("index out of range")
+	}
+	rid := s.worksheets[number].rid
+	filename := s.relationships[rid].Target
+	if strings.HasPrefix(filename, "/") {
+		filename = strings.TrimPrefix(filename, "/")
+	} else {
+		filename = "xl/" + filename
+	}
+	ws, err := s.readWorksheet(s.uncompressedFiles[filename])
+	if err != nil {
+		return nil, err
+	}
+	ws.filename = filename
+	ws.Name = s.worksheets[number].Name
+	return ws, nil
+}
+
+// GetWorksheetByName returns the worksheet with the given name.
+func (s *Spreadsheet) GetWorksheetByName(name string) (*Worksheet, error) {
+	for i, w := range s.worksheets {
+		if w.Name == name {
+			return s.GetWorksheet(i)
+		}
+	}
+	return nil, fmt.Errorf("worksheet %q not found", name)
+}
+
+// WorksheetNames returns the names of the worksheets in the file.
+func (s *Spreadsheet) WorksheetNames() []string {
+	names := make([]string, len(s.worksheets))
+	for i, w := range s.worksheets {
+		names[i] = w.Name
+	}
+	return names
+}
+
+// Date1904 returns true if the dates in the file use the 1904 date system.
+func (s *Spreadsheet) Date1904() bool {
+	return s.date1904
+}
@@ -1,8 +1,12 @@
 package luaxlsx
 
 import (
+	"math"
+	"slices"
+	"time"
+
 	lua "github.com/speedata/go-lua"
-	"github.com/speedata/goxlsx"
+	"github.com/speedata/xts/xts/luaxlsx/internal/goxlsx"
 )
 
 const luaSpreadsheetTypeName = "spreadsheet"
@@ -17,10 +21,22 @@ func lerr(l *lua.State, errormessage string) int {
 
 // ----------------------- spreadsheet
 
+// indexSpreadSheet returns the worksheet with the given number (1 based) or
+// name. Unknown names return nil.
 func indexSpreadSheet(l *lua.State) int {
 	sh := checkSpreadsheet(l)
-	n, _ := l.ToInteger(-1)
-	ws, err := sh.GetWorksheet(n - 1)
+	var idx int
+	if l.TypeOf(2) == lua.TypeString {
+		name, _ := l.ToString(2)
+		if idx = slices.Index(sh.WorksheetNames(), name); idx < 0 {
+			l.PushNil()
+			return 1
+		}
+	} else {
+		n, _ := l.ToInteger(2)
+		idx = n - 1
+	}
+	ws, err := sh.GetWorksheet(idx)
 	if err != nil {
 		lua.Errorf(l, "%s", err.Error())
 	}
@@ -31,6 +47,7 @@ func indexSpreadSheet(l *lua.State) int {
 		l.PushGoFunction(indexWorksheet)
 		l.SetField(-2, "__index")
 	}
+	l.Pop(1)
 
 	l.PushUserData(ws)
 	lua.SetMetaTableNamed(l, luaWorksheetTypeName)
@@ -70,35 +87,177 @@ func indexWorksheet(l *lua.State) int {
 	switch arg {
 	case "minrow":
 		l.PushInteger(ws.MinRow)
-		return 1
 	case "maxrow":
 		l.PushInteger(ws.MaxRow)
-		return 1
 	case "mincol":
 		l.PushInteger(ws.MinColumn)
-		return 1
 	case "maxcol":
 		l.PushInteger(ws.MaxColumn)
-		return 1
 	case "name":
 		l.PushString(ws.Name)
-		return 1
+	case "merged":
+		merged := ws.MergedRanges()
+		l.CreateTable(len(merged), 0)
+		for i, mr := range merged {
+			pushMergeRange(l, mr)
+			l.RawSetInt(-2, i+1)
+		}
+	case "value":
+		l.PushGoFunction(worksheetValue)
+	case "formatted":
+		l.PushGoFunction(worksheetFormatted)
+	case "merge":
+		l.PushGoFunction(worksheetMerge)
+	case "rows":
+		l.PushGoFunction(worksheetRows)
+	default:
+		return 0
+	}
+	return 1
+}
+
+// cellArguments returns column and row of a cell given as (column, row) or
+// as a reference such as "B3" at index.
+func cellArguments(l *lua.State, index int) (int, int) {
+	if l.TypeOf(index) == lua.TypeString {
+		ref, _ := l.ToString(index)
+		return goxlsx.Position(ref)
 	}
-	return 0
+	x, _ := l.ToInteger(index)
+	y, _ := l.ToInteger(index + 1)
+	return x, y
 }
 
+// callWorksheet returns the contents of the cell as a string: ws(column, row).
 func callWorksheet(l *lua.State) int {
 	ws := checkWorksheet(l)
-	y, _ := l.ToInteger(-1)
-	x, _ := l.ToInteger(-2)
-	str := ws.Cell(x, y)
-	l.PushString(str)
+	x, y := cellArguments(l, 2)
+	l.PushString(ws.Cell(x, y))
 	return 1
 }
 
-func stringToDate(l *lua.State) int {
-	n := lua.CheckString(l, 1)
-	t := goxlsx.DateFromString(n)
+// worksheetValue returns the typed value of the cell and its type:
+// ws:value(column, row) or ws:value("B3").
+func worksheetValue(l *lua.State) int {
+	ws := checkWorksheet(l)
+	x, y := cellArguments(l, 2)
+	l.PushString(pushCellValue(l, ws, x, y))
+	return 2
+}
+
+// worksheetFormatted returns the cell value as Excel displays it:
+// ws:formatted(column, row) or ws:formatted("B3").
+func worksheetFormatted(l *lua.State) int {
+	ws := checkWorksheet(l)
+	x, y := cellArguments(l, 2)
+	l.PushString(ws.FormattedCell(x, y))
+	return 1
+}
+
+// worksheetMerge returns the merged range that contains the cell or nil.
+func worksheetMerge(l *lua.State) int {
+	ws := checkWorksheet(l)
+	x, y := cellArguments(l, 2)
+	if mr := ws.MergedRange(x, y); mr != nil {
+		pushMergeRange(l, *mr)
+	} else {
+		l.PushNil()
+	}
+	return 1
+}
+
+// worksheetRows returns an iterator over the rows with values:
+// for rownumber, cells in ws:rows() do ... end. cells is a table with the
+// typed values (or the formatted values if the option formatted is true)
+// keyed by column number.
+func worksheetRows(l *lua.State) int {
+	ws := checkWorksheet(l)
+	formatted := false
+	if l.IsTable(2) {
+		l.Field(2, "formatted")
+		formatted = l.ToBoolean(-1)
+		l.Pop(1)
+	}
+	rows := ws.Rows()
+	i := 0
+	l.PushGoFunction(func(l *lua.State) int {
+		if i >= len(rows) {
+			l.PushNil()
+			return 1
+		}
+		rownum := rows[i]
+		i++
+		columns := ws.Columns(rownum)
+		l.PushInteger(rownum)
+		l.CreateTable(0, len(columns))
+		for _, col := range columns {
+			if formatted {
+				l.PushString(ws.FormattedCell(col, rownum))
+			} else {
+				pushCellValue(l, ws, col, rownum)
+			}
+			l.RawSetInt(-2, col)
+		}
+		return 2
+	})
+	return 1
+}
+
+func pushMergeRange(l *lua.State, mr goxlsx.MergedRange) {
+	l.CreateTable(0, 5)
+	l.PushString(mr.Ref)
+	l.SetField(-2, "ref")
+	l.PushInteger(mr.MinColumn)
+	l.SetField(-2, "mincol")
+	l.PushInteger(mr.MinRow)
+	l.SetField(-2, "minrow")
+	l.PushInteger(mr.MaxColumn)
+	l.SetField(-2, "maxcol")
+	l.PushInteger(mr.MaxRow)
+	l.SetField(-2, "maxrow")
+}
+
+// pushCellValue pushes the value of the cell and returns the name of its
+// type: number, string, boolean, date, error or empty. Numbers with a date
+// format are dates.
+func pushCellValue(l *lua.State, ws *goxlsx.Worksheet, x, y int) string {
+	value := ws.Cell(x, y)
+	switch ws.CellType(x, y) {
+	case goxlsx.CellEmpty:
+		l.PushNil()
+		return "empty"
+	case goxlsx.CellString:
+		l.PushString(value)
+		return "string"
+	case goxlsx.CellBoolean:
+		l.PushBoolean(value == "1" || value == "true")
+		return "boolean"
+	case goxlsx.CellError:
+		l.PushString(value)
+		return "error"
+	}
+	if ws.IsDate(x, y) {
+		if t, err := ws.CellDate(x, y); err == nil {
+			pushCellDate(l, t)
+			return "date"
+		}
+	}
+	f, err := ws.Cellf(x, y)
+	if err != nil {
+		l.PushString(value)
+		return "string"
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		l.PushInteger(int(f))
+	} else {
+		l.PushNumber(f)
+	}
+	return "number"
+}
+
+// pushDate pushes a table with the fields year, month, day, hour, minute and
+// second.
+func pushDate(l *lua.State, t time.Time) {
 	l.NewTable()
 	l.PushInteger(t.Day())
 	l.SetField(-2, "day")
@@ -112,6 +271,23 @@ func stringToDate(l *lua.State) int {
 	l.SetField(-2, "minute")
 	l.PushInteger(t.Second())
 	l.SetField(-2, "second")
+}
+
+// pushCellDate pushes the date table of pushDate with the additional field iso
+// (the date in ISO 8601 format).
+func pushCellDate(l *lua.State, t time.Time) {
+	pushDate(l, t)
+	iso := t.Format("2006-01-02")
+	if t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0 {
+		iso = t.Format("2006-01-02T15:04:05")
+	}
+	l.PushString(iso)
+	l.SetField(-2, "iso")
+}
+
+func stringToDate(l *lua.State) int {
+	n := lua.CheckString(l, 1)
+	pushDate(l, goxlsx.DateFromString(n))
 	return 1
 }
 
@@ -132,6 +308,7 @@ func openfile(l *lua.State) int {
 		l.PushGoFunction(lenSpreadSheet)
 		l.SetField(-2, "__len")
 	}
+	l.Pop(1)
 
 	l.PushUserData(sh)
 	lua.SetMetaTableNamed(l, luaSpreadsheetTypeName)
@@ -0,0 +1,84 @@
+package luaxlsx
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// writeXLSX writes a small workbook with two sheets.
+func writeXLSX(t *testing.T) string {
+	t.Helper()
+	files := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Info" sheetId="1" r:id="rId1"/><sheet name="Prices" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Target="worksheets/sheet2.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<si><t>Article</t></si><si><r><t>Blue </t></r><r><t>pen</t></r></si></sst>`,
+		"xl/styles.xml": `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts><numFmt numFmtId="164" formatCode="dd.mm.yyyy"/></numFmts>
+<cellXfs><xf numFmtId="0"/><xf numFmtId="164"/><xf numFmtId="4"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData/></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<dimension ref="A1:D3"/><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="inlineStr"><is><t>Price</t></is></c></row>
+<row r="3"><c r="A3" t="s"><v>1</v></c><c r="B3" s="2"><v>1234.5</v></c><c r="C3" s="1"><v>46023</v></c><c r="D3" t="b"><v>1</v></c></row>
+</sheetData><mergeCells count="1"><mergeCell ref="B1:D1"/></mergeCells></worksheet>`,
+	}
+	fn := filepath.Join(t.TempDir(), "test.xlsx")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(contents))
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return filepath.ToSlash(fn)
+}
+
+func TestWorksheet(t *testing.T) {
+	fn := writeXLSX(t)
+	data := []struct {
+		code string
+		want string
+	}{
+		{`return #sh .. sh[2].name .. sh["Prices"].maxrow .. tostring(sh["Missing"])`, "2Prices3nil"},
+		{`local ws = sh["Prices"] return ws(1, 3) .. "|" .. ws("B3") .. "|" .. ws(2, 1)`, "Blue pen|1234.5|Price"},
+		{`local ws = sh["Prices"] local v, typ = ws:value("B3") return math.type(v) .. typ`, "floatnumber"},
+		{`local ws = sh["Prices"] local v, typ = ws:value(3, 3) return v.iso .. typ`, "2026-01-01date"},
+		{`local ws = sh["Prices"] local v, typ = ws:value("D3") return tostring(v) .. typ`, "trueboolean"},
+		{`local ws = sh["Prices"] local v, typ = ws:value("A2") return tostring(v) .. typ`, "nilempty"},
+		{`local ws = sh["Prices"] return ws:formatted("B3") .. "|" .. ws:formatted("C3") .. "|" .. ws:formatted("D3")`, "1,234.50|01.01.2026|TRUE"},
+		{`local ws = sh["Prices"] local m = ws:merge("C1") return m.ref .. #ws.merged .. tostring(ws:merge("A1"))`, "B1:D11nil"},
+		{`local ok, msg = xlsx.open("` + strings.TrimSuffix(fn, ".xlsx") + `.missing") return tostring(ok)`, "false"},
+		{`local d = xlsx.string_to_date("43589.563194444447") return d.hour .. ":" .. d.minute .. ":" .. d.second .. tostring(d.iso)`, "13:31:0nil"},
+		{`local s = "" for r, cells in sh["Prices"]:rows({formatted = true}) do s = s .. r .. ":" .. (cells[2] or "") .. ";" end return s`, "1:Price;3:1,234.50;"},
+	}
+	for _, tc := range data {
+		l := lua.NewState()
+		lua.OpenLibraries(l)
+		lua.Require(l, "xlsx", Open, true)
+		l.Pop(1)
+		code := `local sh = assert(xlsx.open("` + fn + `")) ` + tc.code
+		if err := lua.DoString(l, code); err != nil {
+			t.Fatalf("%s: %s", tc.code, err)
+		}
+		if got, _ := l.ToString(-1); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
@@ -94,3 +94,57 @@ func decodeXML(l *lua.State) int {
 	l.Insert(-2) // put true before the root table
 	return 2
 }
+
+// pushTree reads the contents of the element start from the decoder and
+// pushes the element as a table onto the stack. On error nothing is pushed.
+func pushTree(l *lua.State, dec *xml.Decoder, start xml.StartElement) error {
+	l.NewTable()
+	l.PushString("element")
+	l.SetField(-2, "type")
+	l.PushString(start.Name.Local)
+	l.SetField(-2, "name")
+	if len(start.Attr) > 0 {
+		pushAttributes(l, start.Attr)
+		l.SetField(-2, "attribs")
+	}
+	n := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			l.Pop(1)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if err = pushTree(l, dec, t); err != nil {
+				l.Pop(1)
+				return err
+			}
+		case xml.CharData:
+			l.PushString(string(t))
+		case xml.EndElement:
+			return nil
+		default:
+			continue
+		}
+		n++
+		l.RawSetInt(-2, n)
+	}
+}
+
+// pushAttributes pushes a table with the attributes. Attributes in a
+// namespace have the key namespace:name.
+func pushAttributes(l *lua.State, attrs []xml.Attr) {
+	l.CreateTable(0, len(attrs))
+	for _, attr := range attrs {
+		key := attr.Name.Local
+		if attr.Name.Space != "" {
+			key = attr.Name.Space + ":" + attr.Name.Local
+		}
+		l.PushString(attr.Value)
+		l.SetField(-2, key)
+	}
+}
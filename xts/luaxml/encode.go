@@ -0,0 +1,423 @@
+package luaxml
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	lua "github.com/speedata/go-lua"
+)
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// encodeOptions are the options of encode_table.
+type encodeOptions struct {
+	declaration bool   // write <?xml version="1.0" encoding="UTF-8"?>
+	indent      string // indentation per level, empty for no indentation
+}
+
+type encoder struct {
+	l    *lua.State
+	b    bytes.Buffer
+	opts encodeOptions
+	// namespaces holds the prefixes in scope and their URIs, one map per
+	// open element
+	namespaces []map[string]string
+}
+
+type attribute struct {
+	name  string
+	value string
+}
+
+func encodeTable(l *lua.State) int {
+	lua.CheckType(l, 1, lua.TypeTable)
+	filename := lua.OptString(l, 2, "data.xml")
+	e := &encoder{l: l}
+	if l.IsTable(3) {
+		l.Field(3, "declaration")
+		e.opts.declaration = l.ToBoolean(-1)
+		l.Pop(1)
+		l.Field(3, "indent")
+		if l.IsNumber(-1) {
+			n, _ := l.ToInteger(-1)
+			e.opts.indent = strings.Repeat(" ", n)
+		} else if s, ok := l.ToString(-1); ok {
+			e.opts.indent = s
+		}
+		l.Pop(1)
+	}
+	if e.opts.declaration {
+		e.b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+		if e.opts.indent != "" {
+			e.b.WriteByte('\n')
+		}
+	}
+	l.PushValue(1) // push table copy to top for encodeItem
+	if err := e.encodeItem(0); err != nil {
+		l.Pop(1)
+		return lerr(l, err.Error())
+	}
+	l.Pop(1)
+	if e.opts.indent != "" {
+		e.b.WriteByte('\n')
+	}
+	if err := os.WriteFile(filename, e.b.Bytes(), 0o644); err != nil {
+		return lerr(l, err.Error())
+	}
+	l.SetTop(0)
+	l.PushBoolean(true)
+	return 1
+}
+
+// stringField returns the string value of the field of the table at the top
+// of the stack.
+func (e *encoder) stringField(name string) (string, bool) {
+	e.l.Field(-1, name)
+	s, ok := e.l.ToString(-1)
+	e.l.Pop(1)
+	return s, ok
+}
+
+// encodeItem encodes the table at the top of the stack.
+func (e *encoder) encodeItem(level int) error {
+	typ, ok := e.stringField("type")
+	if !ok {
+		typ = "element"
+	}
+	switch typ {
+	case "element":
+		return e.encodeElement(level)
+	case "comment":
+		comment, ok := e.stringField("value")
+		if !ok {
+			return fmt.Errorf("error reading comment")
+		}
+		if strings.Contains(comment, "--") || strings.HasSuffix(comment, "-") {
+			return fmt.Errorf("comment must not contain \"--\" or end with \"-\"")
+		}
+		e.b.WriteString("<!--")
+		e.b.WriteString(comment)
+		e.b.WriteString("-->")
+	case "cdata":
+		text, _ := e.stringField("value")
+		// ]]> cannot be part of a CDATA section, so it is split into two
+		// sections
+		e.b.WriteString("<![CDATA[")
+		e.b.WriteString(strings.ReplaceAll(text, "]]>", "]]]]><![CDATA[>"))
+		e.b.WriteString("]]>")
+	case "pi":
+		target, _ := e.stringField("target")
+		value, _ := e.stringField("value")
+		if target == "" || strings.EqualFold(target, "xml") {
+			return fmt.Errorf("invalid processing instruction target %q", target)
+		}
+		if strings.Contains(value, "?>") {
+			return fmt.Errorf("processing instruction must not contain \"?>\"")
+		}
+		e.b.WriteString("<?")
+		e.b.WriteString(target)
+		if value != "" {
+			e.b.WriteByte(' ')
+			e.b.WriteString(value)
+		}
+		e.b.WriteString("?>")
+	default:
+		return fmt.Errorf("unknown type %q", typ)
+	}
+	return nil
+}
+
+// attributes reads the namespaces and attribs fields of the element at the
+// top of the stack. It returns the namespace declarations sorted by prefix,
+// the attributes given as a sequence of {name, value} pairs in their order
+// and all other attributes.
+func (e *encoder) attributes() ([]attribute, []attribute, []attribute, error) {
+	l := e.l
+	var nsdecl, ordered, named []attribute
+	l.Field(-1, "namespaces")
+	if l.IsTable(-1) {
+		l.PushNil()
+		for l.Next(-2) {
+			prefix, _ := l.ToString(-2)
+			uri, _ := l.ToString(-1)
+			name := "xmlns"
+			if prefix != "" {
+				name = "xmlns:" + prefix
+			}
+			nsdecl = append(nsdecl, attribute{name, uri})
+			l.Pop(1)
+		}
+	}
+	l.Pop(1)
+
+	l.Field(-1, "attribs")
+	if l.IsTable(-1) {
+		length := l.RawLength(-1)
+		for i := 1; i <= length; i++ {
+			l.RawGetInt(-1, i)
+			if !l.IsTable(-1) {
+				l.Pop(2)
+				return nil, nil, nil, fmt.Errorf("attribute %d: expected a table {name, value}", i)
+			}
+			l.RawGetInt(-1, 1)
+			name, _ := l.ToString(-1)
+			l.RawGetInt(-2, 2)
+			value, _ := l.ToString(-1)
+			l.Pop(3)
+			ordered = append(ordered, attribute{name, value})
+		}
+		l.PushNil()
+		for l.Next(-2) {
+			if l.TypeOf(-2) == lua.TypeString {
+				name, _ := l.ToString(-2)
+				value, _ := l.ToString(-1)
+				if name == "xmlns" || strings.HasPrefix(name, "xmlns:") {
+					nsdecl = append(nsdecl, attribute{name, value})
+				} else {
+					named = append(named, attribute{name, value})
+				}
+			}
+			l.Pop(1)
+		}
+	}
+	l.Pop(1)
+	sort.Slice(nsdecl, func(i, j int) bool { return nsdecl[i].name < nsdecl[j].name })
+	return nsdecl, ordered, named, nil
+}
+
+// lookupPrefix returns the URI of the prefix in scope.
+func (e *encoder) lookupPrefix(prefix string) (string, bool) {
+	for i := len(e.namespaces) - 1; i >= 0; i-- {
+		if uri, ok := e.namespaces[i][prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+// checkPrefix returns an error if the name has a prefix that is not declared.
+func (e *encoder) checkPrefix(name string) error {
+	prefix, _, ok := strings.Cut(name, ":")
+	if !ok || prefix == "xml" || prefix == "xmlns" {
+		return nil
+	}
+	if _, ok := e.lookupPrefix(prefix); ok {
+		return nil
+	}
+	return fmt.Errorf("undeclared namespace prefix %q in %q", prefix, name)
+}
+
+// attributeName returns the name of the attribute with a declared prefix.
+// decode_xml returns attributes in a namespace with the key URI:local, these
+// get a prefix that is declared for the URI. If there is none, a new prefix
+// is declared in scope and returned in decl.
+func (e *encoder) attributeName(name string, scope map[string]string) (string, *attribute) {
+	i := strings.LastIndexByte(name, ':')
+	if i < 0 {
+		return name, nil
+	}
+	uri, local := name[:i], name[i+1:]
+	if uri == "xml" || uri == "xmlns" {
+		return name, nil
+	}
+	if _, ok := e.lookupPrefix(uri); ok {
+		return name, nil
+	}
+	if uri == xmlNamespace {
+		return "xml:" + local, nil
+	}
+	if !strings.ContainsAny(uri, ":/") {
+		// an undeclared prefix, reported by checkPrefix
+		return name, nil
+	}
+	var prefixes []string
+	for _, ns := range e.namespaces {
+		for prefix, u := range ns {
+			if u == uri && prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		// the prefix must not be redeclared in an inner element
+		if inner, _ := e.lookupPrefix(prefix); inner == uri {
+			return prefix + ":" + local, nil
+		}
+	}
+	for n := 1; ; n++ {
+		prefix := fmt.Sprintf("ns%d", n)
+		if _, ok := e.lookupPrefix(prefix); !ok {
+			scope[prefix] = uri
+			return prefix + ":" + local, &attribute{"xmlns:" + prefix, uri}
+		}
+	}
+}
+
+// encodeElement encodes the element at the top of the stack.
+func (e *encoder) encodeElement(level int) error {
+	l := e.l
+	name, _ := e.stringField("name")
+	if name == "" {
+		return fmt.Errorf("element without a name")
+	}
+	nsdecl, ordered, named, err := e.attributes()
+	if err != nil {
+		return err
+	}
+	scope := map[string]string{}
+	for _, attr := range nsdecl {
+		if prefix, ok := strings.CutPrefix(attr.name, "xmlns:"); ok {
+			scope[prefix] = attr.value
+		}
+	}
+	e.namespaces = append(e.namespaces, scope)
+	defer func() { e.namespaces = e.namespaces[:len(e.namespaces)-1] }()
+	if err = e.checkPrefix(name); err != nil {
+		return err
+	}
+	for _, attrs := range [][]attribute{ordered, named} {
+		for i, attr := range attrs {
+			var decl *attribute
+			if attrs[i].name, decl = e.attributeName(attr.name, scope); decl != nil {
+				nsdecl = append(nsdecl, *decl)
+			}
+		}
+	}
+	sort.Slice(named, func(i, j int) bool { return named[i].name < named[j].name })
+	attrs := append(append(nsdecl, ordered...), named...)
+
+	e.b.WriteByte('<')
+	e.b.WriteString(name)
+	for _, attr := range attrs {
+		if err = e.checkPrefix(attr.name); err != nil {
+			return err
+		}
+		e.b.WriteByte(' ')
+		e.b.WriteString(attr.name)
+		e.b.WriteString(`="`)
+		escape(&e.b, attr.value, true)
+		e.b.WriteByte('"')
+	}
+
+	length := l.RawLength(-1)
+	if length == 0 {
+		e.b.WriteString("/>")
+		return nil
+	}
+	e.b.WriteByte('>')
+
+	// Children are only indented if the element has no text contents, so
+	// the indentation does not change mixed content.
+	indent := e.opts.indent != ""
+	for i := 1; i <= length && indent; i++ {
+		l.RawGetInt(-1, i)
+		if l.IsTable(-1) {
+			if typ, _ := e.stringField("type"); typ == "cdata" {
+				indent = false
+			}
+		} else if s, ok := l.ToString(-1); ok && strings.TrimSpace(s) != "" {
+			indent = false
+		}
+		l.Pop(1)
+	}
+
+	for i := 1; i <= length; i++ {
+		l.RawGetInt(-1, i)
+		switch l.TypeOf(-1) {
+		case lua.TypeTable:
+			if indent {
+				e.newline(level + 1)
+			}
+			if err = e.encodeItem(level + 1); err != nil {
+				l.Pop(1)
+				return err
+			}
+		case lua.TypeString, lua.TypeNumber:
+			s, _ := l.ToString(-1)
+			if !indent {
+				escape(&e.b, s, false)
+			}
+		default:
+			typename := lua.TypeNameOf(l, -1)
+			l.Pop(1)
+			return fmt.Errorf("unknown type: %s", typename)
+		}
+		l.Pop(1)
+	}
+	if indent {
+		e.newline(level)
+	}
+	e.b.WriteString("</")
+	e.b.WriteString(name)
+	e.b.WriteByte('>')
+	return nil
+}
+
+func (e *encoder) newline(level int) {
+	e.b.WriteByte('\n')
+	e.b.WriteString(strings.Repeat(e.opts.indent, level))
+}
+
+// escape writes s with the special XML characters escaped. Characters that
+// are not allowed in XML are replaced by U+FFFD.
+func escape(b *bytes.Buffer, s string, attribute bool) {
+	for _, r := range s {
+		switch {
+		case r == '&':
+			b.WriteString("&amp;")
+		case r == '<':
+			b.WriteString("&lt;")
+		case r == '>':
+			b.WriteString("&gt;")
+		case r == '\r':
+			b.WriteString("&#xD;")
+		case attribute && r == '"':
+			b.WriteString("&quot;")
+		case attribute && r == '\n':
+			b.WriteString("&#xA;")
+		case attribute && r == '\t':
+			b.WriteString("&#x9;")
+		case !isInCharacterRange(r):
+			b.WriteRune(utf8.RuneError)
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+func isInCharacterRange(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+// XMLName returns s with the characters that are not allowed in an XML
+// element name replaced by an underscore. Names that start with a digit get an
+// underscore in front.
+func XMLName(s string) string {
+	var sb strings.Builder
+	for i, r := range s {
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+			sb.WriteRune(r)
+		case i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'):
+			sb.WriteRune(r)
+		case i == 0 && unicode.IsDigit(r):
+			sb.WriteRune('_')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	if sb.Len() == 0 {
+		return "col"
+	}
+	return sb.String()
+}
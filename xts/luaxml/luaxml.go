@@ -1,11 +1,6 @@
 package luaxml
 
 import (
-	"bytes"
-	"encoding/xml"
-	"fmt"
-	"os"
-
 	lua "github.com/speedata/go-lua"
 )
 
@@ -16,126 +11,30 @@ func lerr(l *lua.State, errormessage string) int {
 	return 2
 }
 
-// encodeComment reads a comment from the table at the top of the stack
-func encodeComment(l *lua.State, enc *xml.Encoder) error {
-	l.Field(-1, "value")
-	if !l.IsString(-1) {
-		l.Pop(1)
-		return fmt.Errorf("error reading comment")
-	}
-	comment, _ := l.ToString(-1)
-	l.Pop(1)
-
-	c := xml.Comment([]byte(comment))
-	return enc.EncodeToken(c)
-}
-
-// encodeElement reads an element from the table at the top of the stack
-func encodeElement(l *lua.State, enc *xml.Encoder) error {
-	l.Field(-1, "name")
-	localName, _ := l.ToString(-1)
-	l.Pop(1)
-
-	start := xml.StartElement{
-		Name: xml.Name{
-			Local: localName,
-		},
-	}
-
-	// read attributes from attribs sub-table
-	l.Field(-1, "attribs")
-	if l.IsTable(-1) {
-		l.PushNil()
-		for l.Next(-2) {
-			key, _ := l.ToString(-2)
-			val, _ := l.ToString(-1)
-			start.Attr = append(start.Attr, xml.Attr{
-				Name:  xml.Name{Local: key},
-				Value: val,
-			})
-			l.Pop(1)
-		}
-	}
-	l.Pop(1)
-
-	if err := enc.EncodeToken(start); err != nil {
-		return err
-	}
-
-	// iterate table for children (integer keys)
-	l.PushNil()
-	for l.Next(-2) {
-		if l.IsNumber(-2) {
-			switch l.TypeOf(-1) {
-			case lua.TypeTable:
-				if err := encodeItem(l, enc); err != nil {
-					l.Pop(2) // key + value
-					return err
-				}
-			case lua.TypeString:
-				s, _ := l.ToString(-1)
-				if err := enc.EncodeToken(xml.CharData([]byte(s))); err != nil {
-					l.Pop(2)
-					return err
-				}
-			default:
-				l.Pop(2)
-				return fmt.Errorf("unknown type: %s", lua.TypeNameOf(l, -1))
-			}
-		}
-		l.Pop(1)
-	}
-
-	return enc.EncodeToken(start.End())
-}
-
-// encodeItem encodes the table at the top of the stack
-func encodeItem(l *lua.State, enc *xml.Encoder) error {
-	l.Field(-1, "type")
-	typ := "element"
-	if l.IsString(-1) {
-		typ, _ = l.ToString(-1)
-	}
-	l.Pop(1)
-
-	switch typ {
-	case "element":
-		return encodeElement(l, enc)
-	case "comment":
-		return encodeComment(l, enc)
-	}
-	return nil
-}
-
-func encodeTable(l *lua.State) int {
-	filename := "data.xml"
-	if l.Top() > 1 {
-		filename = lua.CheckString(l, 2)
-	}
-	var b bytes.Buffer
-	enc := xml.NewEncoder(&b)
-	lua.CheckType(l, 1, lua.TypeTable)
-	l.PushValue(1) // push table copy to top for encodeItem
-	if err := encodeItem(l, enc); err != nil {
-		l.Pop(1)
-		return lerr(l, err.Error())
-	}
-	l.Pop(1)
-	enc.Flush()
-	if err := os.WriteFile(filename, b.Bytes(), 0o644); err != nil {
-		return lerr(l, err.Error())
-	}
-	l.SetTop(0)
-	l.PushBoolean(true)
-	return 1
-}
-
 // Open starts this lua module
 func Open(l *lua.State) int {
 	lua.NewLibrary(l, []lua.RegistryFunction{
 		{Name: "encode_table", Function: encodeTable},
 		{Name: "decode_xml", Function: decodeXML},
+		{Name: "elements", Function: elements},
 		{Name: "run_xslt", Function: runXSLT},
+		{Name: "stream", Function: stream},
+		{Name: "parse_xml", Function: parseXML},
+		{Name: "xpath", Function: xpathEval},
+	})
+	registerDocumentMetaTable(l)
+	return 1
+}
+
+// OpenSafe starts this lua module without the functions that write files.
+func OpenSafe(l *lua.State) int {
+	lua.NewLibrary(l, []lua.RegistryFunction{
+		{Name: "decode_xml", Function: decodeXML},
+		{Name: "elements", Function: elements},
+		{Name: "stream", Function: stream},
+		{Name: "parse_xml", Function: parseXML},
+		{Name: "xpath", Function: xpathEval},
 	})
+	registerDocumentMetaTable(l)
 	return 1
 }
@@ -0,0 +1,158 @@
+package luaxml
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func runLua(t *testing.T, code string) string {
+	t.Helper()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lua.Require(l, "xml", Open, true)
+	l.Pop(1)
+	if err := lua.DoString(l, code); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := l.ToString(-1)
+	return s
+}
+
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fn, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.ToSlash(fn)
+}
+
+func TestXPath(t *testing.T) {
+	fn := writeFile(t, "data.xml", `<catalog xmlns:p="urn:price">
+  <article id="1" status="active" p:currency="EUR"><name>Pen</name><p:price>2.5</p:price></article>
+  <article id="2" status="sold"><name>Ink</name><p:price>4</p:price></article>
+  <article id="3" status="active"><name>Pad</name><p:price>3</p:price></article>
+</catalog>`)
+	data := []struct {
+		code string
+		want string
+	}{
+		{`local r = xml.xpath(FN, "//article[@status='active']/@id") return table.concat(r, ",")`, "1,3"},
+		{`local r = xml.xpath(FN, "count(//article)") return math.type(r[1])`, "integer"},
+		{`local r = xml.xpath(FN, "/catalog/article[2]") return r[1].name .. r[1].attribs.status .. r[1][1][1]`, "articlesoldInk"},
+		{`local r = xml.xpath(FN, "sum(//p:price)", {p = "urn:price"}) return tostring(r[1])`, "9.5"},
+		{`local doc = xml.parse_xml(FN) local r = doc:xpath({"string(//article[1]/name)", "//name"}) return r[1][1] .. #r[2]`, "Pen3"},
+		{`local ok, msg = xml.xpath(FN, "unknownfunction()") return tostring(ok)`, "false"},
+		{`local r = xml.xpath(FN, "/catalog/article[1]") local _, doc = xml.decode_xml(FN) local d = doc[2].attribs
+		  return r[1].attribs["urn:price:currency"] .. tostring(d["urn:price:currency"] == r[1].attribs["urn:price:currency"]) .. tostring(r[1].attribs["p:currency"])`, "EURtruenil"},
+	}
+	for _, tc := range data {
+		code := strings.ReplaceAll(tc.code, "FN", `"`+fn+`"`)
+		if got := runLua(t, code); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	fn := writeFile(t, "data.xml", `<export><!-- ERP -->
+  <article id="1"><name>Pen</name></article>
+  <other/>
+  <article id="2"><name>Ink</name></article>
+</export>`)
+	data := []struct {
+		code string
+		want string
+	}{
+		{`local s = "" for elt in xml.elements(FN, "article") do s = s .. elt.attribs.id .. elt[1][1] end return s`, "1Pen2Ink"},
+		{`local s = ""
+		  xml.stream(FN, {
+		    start_element = function(name, attribs) s = s .. "<" .. name .. (attribs.id or "") end,
+		    end_element = function(name) s = s .. ">" end,
+		    comment = function(c) s = s .. "#" .. c end,
+		  })
+		  return s`, "<export# ERP <article1<name>><other><article2<name>>>"},
+		{`local n = 0 xml.stream(FN, {start_element = function(name) n = n + 1 if name == "name" then return false end end}) return tostring(n)`, "3"},
+		{`local ok, msg = xml.stream(FN, {start_element = function() error("boom") end}) return tostring(ok)`, "false"},
+	}
+	for _, tc := range data {
+		code := strings.ReplaceAll(tc.code, "FN", `"`+fn+`"`)
+		if got := runLua(t, code); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeEncodeNamespaces(t *testing.T) {
+	src := `<Invoice xmlns="urn:inv" xmlns:x="urn:x" x:id="1" xml:lang="de"><Line x:no="2">Pen</Line></Invoice>`
+	fn := writeFile(t, "in.xml", src)
+	out := filepath.ToSlash(filepath.Join(t.TempDir(), "out.xml"))
+	code := `local _, doc = xml.decode_xml("` + fn + `") local ok, msg = xml.encode_table(doc, "` + out + `") return msg`
+	if msg := runLua(t, code); msg != "" {
+		t.Fatal(msg)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != src {
+		t.Errorf("got %q, want %q", got, src)
+	}
+}
+
+func TestEncodeTable(t *testing.T) {
+	out := filepath.ToSlash(filepath.Join(t.TempDir(), "out.xml"))
+	data := []struct {
+		code string
+		opts string
+		want string
+	}{
+		{`{name = "a", attribs = {z = "1", b = "<\"&>"}, "x < y"}`, `nil`, `<a b="&lt;&quot;&amp;&gt;" z="1">x &lt; y</a>`},
+		{`{name = "a", attribs = {{"z", "1"}, {"b", "2"}, c = "3"}}`, `nil`, `<a z="1" b="2" c="3"/>`},
+		{`{name = "rsm:Doc", namespaces = {rsm = "urn:rsm", [""] = "urn:default"}, {name = "rsm:Id", "42"}}`, `nil`,
+			`<rsm:Doc xmlns="urn:default" xmlns:rsm="urn:rsm"><rsm:Id>42</rsm:Id></rsm:Doc>`},
+		{`{name = "a", {type = "pi", target = "page", value = "break"}, {type = "cdata", value = "<b>]]></b>"}}`, `nil`,
+			`<a><?page break?><![CDATA[<b>]]]]><![CDATA[></b>]]></a>`},
+		{`{name = "a", {name = "b", "text"}, {name = "c", {name = "d"}}, {type = "comment", value = " c "}}`, `{declaration = true, indent = 2}`,
+			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<a>\n  <b>text</b>\n  <c>\n    <d/>\n  </c>\n  <!-- c -->\n</a>\n"},
+	}
+	for _, tc := range data {
+		code := `local ok, msg = xml.encode_table(` + tc.code + `, "` + out + `", ` + tc.opts + `) return msg`
+		if msg := runLua(t, code); msg != "" {
+			t.Fatalf("%s: %s", tc.code, msg)
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+	if msg := runLua(t, `local ok, msg = xml.encode_table({name = "p:a"}, "`+out+`") return msg`); msg != `undeclared namespace prefix "p" in "p:a"` {
+		t.Errorf("undeclared prefix: got %q", msg)
+	}
+	if msg := runLua(t, `local ok, msg = xml.encode_table({name = "a", attribs = {["urn:y:b"] = "1"}}, "`+out+`") return msg`); msg != "" {
+		t.Errorf("attribute in a namespace: %s", msg)
+	} else if got, _ := os.ReadFile(out); string(got) != `<a xmlns:ns1="urn:y" ns1:b="1"/>` {
+		t.Errorf("attribute in a namespace: got %q", got)
+	}
+	if got, want := XMLName("1st column"), "_1st_column"; got != want {
+		t.Errorf("XMLName: got %q, want %q", got, want)
+	}
+}
+
+func TestElementsBreak(t *testing.T) {
+	fn := writeFile(t, "data.xml", `<export><article id="1"/><article id="2"/></export>`)
+	// break closes the file, so the iterator does not return the second element
+	code := `local it, s, c, closer = xml.elements("` + fn + `", "article")
+	  for elt in it, s, c, closer do break end
+	  return tostring(it())`
+	if got := runLua(t, code); got != "nil" {
+		t.Errorf("got %q, want %q", got, "nil")
+	}
+}
@@ -0,0 +1,147 @@
+package luaxml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// elementsMetaTable is the name of the metatable for the state of an
+// elements iterator.
+const elementsMetaTable = "xml.elements"
+
+// elementsReader is the state of an elements iterator.
+type elementsReader struct {
+	f    *os.File
+	done bool
+}
+
+func (er *elementsReader) close() {
+	if !er.done {
+		er.done = true
+		er.f.Close()
+	}
+}
+
+// closeElements closes the file of an elements iterator. The generic for
+// calls it when the loop ends, also on break or error.
+func closeElements(l *lua.State) int {
+	if er, ok := l.ToUserData(1).(*elementsReader); ok {
+		er.close()
+	}
+	return 0
+}
+
+// elements returns an iterator over all elements with the given name:
+// for elt in xml.elements(filename, name) do ... end. Each element is a table
+// in the format of decode_xml. Only the current element is kept in memory.
+// The fourth return value is a to-be-closed value that closes the file when
+// the loop is left early.
+func elements(l *lua.State) int {
+	filename := lua.CheckString(l, 1)
+	name := lua.CheckString(l, 2)
+	f, err := os.Open(filename)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	er := &elementsReader{f: f}
+	dec := xml.NewDecoder(f)
+	l.PushGoFunction(func(l *lua.State) int {
+		if er.done {
+			l.PushNil()
+			return 1
+		}
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				er.close()
+				if err == io.EOF {
+					l.PushNil()
+					return 1
+				}
+				lua.Errorf(l, "%s: %s", filename, err.Error())
+			}
+			if start, ok := tok.(xml.StartElement); ok && start.Name.Local == name {
+				if err = pushTree(l, dec, start); err != nil {
+					er.close()
+					lua.Errorf(l, "%s: %s", filename, err.Error())
+				}
+				return 1
+			}
+		}
+	})
+	l.PushNil()
+	l.PushNil()
+	if lua.NewMetaTable(l, elementsMetaTable) {
+		l.PushGoFunction(closeElements)
+		l.SetField(-2, "__close")
+	}
+	l.Pop(1)
+	l.PushUserData(er)
+	lua.SetMetaTableNamed(l, elementsMetaTable)
+	return 4
+}
+
+// stream reads an XML file and calls the functions in the handler table for
+// each event: start_element(name, attribs), end_element(name), text(string)
+// and comment(string). A handler that returns false stops reading.
+func stream(l *lua.State) int {
+	filename := lua.CheckString(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+	f, err := os.Open(filename)
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	defer f.Close()
+
+	dec := xml.NewDecoder(f)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return lerr(l, fmt.Sprintf("%s: %s", filename, err.Error()))
+		}
+		var handler string
+		var nargs int
+		switch t := tok.(type) {
+		case xml.StartElement:
+			handler, nargs = "start_element", 2
+			l.Field(2, handler)
+			l.PushString(t.Name.Local)
+			pushAttributes(l, t.Attr)
+		case xml.EndElement:
+			handler, nargs = "end_element", 1
+			l.Field(2, handler)
+			l.PushString(t.Name.Local)
+		case xml.CharData:
+			handler, nargs = "text", 1
+			l.Field(2, handler)
+			l.PushString(string(t))
+		case xml.Comment:
+			handler, nargs = "comment", 1
+			l.Field(2, handler)
+			l.PushString(string(t))
+		default:
+			continue
+		}
+		if l.IsNil(-nargs - 1) {
+			l.Pop(nargs + 1)
+			continue
+		}
+		if err = l.ProtectedCall(nargs, 1, 0); err != nil {
+			return lerr(l, fmt.Sprintf("%s: %s", handler, err.Error()))
+		}
+		stop := l.IsBoolean(-1) && !l.ToBoolean(-1)
+		l.Pop(1)
+		if stop {
+			break
+		}
+	}
+	l.PushBoolean(true)
+	return 1
+}
@@ -0,0 +1,180 @@
+package luaxml
+
+import (
+	"fmt"
+	"os"
+
+	lua "github.com/speedata/go-lua"
+	"github.com/speedata/goxml"
+	"github.com/speedata/goxpath"
+)
+
+// documentMetaTable is the name of the metatable for parsed XML documents.
+const documentMetaTable = "xml.document"
+
+// parsedDocument is the userdata returned by xml.parse_xml.
+type parsedDocument struct {
+	doc *goxml.XMLDocument
+}
+
+func parseFile(filename string) (*parsedDocument, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	doc, err := goxml.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &parsedDocument{doc: doc}, nil
+}
+
+// parseXML reads an XML file and returns a document that can be used with
+// xml.xpath to evaluate several expressions without parsing the file again.
+func parseXML(l *lua.State) int {
+	pd, err := parseFile(lua.CheckString(l, 1))
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	l.PushUserData(pd)
+	lua.SetMetaTableNamed(l, documentMetaTable)
+	return 1
+}
+
+// xpathEval evaluates one or more XPath expressions:
+// xml.xpath(file_or_doc, expr, namespaces). If expr is a table of
+// expressions, the result is a table with one result per expression.
+func xpathEval(l *lua.State) int {
+	var pd *parsedDocument
+	if l.TypeOf(1) == lua.TypeString {
+		var err error
+		if pd, err = parseFile(lua.CheckString(l, 1)); err != nil {
+			return lerr(l, err.Error())
+		}
+	} else {
+		pd = lua.CheckUserData(l, 1, documentMetaTable).(*parsedDocument)
+	}
+
+	ctx := goxpath.NewContext(pd.doc)
+	if l.IsTable(3) {
+		l.PushNil()
+		for l.Next(3) {
+			prefix, _ := l.ToString(-2)
+			uri, _ := l.ToString(-1)
+			ctx.Namespaces[prefix] = uri
+			l.Pop(1)
+		}
+	}
+	xp := &goxpath.Parser{Ctx: ctx}
+
+	if l.IsTable(2) {
+		length := l.RawLength(2)
+		l.CreateTable(length, 0)
+		for i := 1; i <= length; i++ {
+			l.RawGetInt(2, i)
+			expr, _ := l.ToString(-1)
+			l.Pop(1)
+			seq, err := evaluate(xp, pd.doc, expr)
+			if err != nil {
+				return lerr(l, err.Error())
+			}
+			pushSequence(l, seq)
+			l.RawSetInt(-2, i)
+		}
+		return 1
+	}
+	seq, err := evaluate(xp, pd.doc, lua.CheckString(l, 2))
+	if err != nil {
+		return lerr(l, err.Error())
+	}
+	pushSequence(l, seq)
+	return 1
+}
+
+// evaluate evaluates the expression with the document as the context item.
+func evaluate(xp *goxpath.Parser, doc *goxml.XMLDocument, expr string) (goxpath.Sequence, error) {
+	xp.Ctx.SetContextSequence(goxpath.Sequence{doc})
+	seq, err := xp.Evaluate(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", expr, err)
+	}
+	return seq, nil
+}
+
+// pushSequence pushes the items of the sequence as an array. Elements are
+// tables in the format of decode_xml, numbers and booleans keep their type
+// and all other items are converted to strings.
+func pushSequence(l *lua.State, seq goxpath.Sequence) {
+	l.CreateTable(len(seq), 0)
+	for i, itm := range seq {
+		switch t := itm.(type) {
+		case *goxml.Element:
+			PushElement(l, t)
+		case *goxml.XMLDocument:
+			root, err := t.Root()
+			if err != nil {
+				l.PushNil()
+			} else {
+				PushElement(l, root)
+			}
+		case int:
+			l.PushInteger(t)
+		case float64:
+			l.PushNumber(t)
+		case bool:
+			l.PushBoolean(t)
+		default:
+			l.PushString(goxpath.ItemStringvalue(t))
+		}
+		l.RawSetInt(-2, i+1)
+	}
+}
+
+// PushElement pushes the element as a table in the format of decode_xml.
+func PushElement(l *lua.State, elt *goxml.Element) {
+	l.NewTable()
+	l.PushString("element")
+	l.SetField(-2, "type")
+	l.PushString(elt.Name)
+	l.SetField(-2, "name")
+	if attrs := elt.Attributes(); len(attrs) > 0 {
+		l.NewTable()
+		for _, attr := range attrs {
+			// the same keys as in decode_xml
+			key := attr.Name
+			if attr.Namespace != "" {
+				key = attr.Namespace + ":" + attr.Name
+			}
+			l.PushString(attr.Value)
+			l.SetField(-2, key)
+		}
+		l.SetField(-2, "attribs")
+	}
+	i := 1
+	for _, cld := range elt.Children() {
+		switch t := cld.(type) {
+		case *goxml.Element:
+			PushElement(l, t)
+		case goxml.CharData:
+			l.PushString(t.Contents)
+		default:
+			continue
+		}
+		l.RawSetInt(-2, i)
+		i++
+	}
+}
+
+// registerDocumentMetaTable creates the metatable for parsed documents, so
+// doc:xpath(expr, namespaces) is the same as xml.xpath(doc, expr, namespaces).
+func registerDocumentMetaTable(l *lua.State) {
+	if lua.NewMetaTable(l, documentMetaTable) {
+		l.NewTable()
+		lua.SetFunctions(l, []lua.RegistryFunction{
+			{Name: "xpath", Function: xpathEval},
+		}, 0)
+		l.SetField(-2, "__index")
+	}
+	l.Pop(1)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -38,7 +39,8 @@ var (
 
 // config holds global configuration that is not document dependant. The
 // mapstructure are for the Lua filter to map between these settings and the Lua
-// values.
+// values. Safe can only be set in the configuration file and on the command
+// line, the filter must not be able to switch off safe mode.
 type config struct {
 	basedir      string
 	libdir       string
@@ -52,6 +54,7 @@ type config struct {
 	Mode         []string       `mapstructure:"mode"`
 	Quiet        bool           `mapstructure:"quiet"`
 	Runs         int            `mapstructure:"runs"`
+	Safe         bool           `mapstructure:"-" toml:"safe"`
 	Systemfonts  bool           `mapstructure:"systemfonts"`
 	SuppressInfo bool           `mapstructure:"suppressinfo"`
 	Verbose      bool           `mapstructure:"verbose"`
@@ -235,6 +238,7 @@ func dothings() error {
 	op.On("--mode NAME", "Set mode. Multiple modes given in a comma separated list.", cmdline)
 	op.On("--quiet", "Run XTS in quiet mode (no output on STDOUT)", cmdline)
 	op.On("--runs N", "Run XTS N times", cmdline)
+	op.On("--safe", "Disable file, environment and process access in Lua code", cmdline)
 	op.On("--suppressinfo", "Create a reproducible document", cmdline)
 	op.On("--systemfonts", "Use system fonts", cmdline)
 	op.On("--trace NAMES", "Set the trace to one or more of grid, allocation", cmdline)
@@ -294,6 +298,8 @@ func dothings() error {
 			configuration.Mode = strings.Split(v, ",")
 		case "quiet":
 			configuration.Quiet = (v == "true")
+		case "safe":
+			configuration.Safe = (v == "true")
 		case "suppressinfo":
 			configuration.SuppressInfo = (v == "true")
 		case "systemfonts":
@@ -448,10 +454,25 @@ func dothings() error {
 			slog.Info(fmt.Sprintf("Use configuration file %s", cfg))
 		}
 
+		defer luaRuntime.Cleanup()
 		if luafile := configuration.Filter; luafile != "" {
-			if err = runLuaScript(luafile); err != nil {
+			var publishRun bool
+			if publishRun, err = runLuaScript(luafile); err != nil {
 				return err
 			}
+			if !publishRun {
+				slog.Info("Filter skipped the publishing run")
+				if _, err = runFinalizerCallback(info, nil, protocolFilename, true); err != nil {
+					slog.Error(err.Error())
+				}
+				dur := time.Since(starttime)
+				slog.Info(fmt.Sprintf("Finished in %s", formatDuration(dur)))
+				fmt.Printf("Finished with %s and %s in %s.\n", pluralize(errCount, "error"), pluralize(warnCount, "warning"), formatDuration(dur))
+				if errCount > 0 {
+					return core.TypesettingError{Logged: true}
+				}
+				return nil
+			}
 		}
 
 		var layoutpath, datapath string
@@ -479,57 +500,56 @@ func dothings() error {
 		slog.Debug("checksum", "filename", configuration.Layout, "md5", md5calc(configuration.Layout))
 		slog.Debug("checksum", "filename", configuration.Data, "md5", md5calc(configuration.Data))
 
-		for i := 0; i < int(configuration.Runs); i++ {
-			if cr := configuration.Runs; cr > 1 {
-				slog.Info(fmt.Sprintf("Run %d of %d", i+1, cr))
-			}
-			lr.Seek(0, io.SeekStart)
-			dr.Seek(0, io.SeekStart)
-			xc := &core.XTSConfig{
-				Datafile:     dr,
-				FindFile:     core.FindFile,
-				Layoutfile:   lr,
-				Mode:         configuration.Mode,
-				OutFilename:  configuration.Jobname + ".pdf",
-				Jobname:      configuration.Jobname,
-				SuppressInfo: configuration.SuppressInfo,
-				Tracing:      configuration.Trace,
-				Variables:    configuration.VariablesMap,
-			}
+		info, err = runWithFinalizer(func() (core.PublishingInfo, error) {
+			var info core.PublishingInfo
+			for i := 0; i < int(configuration.Runs); i++ {
+				if cr := configuration.Runs; cr > 1 {
+					slog.Info(fmt.Sprintf("Run %d of %d", i+1, cr))
+				}
+				lr.Seek(0, io.SeekStart)
+				dr.Seek(0, io.SeekStart)
+				xc := &core.XTSConfig{
+					Datafile:     dr,
+					FindFile:     core.FindFile,
+					Layoutfile:   lr,
+					LuaModules:   luaModules(),
+					Mode:         configuration.Mode,
+					OutFilename:  configuration.Jobname + ".pdf",
+					Safe:         configuration.Safe,
+					Jobname:      configuration.Jobname,
+					SuppressInfo: configuration.SuppressInfo,
+					Tracing:      configuration.Trace,
+					Variables:    configuration.VariablesMap,
+				}
 
-			if fn := dumpOutputFileName; fn != "" {
-				w, err := os.Create(fn)
+				if fn := dumpOutputFileName; fn != "" {
+					w, err := os.Create(fn)
+					if err != nil {
+						return info, err
+					}
+					xc.DumpFile = w
+
+				}
+				err := core.RunXTS(xc)
+				info = xc.Info
 				if err != nil {
-					return err
+					return info, err
 				}
-				xc.DumpFile = w
-
-			}
-			err = core.RunXTS(xc)
-			info = xc.Info
-			if err != nil {
-				goto finished
 			}
-		}
+			return info, nil
+		}, protocolFilename)
 		if lrc, ok := lr.(io.ReadCloser); ok {
-			if err = lrc.Close(); err != nil {
-				return err
+			if cerr := lrc.Close(); cerr != nil {
+				err = errors.Join(err, cerr)
 			}
 		}
 		if drc, ok := dr.(io.ReadCloser); ok {
-			if err = drc.Close(); err != nil {
-				return err
+			if cerr := drc.Close(); cerr != nil {
+				err = errors.Join(err, cerr)
 			}
 		}
-	finished:
 		if err != nil {
-			if terr, ok := err.(core.TypesettingError); ok {
-				if !terr.Logged {
-					slog.Error(terr.Msg)
-				}
-			} else {
-				slog.Error(err.Error())
-			}
+			logError(err)
 		}
 		dur := time.Since(starttime)
 		slog.Info(fmt.Sprintf("Finished in %s", formatDuration(dur)))
@@ -543,6 +563,26 @@ func dothings() error {
 	return nil
 }
 
+// logError writes err to the protocol unless it is a TypesettingError that
+// is already logged. The errors of a joined error (for example the error of
+// the publishing run and the error of the finalizer) are logged one by one.
+func logError(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			logError(e)
+		}
+		return
+	}
+	var terr core.TypesettingError
+	if errors.As(err, &terr) {
+		if !terr.Logged {
+			slog.Error(terr.Msg)
+		}
+		return
+	}
+	slog.Error(err.Error())
+}
+
 func main() {
 	if cpuprofile := os.Getenv("CPUPROFILE"); cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	lua "github.com/speedata/go-lua"
+	"github.com/speedata/xts/core"
+)
+
+// publishConfig holds the settings of one runtime.publish() call. The
+// defaults are the current options of the filter.
+type publishConfig struct {
+	layout    string
+	data      string
+	jobname   string
+	mode      []string
+	runs      int
+	dummy     bool
+	variables map[string]any
+}
+
+// optionString returns the option as a string or "" if it is not set.
+func optionString(name string) string {
+	if v, ok := options[name]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// optionStrings returns a list option such as mode, which can be a list or a
+// comma separated string.
+func optionStrings(name string) []string {
+	switch t := options[name].(type) {
+	case []string:
+		return t
+	case string:
+		if t == "" {
+			return nil
+		}
+		return strings.Split(t, ",")
+	}
+	return nil
+}
+
+// readPublishConfig reads the table at index 1.
+func readPublishConfig(l *lua.State) *publishConfig {
+	pc := &publishConfig{
+		layout:    optionString("layout"),
+		data:      optionString("data"),
+		jobname:   optionString("jobname"),
+		mode:      optionStrings("mode"),
+		runs:      1,
+		dummy:     optionString("dummy") == "true",
+		variables: maps.Clone(configuration.VariablesMap),
+	}
+	if runs, err := strconv.Atoi(optionString("runs")); err == nil {
+		pc.runs = runs
+	}
+	for _, opt := range []struct {
+		key string
+		val *string
+	}{{"layout", &pc.layout}, {"data", &pc.data}, {"jobname", &pc.jobname}} {
+		l.Field(1, opt.key)
+		if l.IsString(-1) {
+			*opt.val, _ = l.ToString(-1)
+		}
+		l.Pop(1)
+	}
+	l.Field(1, "mode")
+	switch l.TypeOf(-1) {
+	case lua.TypeString:
+		s, _ := l.ToString(-1)
+		pc.mode = strings.Split(s, ",")
+	case lua.TypeTable:
+		pc.mode = nil
+		for i := 1; i <= l.RawLength(-1); i++ {
+			l.RawGetInt(-1, i)
+			s, _ := l.ToString(-1)
+			l.Pop(1)
+			pc.mode = append(pc.mode, s)
+		}
+	}
+	l.Pop(1)
+	l.Field(1, "runs")
+	if n, ok := l.ToInteger(-1); ok {
+		pc.runs = n
+	}
+	l.Pop(1)
+	l.Field(1, "dummy")
+	if l.IsBoolean(-1) {
+		pc.dummy = l.ToBoolean(-1)
+	}
+	l.Pop(1)
+	l.Field(1, "variables")
+	if l.IsTable(-1) {
+		l.PushNil()
+		for l.Next(-2) {
+			l.PushValue(-2) // ToString changes numbers in place
+			name, _ := l.ToString(-1)
+			l.Pop(1)
+			pc.variables[name] = core.LuaToSequence(l, -1)
+			l.Pop(1)
+		}
+	}
+	l.Pop(1)
+	return pc
+}
+
+// run typesets the document pc.runs times.
+func (pc *publishConfig) run() (core.PublishingInfo, error) {
+	var info core.PublishingInfo
+	layoutpath, err := core.FindFile(pc.layout)
+	if err != nil {
+		return info, err
+	}
+	lr, err := os.Open(layoutpath)
+	if err != nil {
+		return info, err
+	}
+	defer lr.Close()
+	var dr io.ReadSeeker = strings.NewReader(`<data />`)
+	if !pc.dummy {
+		datapath, err := core.FindFile(pc.data)
+		if err != nil {
+			return info, err
+		}
+		f, err := os.Open(datapath)
+		if err != nil {
+			return info, err
+		}
+		defer f.Close()
+		dr = f
+	}
+	for i := 0; i < max(pc.runs, 1); i++ {
+		if pc.runs > 1 {
+			slog.Info(fmt.Sprintf("Run %d of %d", i+1, pc.runs))
+		}
+		lr.Seek(0, io.SeekStart)
+		dr.Seek(0, io.SeekStart)
+		xc := &core.XTSConfig{
+			Datafile:     dr,
+			FindFile:     core.FindFile,
+			Layoutfile:   lr,
+			LuaModules:   luaModules(),
+			Mode:         pc.mode,
+			OutFilename:  pc.jobname + ".pdf",
+			Safe:         configuration.Safe,
+			Jobname:      pc.jobname,
+			SuppressInfo: configuration.SuppressInfo,
+			Tracing:      configuration.Trace,
+			Variables:    pc.variables,
+		}
+		err = core.RunXTS(xc)
+		info = xc.Info
+		if err != nil {
+			return info, err
+		}
+	}
+	return info, nil
+}
+
+// pushPublishingInfo pushes a table with the result of a publishing run.
+func pushPublishingInfo(l *lua.State, jobname string, info core.PublishingInfo, errors, warnings int, runErr error) {
+	pdfPath, _ := filepath.Abs(jobname + ".pdf")
+	l.NewTable()
+	l.PushString(pdfPath)
+	l.SetField(-2, "pdf")
+	l.PushString(jobname)
+	l.SetField(-2, "jobname")
+	l.PushInteger(info.Pages)
+	l.SetField(-2, "pages")
+	l.PushInteger(int(info.FileSize))
+	l.SetField(-2, "filesize")
+	l.PushInteger(errors)
+	l.SetField(-2, "errors")
+	l.PushInteger(warnings)
+	l.SetField(-2, "warnings")
+	if runErr != nil {
+		l.PushString(runErr.Error())
+		l.SetField(-2, "error")
+	}
+}
+
+// publish starts a publishing run from the Lua filter:
+// runtime.publish{layout=..., data=..., jobname=..., mode=..., variables=...}.
+// It returns true and a table with the result or false, an error message and
+// the table.
+func publish(l *lua.State) int {
+	lua.CheckType(l, 1, lua.TypeTable)
+	pc := readPublishConfig(l)
+	slog.Info(fmt.Sprintf("Publish %s with layout %s", pc.jobname, pc.layout))
+	errBefore, warnBefore := errCount, warnCount
+	info, err := pc.run()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	errors, warnings := errCount-errBefore, warnCount-warnBefore
+
+	if err == nil && errors == 0 {
+		l.PushBoolean(true)
+		pushPublishingInfo(l, pc.jobname, info, errors, warnings, nil)
+		return 2
+	}
+	l.PushBoolean(false)
+	if err != nil {
+		l.PushString(err.Error())
+	} else {
+		l.PushString(fmt.Sprintf("publishing run finished with %s", pluralize(errors, "error")))
+	}
+	pushPublishingInfo(l, pc.jobname, info, errors, warnings, err)
+	return 3
+}